@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/boltdb/bolt"
+)
+
+type ChangePasswordRequestJSON struct {
+	Token       string `json:"token"`
+	OldPassword string `json:"oldpassword"`
+	NewPassword string `json:"newpassword"`
+}
+
+type DeleteUserRequestJSON struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// confirmPassword checks the password a client gave to confirm an account
+// change. Like authenticating, every attempt counts towards the user's rate
+// limit, so a stolen token can't be used to guess the password. If the
+// password can't be confirmed, an error is written to res and nil is
+// returned.
+func confirmPassword(res http.ResponseWriter, username string, password string) *User {
+	if ok, retryAfter := AuthUserLimiter.Allow(username); !ok {
+		writeTooManyRequests(res, retryAfter)
+		fmt.Fprintf(res, "Too many authentication requests for user %v", username)
+		log.Printf("Rate limited authentication requests for user %v", username)
+		return nil
+	}
+
+	var user *User
+	err := MainDB.View(func(tx *bolt.Tx) error {
+		var err error
+		user, err = getUser(tx, username)
+		return err
+	})
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error reading user %v: %v", username, err)
+		return nil
+	}
+	if user == nil {
+		res.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(res, "User %v is not a registered user", username)
+		return nil
+	}
+
+	if checkPassword(user, password) != nil {
+		res.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(res, "Invalid password given for user %v", username)
+		return nil
+	}
+	return user
+}
+
+func changePasswordHandler(res http.ResponseWriter, req *http.Request) {
+	requestJSON := ChangePasswordRequestJSON{}
+	err := json.NewDecoder(req.Body).Decode(&requestJSON)
+	if err != nil || requestJSON.NewPassword == "" {
+		res.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(res, "Error in decoding message")
+		return
+	}
+
+	// Check and validate token
+	token := validateToken(res, requestJSON.Token, ScopeAccount)
+	if token == nil {
+		return
+	}
+	if confirmPassword(res, token.User.Username, requestJSON.OldPassword) == nil {
+		return
+	}
+
+	hashedData, err := hashPassword(requestJSON.NewPassword)
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error hashing new password of user %v: %v", token.User.Username, err)
+		return
+	}
+
+	// Whoever knew the old password may hold tokens, so they all go
+	var user *User
+	err = MainDB.Update(func(tx *bolt.Tx) error {
+		user, err = getUser(tx, token.User.Username)
+		if err != nil {
+			return err
+		}
+		if user == nil {
+			return fmt.Errorf("Owner of token %v does not exist", token.User.Username)
+		}
+
+		user.PasswordHash = hashedData
+		_, err = revokeUserTokens(tx, user)
+		if err != nil {
+			return err
+		}
+		return putUser(tx, user)
+	})
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error changing password of user %v: %v", token.User.Username, err)
+		return
+	}
+	setTokenEpoch(user.Username, user.TokenEpoch)
+	log.Printf("Password of user %v has been changed, and their tokens revoked", user.Username)
+}
+
+func deleteUserHandler(res http.ResponseWriter, req *http.Request) {
+	requestJSON := DeleteUserRequestJSON{}
+	err := json.NewDecoder(req.Body).Decode(&requestJSON)
+	if err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(res, "Error in decoding message")
+		return
+	}
+
+	// Check and validate token
+	token := validateToken(res, requestJSON.Token, ScopeAccount)
+	if token == nil {
+		return
+	}
+	if confirmPassword(res, token.User.Username, requestJSON.Password) == nil {
+		return
+	}
+
+	// As when deleting an object, every record goes in a single transaction
+	// before any data is removed
+	var deletedObjects []Object
+	err = MainDB.Update(func(tx *bolt.Tx) error {
+		user, err := getUser(tx, token.User.Username)
+		if err != nil {
+			return err
+		}
+		if user == nil {
+			return fmt.Errorf("Owner of token %v does not exist", token.User.Username)
+		}
+
+		// removeObject also cancels the object's pending uploads
+		objectIDs := append([]int{}, user.ObjectIDs...)
+		for _, id := range objectIDs {
+			object, err := getObject(tx, id)
+			if err != nil {
+				return err
+			}
+			if object == nil {
+				continue
+			}
+			err = forgetGrants(tx, user.Username, object.Name, object.Grants)
+			if err != nil {
+				return err
+			}
+			err = removeObject(tx, user, object)
+			if err != nil {
+				return err
+			}
+			deletedObjects = append(deletedObjects, *object)
+		}
+
+		_, err = revokeUserTokens(tx, user)
+		if err != nil {
+			return err
+		}
+		err = deleteUserDevices(tx, user.Username)
+		if err != nil {
+			return err
+		}
+		err = deleteUserShares(tx, user.Username)
+		if err != nil {
+			return err
+		}
+		err = removeGroupMemberships(tx, user.Username)
+		if err != nil {
+			return err
+		}
+		_, err = deleteLinks(tx, func(link *Link) (bool, error) {
+			return link.Owner == user.Username, nil
+		})
+		if err != nil {
+			return err
+		}
+		return tx.Bucket([]byte("users")).Delete([]byte(user.Username))
+	})
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error deleting user %v: %v", token.User.Username, err)
+		return
+	}
+	forgetTokenEpoch(token.User.Username)
+
+	for _, object := range deletedObjects {
+		removeObjectData(&object)
+	}
+	// Don't leave the user's data behind until the janitor next runs
+	_, err = collectBlobs()
+	if err != nil {
+		log.Printf("Error collecting blobs of deleted user %v: %v", token.User.Username, err)
+	}
+	log.Printf("User %v has been deleted, along with %v objects", token.User.Username, len(deletedObjects))
+}
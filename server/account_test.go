@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func changeTestPassword(t *testing.T, token string, oldPassword string, newPassword string) int {
+	changeJSON := ChangePasswordRequestJSON{Token: token, OldPassword: oldPassword, NewPassword: newPassword}
+	buffer, _ := json.Marshal(changeJSON)
+	req, err := http.NewRequest("PUT", "/user/password", bytes.NewBuffer(buffer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(changePasswordHandler).ServeHTTP(rr, req)
+	return rr.Code
+}
+
+func deleteTestUser(t *testing.T, token string, password string) int {
+	deleteJSON := DeleteUserRequestJSON{Token: token, Password: password}
+	buffer, _ := json.Marshal(deleteJSON)
+	req, err := http.NewRequest("DELETE", "/user", bytes.NewBuffer(buffer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(deleteUserHandler).ServeHTTP(rr, req)
+	return rr.Code
+}
+
+func TestChangePassword(t *testing.T) {
+	// This takes more attempts than a user is usually allowed
+	oldLimiter := AuthUserLimiter
+	AuthUserLimiter = NewRateLimiter(6000, 1000)
+	defer func() { AuthUserLimiter = oldLimiter }()
+
+	token := createAndAuthUser(t, "rotator", "foobar")
+	signedToken := signedTestToken(t, "rotator", "foobar")
+
+	if status := changeTestPassword(t, token, "wrong", "barfoo"); status != http.StatusForbidden {
+		t.Errorf("Expected wrong old password to be refused. Got %v", status)
+	}
+	if status := changeTestPassword(t, token, "foobar", ""); status != http.StatusBadRequest {
+		t.Errorf("Expected empty new password to be refused. Got %v", status)
+	}
+	if status := changeTestPassword(t, token, "foobar", "barfoo"); status != http.StatusOK {
+		t.Fatalf("password handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	// Every token issued under the old password is revoked
+	for _, revoked := range []string{token, signedToken} {
+		if status, _ := getTestObject(t, revoked, "filename=anything"); status != http.StatusNotFound {
+			t.Errorf("Expected token to be revoked. Got %v", status)
+		}
+	}
+
+	if rr := authTestRequest(t, "rotator", "foobar"); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected old password to be refused. Got %v", rr.Code)
+	}
+	authTestUser(t, "rotator", "barfoo")
+}
+
+func TestDeleteUser(t *testing.T) {
+	token := createAndAuthUser(t, "leaver", "foobar")
+	stayerToken := createAndAuthUser(t, "stayer", "foobar")
+
+	uploadTestObject(t, token, "mine.txt", []byte("only leaver has this"))
+	uploadTestObject(t, token, "shared.txt", []byte("both have this"))
+	uploadTestObject(t, stayerToken, "shared.txt", []byte("both have this"))
+	uploadID := createTestObject(t, token, "pending.txt")
+
+	var ownData string
+	err := MainDB.View(func(tx *bolt.Tx) error {
+		owner, err := getUser(tx, "leaver")
+		if err != nil {
+			return err
+		}
+		versions, err := findObjectVersions(tx, owner, "mine.txt")
+		ownData = versions[0].LocalFileName
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status := deleteTestUser(t, token, "wrong"); status != http.StatusForbidden {
+		t.Errorf("Expected wrong password to be refused. Got %v", status)
+	}
+	if status := deleteTestUser(t, token, "foobar"); status != http.StatusOK {
+		t.Fatalf("delete user handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	if status, _ := getTestObject(t, token, "filename=mine.txt"); status != http.StatusNotFound {
+		t.Errorf("Expected token of deleted user to be revoked. Got %v", status)
+	}
+	if rr := authTestRequest(t, "leaver", "foobar"); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected deleted user to be unknown. Got %v", rr.Code)
+	}
+	if _, err := os.Stat(path.Join(DataPath, ownData)); !os.IsNotExist(err) {
+		t.Errorf("Expected data of deleted user to be removed. Got %v", err)
+	}
+	err = MainDB.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte("uploads")).Get([]byte(uploadID)) != nil {
+			t.Errorf("Expected pending upload of deleted user to be cancelled")
+		}
+		return tx.Bucket([]byte("objects")).ForEach(func(k, v []byte) error {
+			object := Object{}
+			err := json.Unmarshal(v, &object)
+			if object.Owner == "leaver" {
+				t.Errorf("Expected objects of deleted user to be removed. Found %v", object.Name)
+			}
+			return err
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Data shared with someone else stays theirs
+	if status, body := getTestObject(t, stayerToken, "filename=shared.txt"); status != http.StatusOK || body != "both have this" {
+		t.Errorf("Expected shared data to survive. Got %v: %v", status, body)
+	}
+
+	// The username is free again
+	createAndAuthUser(t, "leaver", "barfoo")
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+)
+
+// BlobStore holds the data of objects, each under a key of its own.
+type BlobStore interface {
+	// Put stores everything read from data under key, returning the number of
+	// bytes stored. If reading data fails, nothing is stored and whatever was
+	// already stored under key is left as it was.
+	Put(key string, data io.Reader) (int64, error)
+
+	// Get opens the blob stored under key for reading. It returns
+	// ErrBlobNotFound if nothing is stored under key. The caller must close the
+	// returned reader.
+	Get(key string) (io.ReadCloser, error)
+
+	// Delete removes the blob stored under key. Deleting a blob that doesn't
+	// exist is not an error.
+	Delete(key string) error
+
+	// Stat describes the blob stored under key, returning ErrBlobNotFound if
+	// nothing is stored under it.
+	Stat(key string) (BlobInfo, error)
+}
+
+// blobMover is implemented by blob stores that can move a blob to another key
+// without copying its data.
+type blobMover interface {
+	// Move moves the blob stored under from to to, replacing anything stored
+	// there. It returns ErrBlobNotFound if nothing is stored under from.
+	Move(from string, to string) error
+}
+
+// moveBlob moves the blob stored under from in Blobs to to, copying it if the
+// store can't move it directly.
+func moveBlob(from string, to string) error {
+	if mover, ok := Blobs.(blobMover); ok {
+		return mover.Move(from, to)
+	}
+
+	data, err := Blobs.Get(from)
+	if err != nil {
+		return err
+	}
+	_, err = Blobs.Put(to, data)
+	data.Close()
+	if err != nil {
+		return err
+	}
+	return Blobs.Delete(from)
+}
+
+type BlobInfo struct {
+	Size    int64
+	ModTime time.Time
+}
+
+var ErrBlobNotFound = errors.New("Blob not found")
+
+// Blobs is where the data of every object is kept
+var Blobs BlobStore
+
+// FileBlobStore keeps each blob in a file of the same name in a directory.
+type FileBlobStore struct {
+	Dir string
+}
+
+func NewFileBlobStore(dir string) *FileBlobStore {
+	return &FileBlobStore{Dir: dir}
+}
+
+// Put streams data into a temporary file next to the blob and only renames it
+// into place once all of it is safely on disk, so a failed or partial write
+// never replaces an existing blob.
+func (s *FileBlobStore) Put(key string, data io.Reader) (int64, error) {
+	filepath := path.Join(s.Dir, key)
+	tempFile, err := ioutil.TempFile(s.Dir, key+".tmp-")
+	if err != nil {
+		return 0, err
+	}
+
+	size, err := io.Copy(tempFile, data)
+	if err == nil {
+		err = tempFile.Sync()
+	}
+	closeErr := tempFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tempFile.Name(), filepath)
+	}
+	if err != nil {
+		os.Remove(tempFile.Name())
+		return 0, err
+	}
+	return size, nil
+}
+
+// Get opens the blob's file. The returned reader is an *os.File, so callers
+// can seek in it.
+func (s *FileBlobStore) Get(key string) (io.ReadCloser, error) {
+	file, err := os.Open(path.Join(s.Dir, key))
+	if os.IsNotExist(err) {
+		return nil, ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (s *FileBlobStore) Delete(key string) error {
+	err := os.Remove(path.Join(s.Dir, key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Move renames the blob's file, which replaces the destination atomically.
+func (s *FileBlobStore) Move(from string, to string) error {
+	err := os.Rename(path.Join(s.Dir, from), path.Join(s.Dir, to))
+	if os.IsNotExist(err) {
+		return ErrBlobNotFound
+	}
+	return err
+}
+
+func (s *FileBlobStore) Stat(key string) (BlobInfo, error) {
+	stat, err := os.Stat(path.Join(s.Dir, key))
+	if os.IsNotExist(err) {
+		return BlobInfo{}, ErrBlobNotFound
+	}
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	return BlobInfo{Size: stat.Size(), ModTime: stat.ModTime()}, nil
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3BlobStore keeps blobs as objects in a bucket of an S3-compatible service,
+// such as Amazon S3 or MinIO. Buckets are addressed path-style, as in
+// <endpoint>/<bucket>/<key>, and requests are signed with AWS Signature
+// Version 4.
+type S3BlobStore struct {
+	Endpoint  string
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+
+	// S3 needs to know the length of an object before it is sent, so Put
+	// spools data to a temporary file in this directory first
+	TempDir string
+
+	Client *http.Client
+}
+
+func NewS3BlobStore(endpoint string, bucket string, region string, accessKey string, secretKey string, tempDir string) *S3BlobStore {
+	return &S3BlobStore{
+		Endpoint:  strings.TrimRight(endpoint, "/"),
+		Bucket:    bucket,
+		Region:    region,
+		AccessKey: accessKey,
+		SecretKey: secretKey,
+		TempDir:   tempDir,
+		Client:    &http.Client{},
+	}
+}
+
+func (s *S3BlobStore) Put(key string, data io.Reader) (int64, error) {
+	// Spool the data, hashing it on the way so the payload can be signed
+	tempFile, err := ioutil.TempFile(s.TempDir, "s3-upload-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+
+	hasher := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tempFile, hasher), data)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tempFile.Seek(0, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := s.newRequest("PUT", key, ioutil.NopCloser(tempFile), hex.EncodeToString(hasher.Sum(nil)))
+	if err != nil {
+		return 0, err
+	}
+	req.ContentLength = size
+
+	res, err := s.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return 0, s3Error(res)
+	}
+	return size, nil
+}
+
+func (s *S3BlobStore) Get(key string) (io.ReadCloser, error) {
+	req, err := s.newRequest("GET", key, nil, emptyPayloadHash)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := s.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode == http.StatusNotFound {
+		res.Body.Close()
+		return nil, ErrBlobNotFound
+	}
+	if res.StatusCode != http.StatusOK {
+		defer res.Body.Close()
+		return nil, s3Error(res)
+	}
+	return res.Body, nil
+}
+
+func (s *S3BlobStore) Delete(key string) error {
+	req, err := s.newRequest("DELETE", key, nil, emptyPayloadHash)
+	if err != nil {
+		return err
+	}
+
+	res, err := s.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusNotFound:
+		return nil
+	}
+	return s3Error(res)
+}
+
+func (s *S3BlobStore) Stat(key string) (BlobInfo, error) {
+	req, err := s.newRequest("HEAD", key, nil, emptyPayloadHash)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+
+	res, err := s.Client.Do(req)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return BlobInfo{}, ErrBlobNotFound
+	}
+	if res.StatusCode != http.StatusOK {
+		return BlobInfo{}, s3Error(res)
+	}
+
+	size, err := strconv.ParseInt(res.Header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return BlobInfo{}, fmt.Errorf("S3 returned an invalid Content-Length for %v: %v", key, err)
+	}
+	modTime, _ := http.ParseTime(res.Header.Get("Last-Modified"))
+	return BlobInfo{Size: size, ModTime: modTime}, nil
+}
+
+// SHA-256 digest of an empty request body
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+func (s *S3BlobStore) newRequest(method string, key string, body io.ReadCloser, payloadHash string) (*http.Request, error) {
+	req, err := http.NewRequest(method, s.Endpoint+"/"+s3EscapePath(s.Bucket+"/"+key), nil)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Body = body
+	}
+
+	signS3Request(req, payloadHash, s.AccessKey, s.SecretKey, s.Region, time.Now())
+	return req, nil
+}
+
+func s3Error(res *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+	return fmt.Errorf("S3 request %v %v failed with status %v: %s", res.Request.Method, res.Request.URL.Path, res.Status, body)
+}
+
+// s3EscapePath URI-encodes each segment of a path the way Signature Version 4
+// expects, leaving the slashes between segments alone.
+func s3EscapePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, segment := range segments {
+		segments[i] = s3Escape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// s3Escape percent-encodes everything but the characters RFC 3986 leaves
+// unreserved.
+func s3Escape(s string) string {
+	var escaped strings.Builder
+	for _, b := range []byte(s) {
+		if ('A' <= b && b <= 'Z') || ('a' <= b && b <= 'z') || ('0' <= b && b <= '9') ||
+			b == '-' || b == '_' || b == '.' || b == '~' {
+			escaped.WriteByte(b)
+		} else {
+			fmt.Fprintf(&escaped, "%%%02X", b)
+		}
+	}
+	return escaped.String()
+}
+
+// signS3Request adds an AWS Signature Version 4 Authorization header to req,
+// signing the host and every header already set on it. payloadHash is the
+// hex-encoded SHA-256 digest of the request body.
+func signS3Request(req *http.Request, payloadHash string, accessKey string, secretKey string, region string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := now.UTC().Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+
+	headerNames := make([]string, 0, len(headers))
+	for name := range headers {
+		headerNames = append(headerNames, name)
+	}
+	sort.Strings(headerNames)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range headerNames {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(headerNames, ";")
+
+	canonicalURI := req.URL.EscapedPath()
+	if canonicalURI == "" {
+		canonicalURI = "/"
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalURI,
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalRequestHash[:])
+
+	signingKey := hmacSHA256([]byte("AWS4"+secretKey), date)
+	signingKey = hmacSHA256(signingKey, region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var params []string
+	for _, key := range keys {
+		values := query[key]
+		sort.Strings(values)
+		for _, value := range values {
+			params = append(params, s3Escape(key)+"="+s3Escape(value))
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
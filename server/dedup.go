@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/boltdb/bolt"
+)
+
+// Deduplicated storage
+//
+// Uploaded data is shared between every object with the same content. Each
+// distinct piece of content has a SharedBlob record in the "blobs" bucket,
+// keyed by its SHA-256 digest, which names the key its data is stored under in
+// Blobs and counts the objects referencing it. Deleting an object only drops
+// its reference; blobs nothing references any more are reclaimed by
+// collectBlobs.
+//
+// Uploads are stored under a fresh key of their own, and only moved to the
+// blob's key, derived from the digest, once the server has computed the digest
+// itself. With encryption at rest, blob keys are derived through the master
+// key, so the blob store doesn't give away digests of the plaintext, and the
+// objects sharing a blob share its data key too. Data under a blob key is only written or deleted inside a database
+// transaction, while no object references it, so a blob never changes under
+// the objects sharing it.
+
+type SharedBlob struct {
+	SHA256     string `json:"sha256"`
+	Key        string `json:"key"`
+	Size       int64  `json:"size"`
+	References int    `json:"references"`
+	// Key the data is encrypted with, if it is encrypted
+	DataKey *WrappedKey `json:"datakey,omitempty"`
+}
+
+func getSharedBlob(tx *bolt.Tx, digest string) (*SharedBlob, error) {
+	blobJSON := tx.Bucket([]byte("blobs")).Get([]byte(digest))
+	if blobJSON == nil {
+		return nil, nil
+	}
+
+	blob := SharedBlob{}
+	err := json.Unmarshal(blobJSON, &blob)
+	if err != nil {
+		return nil, err
+	}
+	return &blob, nil
+}
+
+func putSharedBlob(tx *bolt.Tx, blob *SharedBlob) error {
+	blobJSON, err := json.Marshal(blob)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket([]byte("blobs")).Put([]byte(blob.SHA256), blobJSON)
+}
+
+// blobKey returns the key the data of the shared blob with the given digest is
+// stored under. Blobs created before data was moved to these keys keep the key
+// of the upload that created them, and blobs created under another master key
+// keep theirs.
+func blobKey(digest string) string {
+	if MasterKey == nil {
+		return "sha256-" + digest
+	}
+	mac := hmac.New(sha256.New, MasterKey)
+	mac.Write([]byte("piedpiper blob key\n" + digest))
+	return "hmac-" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// shareObjectData points an object whose data was just stored under key, which
+// nothing else uses, at the shared blob with the same content. If the content
+// is new, or its blob is only waiting to be collected, the data is moved to
+// the blob's key. Otherwise key is returned so the caller can delete the now
+// redundant copy once the transaction has committed. The caller must put the
+// object.
+func shareObjectData(tx *bolt.Tx, object *Object, key string) (string, error) {
+	blob, err := getSharedBlob(tx, object.SHA256)
+	if err != nil {
+		return "", err
+	}
+
+	if blob != nil && blob.References > 0 {
+		blob.References++
+		object.LocalFileName = blob.Key
+		object.DataKey = blob.DataKey
+		object.Blob = blob.SHA256
+		return key, putSharedBlob(tx, blob)
+	}
+
+	// An unreferenced blob's data can be replaced, since no object can start
+	// referencing it outside of a transaction
+	if blob != nil && blob.Key != blobKey(object.SHA256) {
+		err = Blobs.Delete(blob.Key)
+		if err != nil {
+			return "", err
+		}
+	}
+	err = moveBlob(key, blobKey(object.SHA256))
+	if err != nil {
+		return "", err
+	}
+	blob = &SharedBlob{SHA256: object.SHA256, Key: blobKey(object.SHA256), Size: object.Size, References: 1, DataKey: object.DataKey}
+	object.LocalFileName = blob.Key
+	object.Blob = blob.SHA256
+	return "", putSharedBlob(tx, blob)
+}
+
+// referenceBlob adds a reference to the shared blob an existing object points
+// at, for a new object that will point at it too.
+func referenceBlob(tx *bolt.Tx, digest string) error {
+	blob, err := getSharedBlob(tx, digest)
+	if err != nil {
+		return err
+	}
+	if blob == nil {
+		return fmt.Errorf("Shared blob %v does not exist", digest)
+	}
+	blob.References++
+	return putSharedBlob(tx, blob)
+}
+
+// releaseBlob drops an object's reference to its shared blob, if it has one.
+// The blob itself is left for collectBlobs.
+func releaseBlob(tx *bolt.Tx, object *Object) error {
+	if object.Blob == "" {
+		return nil
+	}
+
+	blob, err := getSharedBlob(tx, object.Blob)
+	if err != nil || blob == nil {
+		return err
+	}
+	blob.References--
+	return putSharedBlob(tx, blob)
+}
+
+// removeDuplicateData deletes a copy of data that turned out to be in a shared
+// blob already.
+func removeDuplicateData(key string) {
+	err := Blobs.Delete(key)
+	if err != nil {
+		log.Printf("Failed to remove duplicate data %v: %v", key, err)
+	}
+}
+
+// collectBlobs deletes every shared blob that no object references, returning
+// how many were deleted. The data goes in the same transaction as the records,
+// so an upload of the same content can't store it again in between.
+func collectBlobs() (int, error) {
+	collected := 0
+	err := MainDB.Update(func(tx *bolt.Tx) error {
+		var unreferenced []SharedBlob
+		blobs := tx.Bucket([]byte("blobs"))
+		err := blobs.ForEach(func(k, v []byte) error {
+			blob := SharedBlob{}
+			err := json.Unmarshal(v, &blob)
+			if err != nil {
+				return err
+			}
+			if blob.References <= 0 {
+				unreferenced = append(unreferenced, blob)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// A record whose data is gone is harmless if the transaction fails,
+		// since it is unreferenced and its data is replaced on the next upload
+		for _, blob := range unreferenced {
+			err = Blobs.Delete(blob.Key)
+			if err != nil {
+				return fmt.Errorf("Failed to remove data of unreferenced blob %v: %v", blob.SHA256, err)
+			}
+			err = blobs.Delete([]byte(blob.SHA256))
+			if err != nil {
+				return err
+			}
+		}
+		collected = len(unreferenced)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return collected, nil
+}
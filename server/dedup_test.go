@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func getTestSharedBlob(t *testing.T, digest string) *SharedBlob {
+	var blob *SharedBlob
+	err := MainDB.View(func(tx *bolt.Tx) error {
+		var err error
+		blob, err = getSharedBlob(tx, digest)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return blob
+}
+
+func deleteTestObject(t *testing.T, token string, filename string) {
+	req, err := http.NewRequest("DELETE", "/object?token="+token+"&filename="+filename, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(deleteObjectHandler).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("delete handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+}
+
+func TestDeduplicatedUploads(t *testing.T) {
+	data := []byte("the same holiday photo")
+	sum := sha256.Sum256(data)
+	digest := hex.EncodeToString(sum[:])
+
+	alice := createAndAuthUser(t, "dedupalice", "foobar")
+	bob := createAndAuthUser(t, "dedupbob", "foobar")
+	uploadTestObject(t, alice, "photo.jpg", data)
+	uploadTestObject(t, bob, "copy.jpg", data)
+	uploadTestObject(t, bob, "copy.jpg", data)
+
+	blob := getTestSharedBlob(t, digest)
+	if blob == nil || blob.References != 3 {
+		t.Fatalf("Expected one blob referenced 3 times. Got %+v", blob)
+	}
+	if _, err := Blobs.Stat(blob.Key); err != nil {
+		t.Fatalf("Shared blob has no data: %v", err)
+	}
+
+	// Only the shared copy of the data is kept
+	files, err := ioutil.ReadDir(DataPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copies := 0
+	for _, file := range files {
+		contents, _ := ioutil.ReadFile(path.Join(DataPath, file.Name()))
+		if bytes.Equal(contents, data) {
+			copies++
+		}
+	}
+	if copies != 1 {
+		t.Errorf("Expected 1 copy of the data to be stored, found %v", copies)
+	}
+
+	// Deleting some references keeps the data for the rest
+	deleteTestObject(t, bob, "copy.jpg")
+	if collected, err := collectBlobs(); err != nil || collected != 0 {
+		t.Fatalf("Expected no blobs to be collected. Got %v, error %v", collected, err)
+	}
+	if status, body := getTestObject(t, alice, "filename=photo.jpg"); status != http.StatusOK || body != string(data) {
+		t.Errorf("Expected shared data to survive. Got %v: %v", status, body)
+	}
+
+	// Once nothing references the blob it is collected
+	deleteTestObject(t, alice, "photo.jpg")
+	if blob := getTestSharedBlob(t, digest); blob == nil || blob.References != 0 {
+		t.Fatalf("Expected unreferenced blob. Got %+v", blob)
+	}
+	if collected, err := collectBlobs(); err != nil || collected != 1 {
+		t.Fatalf("Expected 1 blob to be collected. Got %v, error %v", collected, err)
+	}
+	if getTestSharedBlob(t, digest) != nil {
+		t.Errorf("Collected blob still has a record")
+	}
+	if _, err := Blobs.Stat(blob.Key); err != ErrBlobNotFound {
+		t.Errorf("Collected blob still has data: %v", err)
+	}
+}
+
+func TestOverlappingUploads(t *testing.T) {
+	data := []byte("the genuine article")
+	sum := sha256.Sum256(data)
+	digest := hex.EncodeToString(sum[:])
+
+	token := createAndAuthUser(t, "overlapper", "foobar")
+	uploadID := createTestObject(t, token, "race.txt")
+
+	// Read the session as a second, overlapping upload to it would have
+	uploadSession := UploadSession{}
+	err := MainDB.View(func(tx *bolt.Tx) error {
+		return json.Unmarshal(tx.Bucket([]byte("uploads")).Get([]byte(uploadID)), &uploadSession)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status := uploadTestData(t, token, uploadID, data); status != http.StatusOK {
+		t.Fatalf("object upload handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	// The late upload can't finish, or touch the blob the first one created
+	lateKey, err := randomFileName()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lateData := newDigestReader(bytes.NewReader([]byte("something else")), nil)
+	dataKey, err := storeObjectData(lateKey, lateData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = finishUpload(&uploadSession, lateKey, lateData.Size(), lateData.Sum(), dataKey)
+	if err != ErrUploadSessionGone {
+		t.Errorf("Expected late upload to fail. Got %v", err)
+	}
+	if _, err := Blobs.Stat(lateKey); err != ErrBlobNotFound {
+		t.Errorf("Expected data of late upload to be deleted. Got %v", err)
+	}
+
+	blob := getTestSharedBlob(t, digest)
+	if blob == nil || blob.Key != blobKey(digest) || blob.References != 1 {
+		t.Errorf("Unexpected blob %+v", blob)
+	}
+	if status, body := getTestObject(t, token, "filename=race.txt"); status != http.StatusOK || body != string(data) {
+		t.Errorf("Expected the first upload to be kept. Got %v: %v", status, body)
+	}
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Devices
+//
+// Each of a user's devices can be registered with a name and an Ed25519
+// public key, whose private half never leaves the device. /auth can then tie
+// the tokens it issues to a registered device, once the client proves it holds
+// the device's private key by signing its request. Revoking a device revokes
+// every token tied to it, and each device records when one of its tokens was
+// last used.
+//
+// Devices are stored in the devices bucket, which holds a bucket per user
+// mapping device IDs to devices.
+
+// How often a device's last seen time is written as its tokens are used
+var DeviceSeenInterval = time.Minute
+
+var ErrDeviceSignatureInvalid = errors.New("Device signature is not valid")
+
+type Device struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Base64-encoded Ed25519 public key
+	PublicKey  string `json:"publickey"`
+	Registered string `json:"registered"`
+	LastSeen   string `json:"lastseen,omitempty"`
+}
+
+type RegisterDeviceRequestJSON struct {
+	Token     string `json:"token"`
+	Name      string `json:"name"`
+	PublicKey string `json:"publickey"`
+}
+
+func getDevice(tx *bolt.Tx, username string, id string) (*Device, error) {
+	userDevices := tx.Bucket([]byte("devices")).Bucket([]byte(username))
+	if userDevices == nil {
+		return nil, nil
+	}
+	data := userDevices.Get([]byte(id))
+	if data == nil {
+		return nil, nil
+	}
+	device := Device{}
+	err := json.Unmarshal(data, &device)
+	if err != nil {
+		return nil, err
+	}
+	return &device, nil
+}
+
+func putDevice(tx *bolt.Tx, username string, device *Device) error {
+	buf, err := json.Marshal(device)
+	if err != nil {
+		return err
+	}
+	userDevices, err := tx.Bucket([]byte("devices")).CreateBucketIfNotExists([]byte(username))
+	if err != nil {
+		return err
+	}
+	return userDevices.Put([]byte(device.ID), buf)
+}
+
+// deleteUserDevices forgets every device a user has registered.
+func deleteUserDevices(tx *bolt.Tx, username string) error {
+	if tx.Bucket([]byte("devices")).Bucket([]byte(username)) == nil {
+		return nil
+	}
+	return tx.Bucket([]byte("devices")).DeleteBucket([]byte(username))
+}
+
+func decodeDeviceKey(publicKey string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("Public key must be a base64-encoded Ed25519 key")
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// deviceAuthMessage is what a device signs to have /auth tie tokens to it.
+func deviceAuthMessage(username string, reqDate string, deviceID string) []byte {
+	return []byte(username + "\n" + reqDate + "\n" + deviceID)
+}
+
+// verifyDevice checks that a device belongs to a user and signed an
+// authentication request, and marks it as seen. It returns nil if the user has
+// no such device, and ErrDeviceSignatureInvalid if the signature is wrong.
+func verifyDevice(username string, reqDate string, deviceID string, signature string) (*Device, error) {
+	var device *Device
+	err := MainDB.Update(func(tx *bolt.Tx) error {
+		var err error
+		device, err = getDevice(tx, username, deviceID)
+		if err != nil || device == nil {
+			return err
+		}
+
+		publicKey, err := decodeDeviceKey(device.PublicKey)
+		if err != nil {
+			return err
+		}
+		decoded, err := base64.StdEncoding.DecodeString(signature)
+		if err != nil || !ed25519.Verify(publicKey, deviceAuthMessage(username, reqDate, deviceID), decoded) {
+			device = nil
+			return ErrDeviceSignatureInvalid
+		}
+
+		device.LastSeen = time.Now().UTC().Format("20060102150405")
+		return putDevice(tx, username, device)
+	})
+	return device, err
+}
+
+// markDeviceSeen records that a token tied to a device has been used, at most
+// once every DeviceSeenInterval.
+func markDeviceSeen(username string, deviceID string) error {
+	now := time.Now().UTC()
+	stale := func(device *Device) bool {
+		lastSeen, err := time.Parse("20060102150405", device.LastSeen)
+		return err != nil || now.Sub(lastSeen) >= DeviceSeenInterval
+	}
+
+	var device *Device
+	err := MainDB.View(func(tx *bolt.Tx) error {
+		var err error
+		device, err = getDevice(tx, username, deviceID)
+		return err
+	})
+	if err != nil || device == nil || !stale(device) {
+		return err
+	}
+
+	return MainDB.Update(func(tx *bolt.Tx) error {
+		device, err := getDevice(tx, username, deviceID)
+		if err != nil || device == nil || !stale(device) {
+			return err
+		}
+		device.LastSeen = now.Format("20060102150405")
+		return putDevice(tx, username, device)
+	})
+}
+
+// revokeDevice forgets a device and revokes every token tied to it: legacy
+// tokens and refresh tokens are deleted, and the device is put on the
+// revocation list for as long as a signed token issued to it can last. It
+// reports whether the device existed.
+func revokeDevice(username string, deviceID string) (bool, error) {
+	existed := false
+	var revokedUntil int64
+	err := MainDB.Update(func(tx *bolt.Tx) error {
+		device, err := getDevice(tx, username, deviceID)
+		if err != nil || device == nil {
+			return err
+		}
+		existed = true
+
+		err = tx.Bucket([]byte("devices")).Bucket([]byte(username)).Delete([]byte(deviceID))
+		if err != nil {
+			return err
+		}
+
+		// Only the user's own tokens can be tied to their device
+		userTokens := tx.Bucket([]byte("usertokens")).Bucket([]byte(username))
+		if userTokens != nil {
+			var deviceTokens []*Token
+			err = userTokens.ForEach(func(k, v []byte) error {
+				data := tx.Bucket([]byte("tokens")).Get(k)
+				if data == nil {
+					return nil
+				}
+				token := Token{}
+				err := json.Unmarshal(data, &token)
+				if err != nil {
+					return err
+				}
+				if token.DeviceID == deviceID {
+					deviceTokens = append(deviceTokens, &token)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for _, token := range deviceTokens {
+				err = deleteToken(tx, token)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		_, err = deleteRefreshTokens(tx, func(record *RefreshToken) bool {
+			return record.Device == deviceID
+		})
+		if err != nil {
+			return err
+		}
+
+		lifetime := SignedTokenLifetime
+		if AccessTokenLifetime > lifetime {
+			lifetime = AccessTokenLifetime
+		}
+		revokedUntil = time.Now().UTC().Add(lifetime).Unix()
+		return putRevokedToken(tx, deviceID, revokedUntil)
+	})
+	if err != nil || !existed {
+		return existed, err
+	}
+	setRevokedToken(deviceID, revokedUntil)
+	return true, nil
+}
+
+func registerDeviceHandler(res http.ResponseWriter, req *http.Request) {
+	requestJSON := RegisterDeviceRequestJSON{}
+	err := json.NewDecoder(req.Body).Decode(&requestJSON)
+	if err != nil || requestJSON.Name == "" {
+		res.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(res, "Error in decoding message")
+		return
+	}
+	if _, err := decodeDeviceKey(requestJSON.PublicKey); err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(res, "%v", err)
+		return
+	}
+
+	// Check and validate token
+	token := validateToken(res, requestJSON.Token, ScopeAccount)
+	if token == nil {
+		return
+	}
+
+	id, err := randomID()
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error generating device ID: %v", err)
+		return
+	}
+	device := Device{
+		ID:         id,
+		Name:       requestJSON.Name,
+		PublicKey:  requestJSON.PublicKey,
+		Registered: time.Now().UTC().Format("20060102150405"),
+	}
+	err = MainDB.Update(func(tx *bolt.Tx) error {
+		return putDevice(tx, token.User.Username, &device)
+	})
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error registering device of user %v: %v", token.User.Username, err)
+		return
+	}
+
+	responseData, err := json.Marshal(device)
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error marshalling response for client: %v", err)
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.Write(responseData)
+	log.Printf("Device %v (%v) has been registered to user %v", device.ID, device.Name, token.User.Username)
+}
+
+func listDevicesHandler(res http.ResponseWriter, req *http.Request) {
+	requestToken, ok := requiredQueryParam(res, req, "token")
+	if !ok {
+		return
+	}
+
+	// Check and validate token
+	token := validateToken(res, requestToken, ScopeAccount)
+	if token == nil {
+		return
+	}
+
+	devices := []Device{}
+	err := MainDB.View(func(tx *bolt.Tx) error {
+		userDevices := tx.Bucket([]byte("devices")).Bucket([]byte(token.User.Username))
+		if userDevices == nil {
+			return nil
+		}
+		return userDevices.ForEach(func(k, v []byte) error {
+			device := Device{}
+			err := json.Unmarshal(v, &device)
+			if err != nil {
+				return err
+			}
+			devices = append(devices, device)
+			return nil
+		})
+	})
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error listing devices of user %v: %v", token.User.Username, err)
+		return
+	}
+
+	responseData, err := json.Marshal(devices)
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error marshalling response for client: %v", err)
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.Write(responseData)
+}
+
+func revokeDeviceHandler(res http.ResponseWriter, req *http.Request) {
+	requestToken, ok := requiredQueryParam(res, req, "token")
+	if !ok {
+		return
+	}
+	deviceID, ok := requiredQueryParam(res, req, "id")
+	if !ok {
+		return
+	}
+
+	// Check and validate token
+	token := validateToken(res, requestToken, ScopeAccount)
+	if token == nil {
+		return
+	}
+
+	existed, err := revokeDevice(token.User.Username, deviceID)
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error revoking device %v of user %v: %v", deviceID, token.User.Username, err)
+		return
+	}
+	if !existed {
+		res.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(res, "Device %v is not registered to user %v", deviceID, token.User.Username)
+		return
+	}
+	log.Printf("Device %v of user %v has been revoked", deviceID, token.User.Username)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func registerTestDevice(t *testing.T, token string, name string, publicKey ed25519.PublicKey) *httptest.ResponseRecorder {
+	registerJSON := RegisterDeviceRequestJSON{Token: token, Name: name, PublicKey: base64.StdEncoding.EncodeToString(publicKey)}
+	buffer, _ := json.Marshal(registerJSON)
+	req, err := http.NewRequest("POST", "/user/devices", bytes.NewBuffer(buffer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(registerDeviceHandler).ServeHTTP(rr, req)
+	return rr
+}
+
+// newTestDevice registers a device with a new key pair, returning the device
+// and its private key.
+func newTestDevice(t *testing.T, token string, name string) (Device, ed25519.PrivateKey) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := registerTestDevice(t, token, name, publicKey)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("device handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	device := Device{}
+	err = json.Unmarshal(rr.Body.Bytes(), &device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return device, privateKey
+}
+
+// deviceAuthTestRequest authenticates from a device, signing the request with
+// key.
+func deviceAuthTestRequest(t *testing.T, username string, password string, deviceID string, key ed25519.PrivateKey, format string) *httptest.ResponseRecorder {
+	return deviceAuthTestRequestAt(t, username, password, deviceID, key, format, time.Now().UTC())
+}
+
+// deviceAuthTestRequestAt authenticates from a device with a request made at
+// the given time.
+func deviceAuthTestRequestAt(t *testing.T, username string, password string, deviceID string, key ed25519.PrivateKey, format string, at time.Time) *httptest.ResponseRecorder {
+	reqDate := at.Format("20060102150405")
+	authUserJSON := AuthUserRequestJSON{
+		Username:        username,
+		Password:        password,
+		ReqDate:         reqDate,
+		Format:          format,
+		Device:          deviceID,
+		DeviceSignature: base64.StdEncoding.EncodeToString(ed25519.Sign(key, deviceAuthMessage(username, reqDate, deviceID))),
+	}
+	buffer, _ := json.Marshal(authUserJSON)
+	req, err := http.NewRequest("GET", "/auth", bytes.NewBuffer(buffer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(authUserHandler).ServeHTTP(rr, req)
+	return rr
+}
+
+// deviceTestToken authenticates from a device and returns the token issued.
+func deviceTestToken(t *testing.T, username string, password string, deviceID string, key ed25519.PrivateKey, format string) string {
+	rr := deviceAuthTestRequest(t, username, password, deviceID, key, format)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("auth handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	response := AuthUserResponseJSON{}
+	err := json.Unmarshal(rr.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Token != "" {
+		return response.Token
+	}
+	hasher := sha512.New()
+	hasher.Write([]byte(username + response.Nonce + response.ExpirationDate))
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+func listTestDevices(t *testing.T, token string) []Device {
+	req, err := http.NewRequest("GET", "/user/devices?token="+token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(listDevicesHandler).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("device list handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	devices := []Device{}
+	err = json.Unmarshal(rr.Body.Bytes(), &devices)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return devices
+}
+
+func revokeTestDevice(t *testing.T, token string, deviceID string) int {
+	req, err := http.NewRequest("DELETE", "/user/devices?token="+token+"&id="+deviceID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(revokeDeviceHandler).ServeHTTP(rr, req)
+	return rr.Code
+}
+
+func TestDevices(t *testing.T) {
+	// This takes more attempts than a user is usually allowed
+	oldLimiter := AuthUserLimiter
+	AuthUserLimiter = NewRateLimiter(6000, 1000)
+	defer func() { AuthUserLimiter = oldLimiter }()
+
+	token := createAndAuthUser(t, "gadgeteer", "foobar")
+	if rr := registerTestDevice(t, token, "toaster", []byte("not a key")); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected malformed key to be refused. Got %v", rr.Code)
+	}
+
+	phone, phoneKey := newTestDevice(t, token, "phone")
+	tablet, tabletKey := newTestDevice(t, token, "tablet")
+
+	// Only the device itself can get tokens tied to it
+	if rr := deviceAuthTestRequest(t, "gadgeteer", "foobar", phone.ID, tabletKey, ""); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected request signed by another key to be refused. Got %v", rr.Code)
+	}
+	if rr := deviceAuthTestRequest(t, "gadgeteer", "foobar", "unknown", phoneKey, ""); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected unknown device to be refused. Got %v", rr.Code)
+	}
+
+	// Signatures can't be made for use far in the future
+	if rr := deviceAuthTestRequestAt(t, "gadgeteer", "foobar", phone.ID, phoneKey, "", time.Now().UTC().Add(24*time.Hour)); rr.Code != http.StatusExpectationFailed {
+		t.Errorf("Expected request dated in the future to be refused. Got %v", rr.Code)
+	}
+
+	phoneToken := deviceTestToken(t, "gadgeteer", "foobar", phone.ID, phoneKey, "")
+	phoneSignedToken := deviceTestToken(t, "gadgeteer", "foobar", phone.ID, phoneKey, "signed")
+	tabletToken := deviceTestToken(t, "gadgeteer", "foobar", tablet.ID, tabletKey, "")
+	for _, valid := range []string{phoneToken, phoneSignedToken, tabletToken} {
+		if status, body := getTestObject(t, valid, "filename=anything"); !strings.HasPrefix(body, "Failed to find object") {
+			t.Errorf("Expected device token to work. Got %v: %v", status, body)
+		}
+	}
+
+	devices := listTestDevices(t, token)
+	if len(devices) != 2 {
+		t.Fatalf("Expected two devices. Got %+v", devices)
+	}
+	for _, device := range devices {
+		if device.LastSeen == "" || (device.Name != "phone" && device.Name != "tablet") {
+			t.Errorf("Unexpected device %+v", device)
+		}
+	}
+
+	// Revoking a device revokes only its tokens
+	if status := revokeTestDevice(t, token, phone.ID); status != http.StatusOK {
+		t.Fatalf("device revoke handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	for _, revoked := range []string{phoneToken, phoneSignedToken} {
+		if status, _ := getTestObject(t, revoked, "filename=anything"); status != http.StatusNotFound {
+			t.Errorf("Expected token of revoked device to be rejected. Got %v", status)
+		}
+	}
+	for _, valid := range []string{token, tabletToken} {
+		if status, body := getTestObject(t, valid, "filename=anything"); !strings.HasPrefix(body, "Failed to find object") {
+			t.Errorf("Expected other tokens to keep working. Got %v: %v", status, body)
+		}
+	}
+	if devices := listTestDevices(t, token); len(devices) != 1 || devices[0].ID != tablet.ID {
+		t.Errorf("Expected only the tablet to be left. Got %+v", devices)
+	}
+	if rr := deviceAuthTestRequest(t, "gadgeteer", "foobar", phone.ID, phoneKey, ""); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected revoked device to be refused. Got %v", rr.Code)
+	}
+	if status := revokeTestDevice(t, token, phone.ID); status != http.StatusNotFound {
+		t.Errorf("Expected revoking an unknown device to fail. Got %v", status)
+	}
+}
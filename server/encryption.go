@@ -0,0 +1,352 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+// Encryption at rest
+//
+// When a master key is loaded, the data of every object uploaded is encrypted
+// with AES-256-GCM under a random data key, which the objects deduplicated into
+// the same shared blob share. The data key is stored on the object, wrapped
+// (encrypted) with the master key, so rotating the master key only means
+// rewrapping data keys, not reencrypting data.
+//
+// Data is encrypted in segments of encryptedSegmentSize bytes so it can be
+// streamed. Each segment is sealed with its index as the nonce, and the last
+// one is marked as such, so segments can't be reordered, dropped or cut off
+// without decryption failing. The last segment is always shorter than the
+// others, even if that leaves it empty.
+
+// Master key wrapping data keys, or nil if data is stored unencrypted
+var MasterKey []byte
+
+// Environment variable the master key is read from when no file is given
+const MasterKeyEnv = "PIEDPIPER_MASTER_KEY"
+
+const encryptedSegmentSize = 64 * 1024
+
+var ErrDecryptionFailed = errors.New("Stored data could not be decrypted")
+
+// WrappedKey is an object's data key, encrypted with the master key.
+type WrappedKey struct {
+	Key string `json:"key"`
+	// Identifies the master key that wrapped the data key
+	MasterKeyID string `json:"masterkeyid"`
+}
+
+// loadMasterKey reads a hex-encoded 256-bit master key from path, or from the
+// environment if path is empty. It returns nil if neither has a key.
+func loadMasterKey(path string) ([]byte, error) {
+	encoded := os.Getenv(MasterKeyEnv)
+	if path != "" {
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		encoded = string(contents)
+	}
+
+	encoded = strings.TrimSpace(encoded)
+	if encoded == "" {
+		return nil, nil
+	}
+
+	key, err := hex.DecodeString(encoded)
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("Master key must be 32 hex-encoded bytes")
+	}
+	return key, nil
+}
+
+// masterKeyID names a master key without giving it away.
+func masterKeyID(masterKey []byte) string {
+	digest := sha256.Sum256(masterKey)
+	return hex.EncodeToString(digest[:8])
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func wrapDataKey(masterKey []byte, dataKey []byte) (*WrappedKey, error) {
+	gcm, err := newGCM(masterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed := gcm.Seal(nonce, nonce, dataKey, nil)
+	return &WrappedKey{Key: base64.StdEncoding.EncodeToString(sealed), MasterKeyID: masterKeyID(masterKey)}, nil
+}
+
+func unwrapDataKey(masterKey []byte, wrapped *WrappedKey) ([]byte, error) {
+	if masterKey == nil {
+		return nil, fmt.Errorf("Data is encrypted but no master key is loaded")
+	}
+	if wrapped.MasterKeyID != masterKeyID(masterKey) {
+		return nil, fmt.Errorf("Data key was wrapped by master key %v, not %v", wrapped.MasterKeyID, masterKeyID(masterKey))
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(wrapped.Key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, ErrDecryptionFailed
+	}
+
+	dataKey, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, ErrDecryptionFailed
+	}
+	return dataKey, nil
+}
+
+// encryptObjectData returns a reader of data encrypted under a new data key,
+// along with the wrapped data key. If no master key is loaded, data is
+// returned as is with no key.
+func encryptObjectData(data io.Reader) (io.Reader, *WrappedKey, error) {
+	if MasterKey == nil {
+		return data, nil, nil
+	}
+
+	dataKey := make([]byte, 32)
+	_, err := rand.Read(dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	wrapped, err := wrapDataKey(MasterKey, dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &encryptingReader{
+		data:   data,
+		gcm:    gcm,
+		plain:  make([]byte, encryptedSegmentSize),
+		sealed: make([]byte, 0, encryptedSegmentSize+gcm.Overhead()),
+	}, wrapped, nil
+}
+
+// openObjectData opens an object's data for reading, decrypting it if it was
+// stored encrypted. The caller must close the returned reader.
+func openObjectData(object *Object) (io.ReadCloser, error) {
+	blob, err := Blobs.Get(object.LocalFileName)
+	if err != nil || object.DataKey == nil {
+		return blob, err
+	}
+
+	dataKey, err := unwrapDataKey(MasterKey, object.DataKey)
+	if err != nil {
+		blob.Close()
+		return nil, err
+	}
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		blob.Close()
+		return nil, err
+	}
+
+	decrypted := &decryptingReader{
+		data:   blob,
+		gcm:    gcm,
+		sealed: make([]byte, encryptedSegmentSize+gcm.Overhead()),
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{decrypted, blob}, nil
+}
+
+// segmentNonce and segmentData are the nonce and additional data a segment
+// is sealed with.
+func segmentNonce(index uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], index)
+	return nonce
+}
+
+func segmentData(final bool) []byte {
+	if final {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+type encryptingReader struct {
+	data    io.Reader
+	gcm     cipher.AEAD
+	index   uint64
+	plain   []byte
+	sealed  []byte
+	pending []byte
+	done    bool
+}
+
+func (r *encryptingReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+
+		n, err := io.ReadFull(r.data, r.plain)
+		final := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !final {
+			return 0, err
+		}
+
+		r.sealed = r.gcm.Seal(r.sealed[:0], segmentNonce(r.index), r.plain[:n], segmentData(final))
+		r.pending = r.sealed
+		r.index++
+		r.done = final
+	}
+
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+type decryptingReader struct {
+	data    io.Reader
+	gcm     cipher.AEAD
+	index   uint64
+	sealed  []byte
+	plain   []byte
+	pending []byte
+	done    bool
+}
+
+func (r *decryptingReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+
+		// Only the last segment is short
+		n, err := io.ReadFull(r.data, r.sealed)
+		final := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !final {
+			return 0, err
+		}
+
+		r.plain, err = r.gcm.Open(r.plain[:0], segmentNonce(r.index), r.sealed[:n], segmentData(final))
+		if err != nil {
+			return 0, ErrDecryptionFailed
+		}
+		r.pending = r.plain
+		r.index++
+		r.done = final
+	}
+
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// rotateMasterKey rewraps every data key wrapped by oldKey with newKey, in a
+// single transaction, returning how many keys were rewrapped.
+func rotateMasterKey(oldKey []byte, newKey []byte) (int, error) {
+	rewrapped := 0
+	rewrap := func(wrapped *WrappedKey) (*WrappedKey, error) {
+		dataKey, err := unwrapDataKey(oldKey, wrapped)
+		if err != nil {
+			return nil, err
+		}
+		rewrapped++
+		return wrapDataKey(newKey, dataKey)
+	}
+
+	err := MainDB.Update(func(tx *bolt.Tx) error {
+		var objects []*Object
+		err := tx.Bucket([]byte("objects")).ForEach(func(k, v []byte) error {
+			object := Object{}
+			err := json.Unmarshal(v, &object)
+			if err != nil {
+				return err
+			}
+			if object.DataKey != nil {
+				objects = append(objects, &object)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, object := range objects {
+			object.DataKey, err = rewrap(object.DataKey)
+			if err != nil {
+				return fmt.Errorf("Object %v: %v", object.ID, err)
+			}
+			err = putObject(tx, object)
+			if err != nil {
+				return err
+			}
+		}
+
+		var blobs []*SharedBlob
+		err = tx.Bucket([]byte("blobs")).ForEach(func(k, v []byte) error {
+			blob := SharedBlob{}
+			err := json.Unmarshal(v, &blob)
+			if err != nil {
+				return err
+			}
+			if blob.DataKey != nil {
+				blobs = append(blobs, &blob)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, blob := range blobs {
+			blob.DataKey, err = rewrap(blob.DataKey)
+			if err != nil {
+				return fmt.Errorf("Blob %v: %v", blob.SHA256, err)
+			}
+			err = putSharedBlob(tx, blob)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return rewrapped, nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func testMasterKey(t *testing.T) []byte {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// encryptTestData encrypts data under a fresh data key, returning the
+// ciphertext and the object it would belong to.
+func encryptTestData(t *testing.T, data []byte) ([]byte, *Object) {
+	sealed, dataKey, err := encryptObjectData(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, err := ioutil.ReadAll(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ciphertext, &Object{LocalFileName: "encrypted", DataKey: dataKey}
+}
+
+func decryptTestData(t *testing.T, ciphertext []byte, object *Object) ([]byte, error) {
+	Blobs = NewFileBlobStore(t.TempDir())
+	defer func() { Blobs = NewFileBlobStore(DataPath) }()
+
+	_, err := Blobs.Put(object.LocalFileName, bytes.NewReader(ciphertext))
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, err := openObjectData(object)
+	if err != nil {
+		return nil, err
+	}
+	defer blob.Close()
+	return ioutil.ReadAll(blob)
+}
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	MasterKey = testMasterKey(t)
+	defer func() { MasterKey = nil }()
+
+	for _, size := range []int{0, 1, encryptedSegmentSize - 1, encryptedSegmentSize, encryptedSegmentSize + 1, 3 * encryptedSegmentSize} {
+		data := make([]byte, size)
+		rand.Read(data)
+
+		ciphertext, object := encryptTestData(t, data)
+		if size >= 16 && bytes.Contains(ciphertext, data) {
+			t.Errorf("Ciphertext of %v bytes contains the plaintext", size)
+		}
+
+		decrypted, err := decryptTestData(t, ciphertext, object)
+		if err != nil || !bytes.Equal(decrypted, data) {
+			t.Errorf("Failed to decrypt %v bytes: %v", size, err)
+		}
+	}
+}
+
+func TestEncryptionTampering(t *testing.T) {
+	MasterKey = testMasterKey(t)
+	defer func() { MasterKey = nil }()
+
+	data := make([]byte, 2*encryptedSegmentSize+100)
+	rand.Read(data)
+	ciphertext, object := encryptTestData(t, data)
+	segment := encryptedSegmentSize + 16
+
+	flipped := append([]byte{}, ciphertext...)
+	flipped[10] ^= 1
+	truncated := ciphertext[:2*segment]
+	reordered := append(append(append([]byte{}, ciphertext[segment:2*segment]...), ciphertext[:segment]...), ciphertext[2*segment:]...)
+
+	for name, tampered := range map[string][]byte{"flipped": flipped, "truncated": truncated, "reordered": reordered} {
+		if _, err := decryptTestData(t, tampered, object); err != ErrDecryptionFailed {
+			t.Errorf("Expected %v ciphertext to fail decryption. Got %v", name, err)
+		}
+	}
+
+	// Without the right master key the data key can't be unwrapped
+	MasterKey = testMasterKey(t)
+	if _, err := decryptTestData(t, ciphertext, object); err == nil {
+		t.Errorf("Expected decryption under another master key to fail")
+	}
+}
+
+func TestEncryptedObjects(t *testing.T) {
+	MasterKey = testMasterKey(t)
+	defer func() { MasterKey = nil }()
+
+	token := createAndAuthUser(t, "secretive", "foobar")
+	data := []byte("nobody should read this on disk")
+	uploadTestObject(t, token, "secret.txt", data)
+	uploadTestObject(t, token, "again.txt", data)
+
+	var object *Object
+	err := MainDB.View(func(tx *bolt.Tx) error {
+		owner, err := getUser(tx, "secretive")
+		if err != nil {
+			return err
+		}
+		versions, err := findObjectVersions(tx, owner, "secret.txt")
+		object = versions[0]
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if object.DataKey == nil {
+		t.Fatalf("Uploaded object has no data key")
+	}
+
+	stored, err := ioutil.ReadFile(path.Join(DataPath, object.LocalFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(stored, data) {
+		t.Errorf("Object data was stored in the clear")
+	}
+	if strings.Contains(object.LocalFileName, object.SHA256) {
+		t.Errorf("Blob key %v gives away the digest of the data", object.LocalFileName)
+	}
+
+	for _, filename := range []string{"secret.txt", "again.txt"} {
+		if status, body := getTestObject(t, token, "filename="+filename); status != http.StatusOK || body != string(data) {
+			t.Errorf("Expected decrypted %v. Got %v: %v", filename, status, body)
+		}
+	}
+
+	// After rotation the data is only readable under the new key
+	newKey := testMasterKey(t)
+	rewrapped, err := rotateMasterKey(MasterKey, newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rewrapped < 3 {
+		t.Errorf("Expected both objects and their blob to be rewrapped, only %v were", rewrapped)
+	}
+	if status, _ := getTestObject(t, token, "filename=secret.txt"); status != http.StatusInternalServerError {
+		t.Errorf("Expected object to be unreadable under the old key. Got %v", status)
+	}
+	MasterKey = newKey
+	if status, body := getTestObject(t, token, "filename=secret.txt"); status != http.StatusOK || body != string(data) {
+		t.Errorf("Expected decrypted object under the new key. Got %v: %v", status, body)
+	}
+}
+
+func TestLoadMasterKey(t *testing.T) {
+	keyFile := path.Join(t.TempDir(), "master.key")
+	err := ioutil.WriteFile(keyFile, []byte("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := loadMasterKey(keyFile)
+	if err != nil || len(key) != 32 || key[31] != 0x1f {
+		t.Errorf("Failed to load master key from file: %v", err)
+	}
+
+	os.Setenv(MasterKeyEnv, "not a key")
+	defer os.Unsetenv(MasterKeyEnv)
+	if _, err := loadMasterKey(""); err == nil {
+		t.Errorf("Expected malformed master key to be refused")
+	}
+
+	os.Unsetenv(MasterKeyEnv)
+	if key, err := loadMasterKey(""); key != nil || err != nil {
+		t.Errorf("Expected no master key. Got %v, %v", key, err)
+	}
+}
@@ -0,0 +1,615 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/boltdb/bolt"
+)
+
+// Folders
+//
+// Object names are paths of slash-separated segments, like
+// "photos/2017/beach.jpg", and every path a name is nested in is a folder.
+// Paths are normalized by dropping a leading slash, and must not have empty,
+// "." or ".." segments or contain control characters. A path can't name both
+// an object and a folder, so an object can't be created where a folder is, or
+// inside another object.
+//
+// Folders exist as long as objects are stored in them. Empty folders can also
+// be created, and are kept in their owner's record until they are deleted,
+// along with anything stored in them.
+
+// Longest path an object may be given, in bytes
+var MaxObjectPathLength = 1024
+
+var ErrPathConflict = errors.New("Path is already taken by an object or folder")
+
+type MoveObjectRequestJSON struct {
+	Token       string `json:"token"`
+	FileName    string `json:"filename"`
+	NewFileName string `json:"newfilename"`
+	// Whether objects already at the new paths are replaced
+	Overwrite bool `json:"overwrite,omitempty"`
+	// Group owning the object, if it isn't the user's own
+	Owner string `json:"owner,omitempty"`
+}
+
+type FolderRequestJSON struct {
+	Token string `json:"token"`
+	Path  string `json:"path"`
+	// New path, when renaming a folder, and whether objects already at the
+	// new paths are replaced
+	NewPath   string `json:"newpath,omitempty"`
+	Overwrite bool   `json:"overwrite,omitempty"`
+	// Group owning the folder, if it isn't the user's own
+	Owner string `json:"owner,omitempty"`
+}
+
+// normalizeObjectPath checks that name is a valid path, returning it without
+// any leading slash.
+func normalizeObjectPath(name string) (string, error) {
+	path := strings.TrimPrefix(name, "/")
+	if path == "" {
+		return "", fmt.Errorf("Paths may not be empty")
+	}
+	if len(path) > MaxObjectPathLength {
+		return "", fmt.Errorf("Paths may be at most %v bytes long", MaxObjectPathLength)
+	}
+	if !utf8.ValidString(path) {
+		return "", fmt.Errorf("Paths must be valid UTF-8")
+	}
+	for _, r := range path {
+		if unicode.IsControl(r) {
+			return "", fmt.Errorf("Paths may not contain control characters")
+		}
+	}
+	for _, segment := range strings.Split(path, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return "", fmt.Errorf("Paths may not contain empty, '.' or '..' segments")
+		}
+	}
+	return path, nil
+}
+
+// objectPath returns the name to look an existing object up by. Objects
+// created before paths were validated may have names that aren't valid paths,
+// so those are looked up as they are.
+func objectPath(name string) string {
+	path, err := normalizeObjectPath(name)
+	if err != nil {
+		return name
+	}
+	return path
+}
+
+// parentFolders returns the folders a path is nested in, outermost first.
+func parentFolders(path string) []string {
+	var folders []string
+	for i := range path {
+		if path[i] == '/' {
+			folders = append(folders, path[:i])
+		}
+	}
+	return folders
+}
+
+// namespaceTree holds the paths of the objects and folders in a namespace.
+type namespaceTree struct {
+	objects map[string]bool
+	folders map[string]bool
+}
+
+func newNamespaceTree() *namespaceTree {
+	return &namespaceTree{objects: map[string]bool{}, folders: map[string]bool{}}
+}
+
+func readNamespace(tx *bolt.Tx, owner *User) (*namespaceTree, error) {
+	tree := newNamespaceTree()
+	for _, id := range owner.ObjectIDs {
+		object, err := getObject(tx, id)
+		if err != nil {
+			return nil, err
+		}
+		if object == nil {
+			continue
+		}
+		tree.addObject(object.Name)
+	}
+	for _, folder := range owner.Folders {
+		tree.addFolder(folder)
+	}
+	return tree, nil
+}
+
+func (tree *namespaceTree) addObject(path string) {
+	tree.objects[path] = true
+	for _, folder := range parentFolders(path) {
+		tree.folders[folder] = true
+	}
+}
+
+func (tree *namespaceTree) addFolder(path string) {
+	tree.folders[path] = true
+	for _, parent := range parentFolders(path) {
+		tree.folders[parent] = true
+	}
+}
+
+// consistent reports whether no path is both an object and a folder, which
+// includes no object being inside another.
+func (tree *namespaceTree) consistent() bool {
+	for path := range tree.objects {
+		if tree.folders[path] {
+			return false
+		}
+	}
+	return true
+}
+
+// insideObject reports whether any of the folders a path is nested in is
+// actually an object.
+func (tree *namespaceTree) insideObject(path string) bool {
+	for _, folder := range parentFolders(path) {
+		if tree.objects[folder] {
+			return true
+		}
+	}
+	return false
+}
+
+// taken reports whether a new object or folder can't be put at path.
+func (tree *namespaceTree) taken(path string) bool {
+	return tree.objects[path] || tree.folders[path] || tree.insideObject(path)
+}
+
+// inFolder reports whether a path is a folder or is nested in it.
+func inFolder(path string, folder string) bool {
+	return path == folder || strings.HasPrefix(path, folder+"/")
+}
+
+// renamePaths gives every object and empty folder in owner's namespace the new
+// path rename maps it to, if any. Every version of a renamed object keeps its
+// grants and pending uploads. The caller must put owner.
+func renamePaths(tx *bolt.Tx, owner *User, rename func(path string) (string, bool)) error {
+	renamed := map[int]string{}
+	for _, id := range owner.ObjectIDs {
+		object, err := getObject(tx, id)
+		if err != nil {
+			return err
+		}
+		if object == nil {
+			continue
+		}
+		newName, ok := rename(object.Name)
+		if !ok {
+			continue
+		}
+
+		err = forgetGrants(tx, owner.Username, object.Name, object.Grants)
+		if err != nil {
+			return err
+		}
+		err = indexGrants(tx, owner.Username, newName, object.Grants)
+		if err != nil {
+			return err
+		}
+		object.Name = newName
+		err = putObject(tx, object)
+		if err != nil {
+			return err
+		}
+		renamed[object.ID] = newName
+	}
+
+	// A folder may be moved onto one that already exists
+	folders := []string{}
+	seen := map[string]bool{}
+	for _, folder := range owner.Folders {
+		if newFolder, ok := rename(folder); ok {
+			folder = newFolder
+		}
+		if !seen[folder] {
+			seen[folder] = true
+			folders = append(folders, folder)
+		}
+	}
+	owner.Folders = folders
+
+	// Uploads finish under the name they were started with, so pending ones
+	// follow their object
+	uploads := tx.Bucket([]byte("uploads"))
+	var moved []*UploadSession
+	err := uploads.ForEach(func(k, v []byte) error {
+		uploadSession := UploadSession{}
+		err := json.Unmarshal(v, &uploadSession)
+		if err != nil {
+			return err
+		}
+		if newName, ok := renamed[uploadSession.Object.ID]; ok {
+			uploadSession.Object.Name = newName
+			moved = append(moved, &uploadSession)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, uploadSession := range moved {
+		err = putUploadSession(tx, uploadSession)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// moveSubtree returns a rename for renamePaths that moves the object or
+// folder at from, and anything in it, to to.
+func moveSubtree(from string, to string) func(path string) (string, bool) {
+	return func(path string) (string, bool) {
+		if !inFolder(path, from) {
+			return "", false
+		}
+		return to + strings.TrimPrefix(path, from), true
+	}
+}
+
+// decodeFolderRequest reads the paths of a folder request, writing an error
+// to the client if they aren't valid.
+func decodeFolderRequest(res http.ResponseWriter, req *http.Request, renaming bool) *FolderRequestJSON {
+	requestJSON := FolderRequestJSON{}
+	err := json.NewDecoder(req.Body).Decode(&requestJSON)
+	if err != nil || (renaming && requestJSON.NewPath == "") {
+		res.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(res, "Error in decoding message")
+		return nil
+	}
+
+	requestJSON.Path, err = normalizeObjectPath(requestJSON.Path)
+	if err == nil && renaming {
+		requestJSON.NewPath, err = normalizeObjectPath(requestJSON.NewPath)
+	}
+	if err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(res, "%v", err)
+		return nil
+	}
+	return &requestJSON
+}
+
+func createFolderHandler(res http.ResponseWriter, req *http.Request) {
+	requestJSON := decodeFolderRequest(res, req, false)
+	if requestJSON == nil {
+		return
+	}
+
+	// Check and validate token
+	token := validateToken(res, requestJSON.Token, ScopeWrite)
+	if token == nil {
+		return
+	}
+	ownerName := requestedOwner(requestJSON.Owner, token)
+
+	err := MainDB.Update(func(tx *bolt.Tx) error {
+		owner, err := findAccessibleOwner(tx, token.User.Username, ownerName, PermissionWrite)
+		if err != nil {
+			return err
+		}
+		tree, err := readNamespace(tx, owner)
+		if err != nil {
+			return err
+		}
+		if tree.taken(requestJSON.Path) {
+			return ErrPathConflict
+		}
+
+		owner.Folders = append(owner.Folders, requestJSON.Path)
+		return putOwner(tx, owner)
+	})
+	if writeFolderError(res, err, ownerName, requestJSON.Path) {
+		return
+	}
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error creating folder %v of %v: %v", requestJSON.Path, ownerName, err)
+		return
+	}
+	log.Printf("Folder %v of %v has been created", requestJSON.Path, ownerName)
+}
+
+func renameFolderHandler(res http.ResponseWriter, req *http.Request) {
+	requestJSON := decodeFolderRequest(res, req, true)
+	if requestJSON == nil {
+		return
+	}
+	if inFolder(requestJSON.NewPath, requestJSON.Path) {
+		res.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(res, "An object or folder can't be moved onto or into itself")
+		return
+	}
+
+	// Check and validate token
+	token := validateToken(res, requestJSON.Token, ScopeWrite)
+	if token == nil {
+		return
+	}
+	ownerName := requestedOwner(requestJSON.Owner, token)
+
+	movePath(res, token, ownerName, requestJSON.Path, requestJSON.NewPath, requestJSON.Overwrite, true)
+}
+
+// moveObjectHandler renames an object, with every version of it, or moves a
+// folder and everything in it.
+func moveObjectHandler(res http.ResponseWriter, req *http.Request) {
+	requestJSON := MoveObjectRequestJSON{}
+	err := json.NewDecoder(req.Body).Decode(&requestJSON)
+	if err != nil || requestJSON.NewFileName == "" {
+		res.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(res, "Error in decoding message")
+		return
+	}
+
+	from, err := normalizeObjectPath(requestJSON.FileName)
+	if err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(res, "%v", err)
+		return
+	}
+	to, err := normalizeObjectPath(requestJSON.NewFileName)
+	if err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(res, "%v", err)
+		return
+	}
+	if inFolder(to, from) {
+		res.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(res, "An object or folder can't be moved onto or into itself")
+		return
+	}
+
+	// Check and validate token
+	token := validateToken(res, requestJSON.Token, ScopeWrite)
+	if token == nil {
+		return
+	}
+	ownerName := requestedOwner(requestJSON.Owner, token)
+
+	movePath(res, token, ownerName, from, to, requestJSON.Overwrite, false)
+}
+
+// movePath moves the object or folder at from in an owner's namespace, and
+// anything in it, to to, merging folders into any already there. Objects
+// already at the new paths are only replaced if overwrite is set. If
+// folderOnly is set, from must be a folder. The outcome is written to the
+// client.
+func movePath(res http.ResponseWriter, token *Token, ownerName string, from string, to string, overwrite bool, folderOnly bool) {
+	// Moving only changes records, so nothing is uploaded again. Objects
+	// replaced by an overwrite are removed in the same transaction, and their
+	// data once it has committed.
+	found := false
+	var replacedObjects []Object
+	err := MainDB.Update(func(tx *bolt.Tx) error {
+		owner, err := findAccessibleOwner(tx, token.User.Username, ownerName, PermissionWrite)
+		if err != nil {
+			return err
+		}
+		tree, err := readNamespace(tx, owner)
+		if err != nil || !((tree.objects[from] && !folderOnly) || tree.folders[from]) {
+			return err
+		}
+		found = true
+
+		// Work out what the namespace would look like after the move, and
+		// which objects would be replaced in it
+		rename := moveSubtree(from, to)
+		moved := map[string]bool{}
+		for path := range tree.objects {
+			if newPath, ok := rename(path); ok {
+				moved[newPath] = true
+			}
+		}
+		replaced := map[string]bool{}
+		result := newNamespaceTree()
+		for path := range tree.objects {
+			if newPath, ok := rename(path); ok {
+				result.addObject(newPath)
+			} else if moved[path] {
+				replaced[path] = true
+			} else {
+				result.addObject(path)
+			}
+		}
+		for _, folder := range owner.Folders {
+			if newFolder, ok := rename(folder); ok {
+				folder = newFolder
+			}
+			result.addFolder(folder)
+		}
+		if (len(replaced) > 0 && !overwrite) || !result.consistent() {
+			return ErrPathConflict
+		}
+
+		var replacedVersions []*Object
+		for _, id := range owner.ObjectIDs {
+			object, err := getObject(tx, id)
+			if err != nil {
+				return err
+			}
+			if object != nil && replaced[object.Name] {
+				replacedVersions = append(replacedVersions, object)
+			}
+		}
+		for _, object := range replacedVersions {
+			err = forgetGrants(tx, owner.Username, object.Name, object.Grants)
+			if err != nil {
+				return err
+			}
+			err = removeObject(tx, owner, object)
+			if err != nil {
+				return err
+			}
+			replacedObjects = append(replacedObjects, *object)
+		}
+
+		err = renamePaths(tx, owner, rename)
+		if err != nil {
+			return err
+		}
+		return putOwner(tx, owner)
+	})
+	if writeFolderError(res, err, ownerName, to) {
+		return
+	}
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error moving %v of %v to %v: %v", from, ownerName, to, err)
+		return
+	}
+	if !found && folderOnly {
+		res.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(res, "Failed to find folder %v belonging to %v", from, ownerName)
+		return
+	}
+	if !found {
+		res.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(res, "Failed to find object with filename %v belonging to user %v", from, ownerName)
+		return
+	}
+
+	for _, object := range replacedObjects {
+		removeObjectData(&object)
+		log.Printf("Object %v has been deleted", object.ID)
+	}
+	log.Printf("%v of %v has been moved to %v", from, ownerName, to)
+}
+
+func deleteFolderHandler(res http.ResponseWriter, req *http.Request) {
+	requestToken, ok := requiredQueryParam(res, req, "token")
+	if !ok {
+		return
+	}
+	requestPath, ok := requiredQueryParam(res, req, "path")
+	if !ok {
+		return
+	}
+	path, err := normalizeObjectPath(requestPath)
+	if err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(res, "%v", err)
+		return
+	}
+	recursive := req.URL.Query().Get("recursive") == "true"
+
+	// Check and validate token
+	token := validateToken(res, requestToken, ScopeWrite)
+	if token == nil {
+		return
+	}
+	ownerName := requestedOwner(req.URL.Query().Get("owner"), token)
+
+	// As when deleting an object, every record goes in a single transaction
+	// before any data is removed
+	found := false
+	notEmpty := false
+	var deletedObjects []Object
+	err = MainDB.Update(func(tx *bolt.Tx) error {
+		owner, err := findAccessibleOwner(tx, token.User.Username, ownerName, PermissionWrite)
+		if err != nil {
+			return err
+		}
+		tree, err := readNamespace(tx, owner)
+		if err != nil || !tree.folders[path] {
+			return err
+		}
+		found = true
+
+		var contents []*Object
+		for _, id := range owner.ObjectIDs {
+			object, err := getObject(tx, id)
+			if err != nil {
+				return err
+			}
+			if object != nil && inFolder(object.Name, path) {
+				contents = append(contents, object)
+			}
+		}
+		folders := []string{}
+		subfolders := false
+		for _, folder := range owner.Folders {
+			if !inFolder(folder, path) {
+				folders = append(folders, folder)
+			} else if folder != path {
+				subfolders = true
+			}
+		}
+		if !recursive && (subfolders || len(contents) > 0) {
+			notEmpty = true
+			return nil
+		}
+
+		for _, object := range contents {
+			err = forgetGrants(tx, owner.Username, object.Name, object.Grants)
+			if err != nil {
+				return err
+			}
+			err = removeObject(tx, owner, object)
+			if err != nil {
+				return err
+			}
+			deletedObjects = append(deletedObjects, *object)
+		}
+		owner.Folders = folders
+		return putOwner(tx, owner)
+	})
+	if writeFolderError(res, err, ownerName, path) {
+		return
+	}
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error deleting folder %v of %v: %v", path, ownerName, err)
+		return
+	}
+	if !found {
+		res.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(res, "Failed to find folder %v belonging to %v", path, ownerName)
+		return
+	}
+	if notEmpty {
+		res.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(res, "Folder %v is not empty", path)
+		return
+	}
+
+	for _, object := range deletedObjects {
+		removeObjectData(&object)
+		log.Printf("Object %v has been deleted", object.ID)
+	}
+	log.Printf("Folder %v of %v has been deleted", path, ownerName)
+}
+
+// writeFolderError tells the client why it can't change a folder, returning
+// false if err is some other error.
+func writeFolderError(res http.ResponseWriter, err error, ownerName string, path string) bool {
+	switch err {
+	case ErrObjectNotShared:
+		res.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(res, "Failed to find objects belonging to %v", ownerName)
+		return true
+	case ErrWriteNotGranted:
+		res.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(res, "Objects belonging to %v are read-only", ownerName)
+		return true
+	case ErrPathConflict:
+		res.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(res, "%v: %v", err, path)
+		return true
+	}
+	return false
+}
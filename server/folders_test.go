@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func folderTestRequest(t *testing.T, method string, handler http.HandlerFunc, folderJSON FolderRequestJSON) int {
+	buffer, _ := json.Marshal(folderJSON)
+	req, err := http.NewRequest(method, "/folder", bytes.NewBuffer(buffer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr.Code
+}
+
+func deleteTestFolder(t *testing.T, token string, path string, recursive bool) int {
+	query := "/folder?token=" + token + "&path=" + path
+	if recursive {
+		query += "&recursive=true"
+	}
+	req, err := http.NewRequest("DELETE", query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(deleteFolderHandler).ServeHTTP(rr, req)
+	return rr.Code
+}
+
+func listTestPrefix(t *testing.T, token string, query string) ListObjectsResponseJSON {
+	req, err := http.NewRequest("GET", "/objects?token="+token+"&"+query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(listObjectsHandler).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("list handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	response := ListObjectsResponseJSON{}
+	err = json.Unmarshal(rr.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+func listedNames(listing ListObjectsResponseJSON) []string {
+	names := []string{}
+	for _, object := range listing.Objects {
+		names = append(names, object.Name)
+	}
+	return names
+}
+
+func TestNormalizeObjectPath(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		want string
+	}{
+		{"notes.txt", "notes.txt"},
+		{"/photos/beach.jpg", "photos/beach.jpg"},
+		{"photos/2017/..jpg", "photos/2017/..jpg"},
+		{"", ""},
+		{"/", ""},
+		{"../secret", ""},
+		{"photos//beach.jpg", ""},
+		{"photos/./beach.jpg", ""},
+		{"photos/", ""},
+		{"tab\tname", ""},
+		{"bad\xffutf8", ""},
+		{strings.Repeat("a", MaxObjectPathLength+1), ""},
+	} {
+		name, want := test.name, test.want
+		path, err := normalizeObjectPath(name)
+		if want == "" && err == nil {
+			t.Errorf("Expected %q to be refused. Got %q", name, path)
+		}
+		if want != "" && (err != nil || path != want) {
+			t.Errorf("Expected %q to normalize to %q. Got %q: %v", name, want, path, err)
+		}
+	}
+}
+
+func TestFolders(t *testing.T) {
+	token := createAndAuthUser(t, "archivist", "foobar")
+	researcherToken := createAndAuthUser(t, "researcher", "foobar")
+
+	for _, invalid := range []string{"", "../secret", "photos//beach.jpg", "photos/./beach.jpg", "tab\tname"} {
+		if status, _ := createSharedTestObject(t, token, "archivist", invalid); status != http.StatusBadRequest {
+			t.Errorf("Expected path %q to be refused. Got %v", invalid, status)
+		}
+	}
+
+	uploadTestObject(t, token, "/photos/2017/beach.jpg", []byte("sand"))
+	uploadTestObject(t, token, "photos/2017/dunes.jpg", []byte("more sand"))
+	uploadTestObject(t, token, "photos/2018/snow.jpg", []byte("ice"))
+	uploadTestObject(t, token, "notes.txt", []byte("todo"))
+	if status, body := getTestObject(t, token, "filename=/photos/2017/beach.jpg"); status != http.StatusOK || body != "sand" {
+		t.Errorf("Expected leading slash to be ignored. Got %v: %v", status, body)
+	}
+
+	// Objects and folders can't share a path
+	for _, taken := range []string{"photos", "photos/2017", "notes.txt/draft.txt"} {
+		if status, _ := createSharedTestObject(t, token, "archivist", taken); status != http.StatusConflict {
+			t.Errorf("Expected object at %v to conflict. Got %v", taken, status)
+		}
+		if status := folderTestRequest(t, "POST", createFolderHandler, FolderRequestJSON{Token: token, Path: taken}); status != http.StatusConflict {
+			t.Errorf("Expected folder at %v to conflict. Got %v", taken, status)
+		}
+	}
+	if status := folderTestRequest(t, "POST", createFolderHandler, FolderRequestJSON{Token: token, Path: "photos/2019"}); status != http.StatusOK {
+		t.Fatalf("folder handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	if status := folderTestRequest(t, "POST", createFolderHandler, FolderRequestJSON{Token: token, Path: "photos/../etc"}); status != http.StatusBadRequest {
+		t.Errorf("Expected invalid folder path to be refused. Got %v", status)
+	}
+
+	// Listings can be narrowed by prefix, and rolled up by delimiter
+	listing := listTestPrefix(t, token, "delimiter=/")
+	if !reflect.DeepEqual(listedNames(listing), []string{"notes.txt"}) || !reflect.DeepEqual(listing.Prefixes, []string{"photos/"}) || listing.Total != 2 {
+		t.Errorf("Unexpected root listing %+v", listing)
+	}
+	listing = listTestPrefix(t, token, "prefix=photos/&delimiter=/")
+	if len(listing.Objects) != 0 || !reflect.DeepEqual(listing.Prefixes, []string{"photos/2017/", "photos/2018/", "photos/2019/"}) {
+		t.Errorf("Unexpected folder listing %+v", listing)
+	}
+	listing = listTestPrefix(t, token, "prefix=photos/&delimiter=/&limit=2")
+	if len(listing.Prefixes) != 2 || listing.Total != 3 || listing.NextOffset != 2 {
+		t.Errorf("Unexpected paginated listing %+v", listing)
+	}
+	listing = listTestPrefix(t, token, "prefix=photos/2017/")
+	if !reflect.DeepEqual(listedNames(listing), []string{"photos/2017/beach.jpg", "photos/2017/dunes.jpg"}) || len(listing.Prefixes) != 0 {
+		t.Errorf("Unexpected prefix listing %+v", listing)
+	}
+
+	// Renaming a folder moves everything in it, grants included
+	if status := shareTestObject(t, token, "photos/2017/beach.jpg", "researcher", PermissionRead); status != http.StatusOK {
+		t.Fatalf("share handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	for _, invalid := range []struct {
+		request FolderRequestJSON
+		status  int
+	}{
+		{FolderRequestJSON{Token: token, Path: "photos", NewPath: "photos/old"}, http.StatusBadRequest},
+		{FolderRequestJSON{Token: token, Path: "videos", NewPath: "clips"}, http.StatusNotFound},
+		{FolderRequestJSON{Token: token, Path: "photos/2018", NewPath: "notes.txt"}, http.StatusConflict},
+		{FolderRequestJSON{Token: researcherToken, Owner: "archivist", Path: "photos/2017", NewPath: "stolen"}, http.StatusNotFound},
+	} {
+		if status := folderTestRequest(t, "PATCH", renameFolderHandler, invalid.request); status != invalid.status {
+			t.Errorf("Expected rename %+v to fail with %v. Got %v", invalid.request, invalid.status, status)
+		}
+	}
+	if status := folderTestRequest(t, "PATCH", renameFolderHandler, FolderRequestJSON{Token: token, Path: "photos/2017", NewPath: "albums/summer"}); status != http.StatusOK {
+		t.Fatalf("folder rename handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	if status, body := getTestObject(t, token, "filename=albums/summer/dunes.jpg"); status != http.StatusOK || body != "more sand" {
+		t.Errorf("Expected object to move with its folder. Got %v: %v", status, body)
+	}
+	if status, _ := getTestObject(t, token, "filename=photos/2017/dunes.jpg"); status != http.StatusNotFound {
+		t.Errorf("Expected old path to be gone. Got %v", status)
+	}
+	if status, body := getTestObject(t, researcherToken, "owner=archivist&filename=albums/summer/beach.jpg"); status != http.StatusOK || body != "sand" {
+		t.Errorf("Expected grant to move with its object. Got %v: %v", status, body)
+	}
+	if shared := listTestSharedObjects(t, researcherToken); len(shared) != 1 || shared[0].Name != "albums/summer/beach.jpg" {
+		t.Errorf("Unexpected shared objects %+v", shared)
+	}
+
+	// Folders with anything in them are only deleted recursively
+	if status := deleteTestFolder(t, token, "albums", false); status != http.StatusConflict {
+		t.Errorf("Expected non-empty folder to be kept. Got %v", status)
+	}
+	if status := deleteTestFolder(t, token, "albums", true); status != http.StatusOK {
+		t.Fatalf("folder delete handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	if listing := listTestPrefix(t, token, "prefix=albums/"); listing.Total != 0 {
+		t.Errorf("Expected folder contents to be deleted. Got %+v", listing)
+	}
+	if shared := listTestSharedObjects(t, researcherToken); len(shared) != 0 {
+		t.Errorf("Expected grants to be deleted with their object. Got %+v", shared)
+	}
+	if status := deleteTestFolder(t, token, "photos/2019", false); status != http.StatusOK {
+		t.Errorf("Expected empty folder to be deleted. Got %v", status)
+	}
+	if status := deleteTestFolder(t, token, "photos/2019", false); status != http.StatusNotFound {
+		t.Errorf("Expected deleted folder to be gone. Got %v", status)
+	}
+	listing = listTestPrefix(t, token, "delimiter=/")
+	if !reflect.DeepEqual(listing.Prefixes, []string{"photos/"}) || listing.Total != 2 {
+		t.Errorf("Unexpected root listing after deletes %+v", listing)
+	}
+}
+
+func TestRenameFolderLikeMove(t *testing.T) {
+	token := createAndAuthUser(t, "curator", "foobar")
+	uploadTestObject(t, token, "inbox/a.txt", []byte("new"))
+	uploadTestObject(t, token, "archive/a.txt", []byte("old"))
+	uploadTestObject(t, token, "archive/b.txt", []byte("kept"))
+
+	// Renaming a folder onto another merges them, like moving it does
+	if status := folderTestRequest(t, "PATCH", renameFolderHandler, FolderRequestJSON{Token: token, Path: "archive/b.txt", NewPath: "b.txt"}); status != http.StatusNotFound {
+		t.Errorf("Expected object to be refused as a folder. Got %v", status)
+	}
+	if status := folderTestRequest(t, "PATCH", renameFolderHandler, FolderRequestJSON{Token: token, Path: "inbox", NewPath: "archive"}); status != http.StatusConflict {
+		t.Errorf("Expected colliding folder rename to be refused. Got %v", status)
+	}
+	if status := folderTestRequest(t, "PATCH", renameFolderHandler, FolderRequestJSON{Token: token, Path: "inbox", NewPath: "archive", Overwrite: true}); status != http.StatusOK {
+		t.Fatalf("folder rename handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	if status, body := getTestObject(t, token, "filename=archive/a.txt"); status != http.StatusOK || body != "new" {
+		t.Errorf("Expected merged object to be replaced. Got %v: %v", status, body)
+	}
+	if status, body := getTestObject(t, token, "filename=archive/b.txt"); status != http.StatusOK || body != "kept" {
+		t.Errorf("Expected other objects to be kept. Got %v: %v", status, body)
+	}
+	if listing := listTestPrefix(t, token, "prefix=inbox/"); listing.Total != 0 {
+		t.Errorf("Expected renamed folder to be gone. Got %+v", listing)
+	}
+}
+
+func moveTestObject(t *testing.T, moveJSON MoveObjectRequestJSON) int {
+	buffer, _ := json.Marshal(moveJSON)
+	req, err := http.NewRequest("PATCH", "/object", bytes.NewBuffer(buffer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(moveObjectHandler).ServeHTTP(rr, req)
+	return rr.Code
+}
+
+func TestMoveObject(t *testing.T) {
+	token := createAndAuthUser(t, "mover", "foobar")
+	viewerToken := createAndAuthUser(t, "onlooker", "foobar")
+
+	uploadTestObject(t, token, "draft.txt", []byte("one"))
+	uploadTestObject(t, token, "draft.txt", []byte("two"))
+	if status := shareTestObject(t, token, "draft.txt", "onlooker", PermissionRead); status != http.StatusOK {
+		t.Fatalf("share handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	pendingUploadID := createTestObject(t, token, "pending.txt")
+
+	// Renaming keeps every version, grants and pending uploads
+	if status := moveTestObject(t, MoveObjectRequestJSON{Token: token, FileName: "draft.txt", NewFileName: "docs/final.txt"}); status != http.StatusOK {
+		t.Fatalf("move handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	if status, body := getTestObject(t, token, "filename=docs/final.txt&version=1"); status != http.StatusOK || body != "one" {
+		t.Errorf("Expected old versions to be moved. Got %v: %v", status, body)
+	}
+	if status, _ := getTestObject(t, token, "filename=draft.txt"); status != http.StatusNotFound {
+		t.Errorf("Expected old filename to be gone. Got %v", status)
+	}
+	if status, body := getTestObject(t, viewerToken, "owner=mover&filename=docs/final.txt"); status != http.StatusOK || body != "two" {
+		t.Errorf("Expected grant to be moved. Got %v: %v", status, body)
+	}
+	if status := moveTestObject(t, MoveObjectRequestJSON{Token: token, FileName: "pending.txt", NewFileName: "docs/pending.txt"}); status != http.StatusOK {
+		t.Fatalf("move handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	if status := uploadTestData(t, token, pendingUploadID, []byte("late")); status != http.StatusOK {
+		t.Fatalf("object upload handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	if status, body := getTestObject(t, token, "filename=docs/pending.txt"); status != http.StatusOK || body != "late" {
+		t.Errorf("Expected pending upload to follow its object. Got %v: %v", status, body)
+	}
+
+	uploadTestObject(t, token, "other.txt", []byte("other"))
+	for _, invalid := range []struct {
+		request MoveObjectRequestJSON
+		status  int
+	}{
+		{MoveObjectRequestJSON{Token: token, FileName: "other.txt", NewFileName: "../other.txt"}, http.StatusBadRequest},
+		{MoveObjectRequestJSON{Token: token, FileName: "docs", NewFileName: "docs/docs"}, http.StatusBadRequest},
+		{MoveObjectRequestJSON{Token: token, FileName: "missing.txt", NewFileName: "found.txt"}, http.StatusNotFound},
+		{MoveObjectRequestJSON{Token: token, FileName: "other.txt", NewFileName: "docs/final.txt"}, http.StatusConflict},
+		{MoveObjectRequestJSON{Token: token, FileName: "other.txt", NewFileName: "docs", Overwrite: true}, http.StatusConflict},
+		{MoveObjectRequestJSON{Token: token, FileName: "other.txt", NewFileName: "docs/final.txt/other.txt", Overwrite: true}, http.StatusConflict},
+		{MoveObjectRequestJSON{Token: viewerToken, Owner: "mover", FileName: "other.txt", NewFileName: "mine.txt"}, http.StatusNotFound},
+	} {
+		if status := moveTestObject(t, invalid.request); status != invalid.status {
+			t.Errorf("Expected move %+v to fail with %v. Got %v", invalid.request, invalid.status, status)
+		}
+	}
+
+	// Overwriting replaces the object at the new path, grants and all
+	if status := moveTestObject(t, MoveObjectRequestJSON{Token: token, FileName: "other.txt", NewFileName: "docs/final.txt", Overwrite: true}); status != http.StatusOK {
+		t.Fatalf("move handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	if status, body := getTestObject(t, token, "filename=docs/final.txt"); status != http.StatusOK || body != "other" {
+		t.Errorf("Expected object to be replaced. Got %v: %v", status, body)
+	}
+	if status, _ := getTestObject(t, token, "filename=docs/final.txt&version=2"); status != http.StatusNotFound {
+		t.Errorf("Expected replaced object's versions to be gone. Got %v", status)
+	}
+	if shared := listTestSharedObjects(t, viewerToken); len(shared) != 0 {
+		t.Errorf("Expected replaced object's grants to be gone. Got %+v", shared)
+	}
+
+	// Folders move with everything in them, and merge into existing ones
+	// when overwriting
+	if status := moveTestObject(t, MoveObjectRequestJSON{Token: token, FileName: "docs", NewFileName: "archive/docs"}); status != http.StatusOK {
+		t.Fatalf("move handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	uploadTestObject(t, token, "inbox/final.txt", []byte("newer"))
+	if status := moveTestObject(t, MoveObjectRequestJSON{Token: token, FileName: "inbox", NewFileName: "archive/docs"}); status != http.StatusConflict {
+		t.Errorf("Expected colliding folder move to be refused. Got %v", status)
+	}
+	if status := moveTestObject(t, MoveObjectRequestJSON{Token: token, FileName: "inbox", NewFileName: "archive/docs", Overwrite: true}); status != http.StatusOK {
+		t.Fatalf("move handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	listing := listTestPrefix(t, token, "delimiter=/")
+	if len(listing.Objects) != 0 || !reflect.DeepEqual(listing.Prefixes, []string{"archive/"}) {
+		t.Errorf("Unexpected root listing %+v", listing)
+	}
+	listing = listTestPrefix(t, token, "prefix=archive/docs/")
+	if names := listedNames(listing); len(names) != 2 {
+		t.Errorf("Unexpected merged folder %v", names)
+	}
+	if status, body := getTestObject(t, token, "filename=archive/docs/final.txt"); status != http.StatusOK || body != "newer" {
+		t.Errorf("Expected merged object to be replaced. Got %v: %v", status, body)
+	}
+}
@@ -0,0 +1,553 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/boltdb/bolt"
+)
+
+// Groups
+//
+// A group owns objects of its own, in a namespace its members share. Requests
+// reach a group's namespace the way they reach an object shared by another
+// user, by naming "group:<name>" as the owner. What a member may do there
+// depends on their role: readers can list and get the group's objects,
+// writers can also create, upload, restore and delete them, and admins can
+// also manage the group's members. The user who creates a group is its first
+// admin, and a group can't be left without one, except by deleting the
+// account of its last admin.
+//
+// Groups are stored in the groups bucket, keyed by their name. Each group
+// holds a user record for its namespace, which indexes the group's objects and
+// counts them towards its quota like a user's own record does.
+
+const groupOwnerPrefix = "group:"
+
+const (
+	GroupRoleReader = "reader"
+	GroupRoleWriter = "writer"
+	GroupRoleAdmin  = "admin"
+)
+
+var (
+	ErrGroupNotFound      = errors.New("Group does not exist")
+	ErrGroupAdminOnly     = errors.New("Only admins may change the members of a group")
+	ErrGroupAdminRequired = errors.New("A group must keep at least one admin")
+)
+
+type GroupMember struct {
+	Username string `json:"username"`
+	Role     string `json:"role"`
+}
+
+type Group struct {
+	Name    string        `json:"name"`
+	Created string        `json:"created"`
+	Members []GroupMember `json:"members"`
+	// Index and usage of the objects the group owns
+	Namespace User `json:"namespace"`
+}
+
+type CreateGroupRequestJSON struct {
+	Token string `json:"token"`
+	Name  string `json:"name"`
+}
+
+type GroupMemberRequestJSON struct {
+	Token    string `json:"token"`
+	Group    string `json:"group"`
+	Username string `json:"username"`
+	Role     string `json:"role"`
+}
+
+type GroupJSON struct {
+	Name string `json:"name"`
+	// Owner to name in requests for the group's objects
+	Owner   string        `json:"owner"`
+	Created string        `json:"created"`
+	Role    string        `json:"role"`
+	Members []GroupMember `json:"members"`
+}
+
+// checkGroupName checks that name can name a group. Group names follow the
+// rules for a segment of an object's path, so they can't be confused with a
+// path or with another owner.
+func checkGroupName(name string) error {
+	if name == "" || name == "." || name == ".." {
+		return fmt.Errorf("Group names may not be empty, '.' or '..'")
+	}
+	if len(name) > MaxObjectPathLength {
+		return fmt.Errorf("Group names may be at most %v bytes long", MaxObjectPathLength)
+	}
+	if !utf8.ValidString(name) {
+		return fmt.Errorf("Group names must be valid UTF-8")
+	}
+	for _, r := range name {
+		if r == '/' || unicode.IsControl(r) {
+			return fmt.Errorf("Group names may not contain '/' or control characters")
+		}
+	}
+	if strings.HasPrefix(name, groupOwnerPrefix) {
+		return fmt.Errorf("Group names may not start with %q", groupOwnerPrefix)
+	}
+	return nil
+}
+
+// isGroupOwner reports whether an object owner names a group.
+func isGroupOwner(ownerName string) bool {
+	return strings.HasPrefix(ownerName, groupOwnerPrefix)
+}
+
+func getGroup(tx *bolt.Tx, name string) (*Group, error) {
+	data := tx.Bucket([]byte("groups")).Get([]byte(name))
+	if data == nil {
+		return nil, nil
+	}
+	group := Group{}
+	err := json.Unmarshal(data, &group)
+	if err != nil {
+		return nil, err
+	}
+	return &group, nil
+}
+
+func putGroup(tx *bolt.Tx, group *Group) error {
+	buf, err := json.Marshal(group)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket([]byte("groups")).Put([]byte(group.Name), buf)
+}
+
+// getOwner reads the record of an object owner, which is either a user or
+// the namespace of a group. It returns nil if no such owner exists.
+func getOwner(tx *bolt.Tx, ownerName string) (*User, error) {
+	if !isGroupOwner(ownerName) {
+		return getUser(tx, ownerName)
+	}
+	group, err := getGroup(tx, strings.TrimPrefix(ownerName, groupOwnerPrefix))
+	if err != nil || group == nil {
+		return nil, err
+	}
+	return &group.Namespace, nil
+}
+
+// putOwner persists the record of an object owner read with getOwner.
+func putOwner(tx *bolt.Tx, owner *User) error {
+	if !isGroupOwner(owner.Username) {
+		return putUser(tx, owner)
+	}
+	group, err := getGroup(tx, strings.TrimPrefix(owner.Username, groupOwnerPrefix))
+	if err != nil {
+		return err
+	}
+	if group == nil {
+		return fmt.Errorf("Group %v does not exist", owner.Username)
+	}
+	group.Namespace = *owner
+	return putGroup(tx, group)
+}
+
+// memberRole returns a user's role in a group, or "" if they aren't a member.
+func memberRole(group *Group, username string) string {
+	for _, member := range group.Members {
+		if member.Username == username {
+			return member.Role
+		}
+	}
+	return ""
+}
+
+// rolePermits reports whether a role allows what is asked for.
+func rolePermits(role string, permission string) bool {
+	switch role {
+	case GroupRoleAdmin, GroupRoleWriter:
+		return true
+	case GroupRoleReader:
+		return permission == PermissionRead
+	}
+	return false
+}
+
+// findAccessibleOwner returns the record of a user's own namespace, or of a
+// group's namespace if they are a member whose role allows permission. Like
+// findAccessibleVersions, it returns ErrObjectNotShared for namespaces the user
+// can't see and ErrWriteNotGranted for those they may only read.
+func findAccessibleOwner(tx *bolt.Tx, username string, ownerName string, permission string) (*User, error) {
+	if ownerName == username {
+		owner, err := getUser(tx, username)
+		if err != nil {
+			return nil, err
+		}
+		if owner == nil {
+			return nil, fmt.Errorf("Owner of token %v does not exist", username)
+		}
+		return owner, nil
+	}
+	if !isGroupOwner(ownerName) {
+		return nil, ErrObjectNotShared
+	}
+
+	group, err := getGroup(tx, strings.TrimPrefix(ownerName, groupOwnerPrefix))
+	if err != nil {
+		return nil, err
+	}
+	if group == nil {
+		return nil, ErrObjectNotShared
+	}
+	role := memberRole(group, username)
+	if role == "" {
+		return nil, ErrObjectNotShared
+	}
+	if !rolePermits(role, permission) {
+		return nil, ErrWriteNotGranted
+	}
+	return &group.Namespace, nil
+}
+
+// setMemberRole adds a user to a group, changes their role, or removes them if
+// role is empty. ErrGroupAdminRequired is returned if that would leave the
+// group without an admin. The caller must put group.
+func setMemberRole(group *Group, username string, role string) error {
+	members := withoutMember(group.Members, username)
+	if role != "" {
+		members = append(members, GroupMember{Username: username, Role: role})
+	}
+	if countAdmins(members) == 0 {
+		return ErrGroupAdminRequired
+	}
+	group.Members = members
+	return nil
+}
+
+func withoutMember(members []GroupMember, username string) []GroupMember {
+	remaining := []GroupMember{}
+	for _, member := range members {
+		if member.Username != username {
+			remaining = append(remaining, member)
+		}
+	}
+	return remaining
+}
+
+func countAdmins(members []GroupMember) int {
+	admins := 0
+	for _, member := range members {
+		if member.Role == GroupRoleAdmin {
+			admins++
+		}
+	}
+	return admins
+}
+
+// removeGroupMemberships takes a user out of every group they belong to,
+// even those they are the last admin of.
+func removeGroupMemberships(tx *bolt.Tx, username string) error {
+	var groups []*Group
+	err := tx.Bucket([]byte("groups")).ForEach(func(k, v []byte) error {
+		group := Group{}
+		err := json.Unmarshal(v, &group)
+		if err != nil {
+			return err
+		}
+		if memberRole(&group, username) != "" {
+			groups = append(groups, &group)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, group := range groups {
+		group.Members = withoutMember(group.Members, username)
+		if countAdmins(group.Members) == 0 {
+			log.Printf("Group %v has lost its last admin, user %v", group.Name, username)
+		}
+		err = putGroup(tx, group)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func groupInfo(group *Group, username string) GroupJSON {
+	return GroupJSON{
+		Name:    group.Name,
+		Owner:   groupOwnerPrefix + group.Name,
+		Created: group.Created,
+		Role:    memberRole(group, username),
+		Members: group.Members,
+	}
+}
+
+func writeGroup(res http.ResponseWriter, group *Group, username string) {
+	responseData, err := json.Marshal(groupInfo(group, username))
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error marshalling response for client: %v", err)
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.Write(responseData)
+}
+
+func createGroupHandler(res http.ResponseWriter, req *http.Request) {
+	requestJSON := CreateGroupRequestJSON{}
+	err := json.NewDecoder(req.Body).Decode(&requestJSON)
+	if err != nil || requestJSON.Name == "" {
+		res.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(res, "Error in decoding message")
+		return
+	}
+
+	err = checkGroupName(requestJSON.Name)
+	if err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(res, "%v", err)
+		return
+	}
+
+	// Check and validate token
+	token := validateToken(res, requestJSON.Token, ScopeAccount)
+	if token == nil {
+		return
+	}
+
+	group := Group{
+		Name:    requestJSON.Name,
+		Created: time.Now().UTC().Format("20060102150405"),
+		Members: []GroupMember{{Username: token.User.Username, Role: GroupRoleAdmin}},
+		Namespace: User{
+			Username:  groupOwnerPrefix + requestJSON.Name,
+			ObjectIDs: []int{},
+		},
+	}
+	exists := false
+	err = MainDB.Update(func(tx *bolt.Tx) error {
+		existing, err := getGroup(tx, group.Name)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			exists = true
+			return nil
+		}
+		return putGroup(tx, &group)
+	})
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error creating group %v: %v", group.Name, err)
+		return
+	}
+	if exists {
+		res.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(res, "That group already exists")
+		return
+	}
+
+	writeGroup(res, &group, token.User.Username)
+	log.Printf("Group %v has been created by user %v", group.Name, token.User.Username)
+}
+
+func listGroupsHandler(res http.ResponseWriter, req *http.Request) {
+	requestToken, ok := requiredQueryParam(res, req, "token")
+	if !ok {
+		return
+	}
+
+	// Check and validate token
+	token := validateToken(res, requestToken, ScopeRead)
+	if token == nil {
+		return
+	}
+
+	responseJSON := []GroupJSON{}
+	err := MainDB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("groups")).ForEach(func(k, v []byte) error {
+			group := Group{}
+			err := json.Unmarshal(v, &group)
+			if err != nil {
+				return err
+			}
+			if memberRole(&group, token.User.Username) != "" {
+				responseJSON = append(responseJSON, groupInfo(&group, token.User.Username))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error listing groups of user %v: %v", token.User.Username, err)
+		return
+	}
+
+	responseData, err := json.Marshal(responseJSON)
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error marshalling response for client: %v", err)
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.Write(responseData)
+}
+
+// getMemberGroup reads a group a user belongs to, returning ErrGroupNotFound if
+// they don't, and ErrGroupAdminOnly if admin is needed and they aren't one.
+func getMemberGroup(tx *bolt.Tx, name string, username string, admin bool) (*Group, error) {
+	group, err := getGroup(tx, name)
+	if err != nil {
+		return nil, err
+	}
+	if group == nil || memberRole(group, username) == "" {
+		return nil, ErrGroupNotFound
+	}
+	if admin && memberRole(group, username) != GroupRoleAdmin {
+		return nil, ErrGroupAdminOnly
+	}
+	return group, nil
+}
+
+// writeGroupError tells the client why it can't change a group, returning
+// false if err isn't one of the errors of getMemberGroup or setMemberRole.
+func writeGroupError(res http.ResponseWriter, err error, name string) bool {
+	switch err {
+	case ErrGroupNotFound:
+		res.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(res, "Failed to find group %v", name)
+		return true
+	case ErrGroupAdminOnly:
+		res.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(res, "%v", err)
+		return true
+	case ErrGroupAdminRequired:
+		res.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(res, "%v", err)
+		return true
+	}
+	return false
+}
+
+func setGroupMemberHandler(res http.ResponseWriter, req *http.Request) {
+	requestJSON := GroupMemberRequestJSON{}
+	err := json.NewDecoder(req.Body).Decode(&requestJSON)
+	if err != nil || requestJSON.Group == "" || requestJSON.Username == "" {
+		res.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(res, "Error in decoding message")
+		return
+	}
+	if requestJSON.Role != GroupRoleReader && requestJSON.Role != GroupRoleWriter && requestJSON.Role != GroupRoleAdmin {
+		res.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(res, "Parameter 'role' must be '%v', '%v' or '%v'", GroupRoleReader, GroupRoleWriter, GroupRoleAdmin)
+		return
+	}
+
+	// Check and validate token
+	token := validateToken(res, requestJSON.Token, ScopeAccount)
+	if token == nil {
+		return
+	}
+
+	var group *Group
+	memberExists := false
+	err = MainDB.Update(func(tx *bolt.Tx) error {
+		var err error
+		group, err = getMemberGroup(tx, requestJSON.Group, token.User.Username, true)
+		if err != nil {
+			return err
+		}
+
+		member, err := getUser(tx, requestJSON.Username)
+		if err != nil || member == nil {
+			return err
+		}
+		memberExists = true
+
+		err = setMemberRole(group, member.Username, requestJSON.Role)
+		if err != nil {
+			return err
+		}
+		return putGroup(tx, group)
+	})
+	if writeGroupError(res, err, requestJSON.Group) {
+		return
+	}
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error changing members of group %v: %v", requestJSON.Group, err)
+		return
+	}
+	if !memberExists {
+		res.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(res, "User %v does not exist", requestJSON.Username)
+		return
+	}
+
+	writeGroup(res, group, token.User.Username)
+	log.Printf("User %v has made user %v a %v of group %v", token.User.Username, requestJSON.Username, requestJSON.Role, requestJSON.Group)
+}
+
+func removeGroupMemberHandler(res http.ResponseWriter, req *http.Request) {
+	requestToken, ok := requiredQueryParam(res, req, "token")
+	if !ok {
+		return
+	}
+	groupName, ok := requiredQueryParam(res, req, "group")
+	if !ok {
+		return
+	}
+	username, ok := requiredQueryParam(res, req, "username")
+	if !ok {
+		return
+	}
+
+	// Check and validate token
+	token := validateToken(res, requestToken, ScopeAccount)
+	if token == nil {
+		return
+	}
+
+	// Members may leave, but only admins may remove others
+	isMember := false
+	err := MainDB.Update(func(tx *bolt.Tx) error {
+		group, err := getMemberGroup(tx, groupName, token.User.Username, username != token.User.Username)
+		if err != nil {
+			return err
+		}
+		if memberRole(group, username) == "" {
+			return nil
+		}
+		isMember = true
+
+		err = setMemberRole(group, username, "")
+		if err != nil {
+			return err
+		}
+		return putGroup(tx, group)
+	})
+	if writeGroupError(res, err, groupName) {
+		return
+	}
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error changing members of group %v: %v", groupName, err)
+		return
+	}
+	if !isMember {
+		res.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(res, "User %v is not a member of group %v", username, groupName)
+		return
+	}
+	log.Printf("User %v has been removed from group %v by user %v", username, groupName, token.User.Username)
+}
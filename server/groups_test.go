@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func createTestGroup(t *testing.T, token string, name string) int {
+	createJSON := CreateGroupRequestJSON{Token: token, Name: name}
+	buffer, _ := json.Marshal(createJSON)
+	req, err := http.NewRequest("POST", "/group", bytes.NewBuffer(buffer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(createGroupHandler).ServeHTTP(rr, req)
+	return rr.Code
+}
+
+func setTestGroupMember(t *testing.T, token string, group string, username string, role string) int {
+	memberJSON := GroupMemberRequestJSON{Token: token, Group: group, Username: username, Role: role}
+	buffer, _ := json.Marshal(memberJSON)
+	req, err := http.NewRequest("PUT", "/group/members", bytes.NewBuffer(buffer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(setGroupMemberHandler).ServeHTTP(rr, req)
+	return rr.Code
+}
+
+func removeTestGroupMember(t *testing.T, token string, group string, username string) int {
+	req, err := http.NewRequest("DELETE", "/group/members?token="+token+"&group="+group+"&username="+username, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(removeGroupMemberHandler).ServeHTTP(rr, req)
+	return rr.Code
+}
+
+func listTestGroups(t *testing.T, token string) []GroupJSON {
+	req, err := http.NewRequest("GET", "/groups?token="+token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(listGroupsHandler).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("group list handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	groups := []GroupJSON{}
+	err = json.Unmarshal(rr.Body.Bytes(), &groups)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return groups
+}
+
+func listTestOwnerObjects(t *testing.T, token string, owner string) (int, ListObjectsResponseJSON) {
+	req, err := http.NewRequest("GET", "/objects?token="+token+"&owner="+owner, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(listObjectsHandler).ServeHTTP(rr, req)
+	response := ListObjectsResponseJSON{}
+	if rr.Code == http.StatusOK {
+		err = json.Unmarshal(rr.Body.Bytes(), &response)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rr.Code, response
+}
+
+func TestGroups(t *testing.T) {
+	adminToken := createAndAuthUser(t, "captain", "foobar")
+	writerToken := createAndAuthUser(t, "deckhand", "foobar")
+	readerToken := createAndAuthUser(t, "passenger", "foobar")
+	outsiderToken := createAndAuthUser(t, "stowaway", "foobar")
+
+	if status := createTestGroup(t, adminToken, "crew"); status != http.StatusOK {
+		t.Fatalf("group handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	if status := createTestGroup(t, writerToken, "crew"); status != http.StatusConflict {
+		t.Errorf("Expected duplicate group to be refused. Got %v", status)
+	}
+
+	if status := setTestGroupMember(t, adminToken, "crew", "deckhand", "captain"); status != http.StatusBadRequest {
+		t.Errorf("Expected unknown role to be refused. Got %v", status)
+	}
+	if status := setTestGroupMember(t, adminToken, "crew", "nobody", GroupRoleReader); status != http.StatusNotFound {
+		t.Errorf("Expected unknown user to be refused. Got %v", status)
+	}
+	if status := setTestGroupMember(t, outsiderToken, "crew", "stowaway", GroupRoleAdmin); status != http.StatusNotFound {
+		t.Errorf("Expected outsider to be refused. Got %v", status)
+	}
+	for username, role := range map[string]string{"deckhand": GroupRoleWriter, "passenger": GroupRoleReader} {
+		if status := setTestGroupMember(t, adminToken, "crew", username, role); status != http.StatusOK {
+			t.Fatalf("group member handler returned wrong status code: got %v want %v", status, http.StatusOK)
+		}
+	}
+	if status := setTestGroupMember(t, writerToken, "crew", "stowaway", GroupRoleReader); status != http.StatusForbidden {
+		t.Errorf("Expected only admins to manage members. Got %v", status)
+	}
+
+	groups := listTestGroups(t, readerToken)
+	if len(groups) != 1 || groups[0].Owner != "group:crew" || groups[0].Role != GroupRoleReader || len(groups[0].Members) != 3 {
+		t.Errorf("Unexpected groups %+v", groups)
+	}
+	if groups := listTestGroups(t, outsiderToken); len(groups) != 0 {
+		t.Errorf("Expected no groups. Got %+v", groups)
+	}
+
+	// Writers can upload into the group's namespace, which is charged for it
+	status, uploadID := createSharedTestObject(t, writerToken, "group:crew", "manifest.txt")
+	if status != http.StatusOK {
+		t.Fatalf("object creator handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	if status := uploadTestData(t, writerToken, uploadID, []byte("cargo")); status != http.StatusOK {
+		t.Fatalf("object upload handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	if usage := getTestUsage(t, writerToken); usage.Objects != 0 || usage.Bytes != 0 {
+		t.Errorf("Expected group objects not to count towards the writer's usage. Got %+v", usage)
+	}
+
+	// The group's usage is recomputed along with every user's
+	err := MainDB.Update(func(tx *bolt.Tx) error {
+		group, err := getGroup(tx, "crew")
+		if err != nil {
+			return err
+		}
+		group.Namespace.UsedObjects = 7
+		group.Namespace.UsedBytes = 7
+		err = putGroup(tx, group)
+		if err != nil {
+			return err
+		}
+		return recountUsage(tx)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = MainDB.View(func(tx *bolt.Tx) error {
+		group, err := getGroup(tx, "crew")
+		if err != nil {
+			return err
+		}
+		if group.Namespace.UsedObjects != 1 || group.Namespace.UsedBytes != 5 {
+			t.Errorf("Wrong group usage after recount: %v objects, %v bytes", group.Namespace.UsedObjects, group.Namespace.UsedBytes)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Readers can list and read, but not write
+	if status, listing := listTestOwnerObjects(t, readerToken, "group:crew"); status != http.StatusOK || listing.Total != 1 || listing.Objects[0].Name != "manifest.txt" {
+		t.Errorf("Expected reader to list the group's objects. Got %v: %+v", status, listing)
+	}
+	if status, body := getTestObject(t, readerToken, "owner=group:crew&filename=manifest.txt"); status != http.StatusOK || body != "cargo" {
+		t.Errorf("Expected reader to get the group's object. Got %v: %v", status, body)
+	}
+	if status, _ := createSharedTestObject(t, readerToken, "group:crew", "graffiti.txt"); status != http.StatusForbidden {
+		t.Errorf("Expected reader not to create objects. Got %v", status)
+	}
+	if status := deleteSharedTestObject(t, readerToken, "group:crew", "manifest.txt"); status != http.StatusForbidden {
+		t.Errorf("Expected reader not to delete objects. Got %v", status)
+	}
+
+	// Outsiders can't tell the group's objects exist
+	if status, _ := listTestOwnerObjects(t, outsiderToken, "group:crew"); status != http.StatusNotFound {
+		t.Errorf("Expected outsider not to list the group's objects. Got %v", status)
+	}
+	if status, _ := getTestObject(t, outsiderToken, "owner=group:crew&filename=manifest.txt"); status != http.StatusNotFound {
+		t.Errorf("Expected outsider not to get the group's object. Got %v", status)
+	}
+	if status, _ := listTestOwnerObjects(t, outsiderToken, "captain"); status != http.StatusNotFound {
+		t.Errorf("Expected other users' objects not to be listed. Got %v", status)
+	}
+
+	// The group must keep an admin
+	if status := setTestGroupMember(t, adminToken, "crew", "captain", GroupRoleWriter); status != http.StatusConflict {
+		t.Errorf("Expected demoting the last admin to be refused. Got %v", status)
+	}
+	if status := removeTestGroupMember(t, adminToken, "crew", "captain"); status != http.StatusConflict {
+		t.Errorf("Expected the last admin leaving to be refused. Got %v", status)
+	}
+
+	// Members may leave, and lose access when they do
+	if status := removeTestGroupMember(t, readerToken, "crew", "deckhand"); status != http.StatusForbidden {
+		t.Errorf("Expected only admins to remove others. Got %v", status)
+	}
+	if status := removeTestGroupMember(t, readerToken, "crew", "passenger"); status != http.StatusOK {
+		t.Fatalf("group member handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	if status, _ := getTestObject(t, readerToken, "owner=group:crew&filename=manifest.txt"); status != http.StatusNotFound {
+		t.Errorf("Expected former member to lose access. Got %v", status)
+	}
+	if status := removeTestGroupMember(t, adminToken, "crew", "passenger"); status != http.StatusNotFound {
+		t.Errorf("Expected removing a non-member to fail. Got %v", status)
+	}
+
+	if status := deleteSharedTestObject(t, writerToken, "group:crew", "manifest.txt"); status != http.StatusOK {
+		t.Errorf("Expected writer to delete the group's object. Got %v", status)
+	}
+	if status, listing := listTestOwnerObjects(t, adminToken, "group:crew"); status != http.StatusOK || listing.Total != 0 {
+		t.Errorf("Expected the group to own nothing. Got %v: %+v", status, listing)
+	}
+}
+
+func TestGroupUsernamesReserved(t *testing.T) {
+	createUserJSON := UserCreationJSON{Username: "group:impostor", Password: "foobar"}
+	buffer, _ := json.Marshal(createUserJSON)
+	req, err := http.NewRequest("POST", "/user", bytes.NewBuffer(buffer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(createUserHandler).ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected username naming a group to be refused. Got %v", rr.Code)
+	}
+}
+
+func TestGroupNamesValidated(t *testing.T) {
+	token := createAndAuthUser(t, "founder", "foobar")
+
+	for _, name := range []string{"", ".", "..", "a/b", "/crew", "bell\x07", "group:crew", strings.Repeat("a", MaxObjectPathLength+1)} {
+		if status := createTestGroup(t, token, name); status != http.StatusBadRequest {
+			t.Errorf("Expected group name %q to be refused. Got %v", name, status)
+		}
+	}
+	if status := createTestGroup(t, token, "band: the reunion"); status != http.StatusOK {
+		t.Errorf("Expected valid group name to be accepted. Got %v", status)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// How long an upload session may wait for its data before the janitor
+// removes it, along with the object it was created for
+var UploadSessionTTL = 24 * time.Hour
+
+// SweepResult counts what a single sweep of the janitor removed.
+type SweepResult struct {
+	Tokens  int
+	Uploads int
+	Objects int
+	Blobs   int
+	Links   int
+}
+
+// startJanitor periodically sweeps the database for expired tokens, abandoned
+// uploads and unreferenced blobs, until the server exits. A non-positive interval disables
+// the janitor.
+func startJanitor(interval time.Duration) {
+	if interval <= 0 {
+		log.Printf("Janitor is disabled")
+		return
+	}
+
+	go func() {
+		for range time.Tick(interval) {
+			result, err := sweep()
+			if err != nil {
+				log.Printf("Janitor sweep failed: %v", err)
+				continue
+			}
+			log.Printf("Janitor sweep removed %v expired tokens, %v abandoned uploads, %v objects that were never uploaded, %v unreferenced blobs and %v unusable links",
+				result.Tokens, result.Uploads, result.Objects, result.Blobs, result.Links)
+		}
+	}()
+}
+
+// sweep removes expired tokens (including refresh tokens, and revoked signed
+// tokens that have since expired), links that can no longer be used, upload
+// sessions older than UploadSessionTTL and the objects those sessions were
+// created for, if they never received any data. Shared blobs no object
+// references any more are then collected.
+func sweep() (SweepResult, error) {
+	result := SweepResult{}
+	var abandonedObjects []Object
+	now := time.Now().UTC()
+
+	err := MainDB.Update(func(tx *bolt.Tx) error {
+		// Find expired tokens. Keys can't be deleted while iterating a cursor,
+		// so collect them first.
+		var expiredTokens []Token
+		err := tx.Bucket([]byte("tokens")).ForEach(func(k, v []byte) error {
+			token := Token{}
+			err := json.Unmarshal(v, &token)
+			if err != nil {
+				return err
+			}
+			if !checkTokenExpired(token) {
+				expiredTokens = append(expiredTokens, token)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, token := range expiredTokens {
+			err = deleteToken(tx, &token)
+			if err != nil {
+				return err
+			}
+		}
+		result.Tokens = len(expiredTokens)
+
+		// Revoked signed tokens that have expired needn't be listed any more
+		revokedTokens, err := sweepRevokedTokens(tx, now)
+		if err != nil {
+			return err
+		}
+		result.Tokens += revokedTokens
+
+		refreshTokens, err := sweepRefreshTokens(tx, now)
+		if err != nil {
+			return err
+		}
+		result.Tokens += refreshTokens
+
+		// Links that expired, were used up or lost their object
+		result.Links, err = sweepLinks(tx, now)
+		if err != nil {
+			return err
+		}
+
+		// Find abandoned uploads
+		var staleUploads []UploadSession
+		err = tx.Bucket([]byte("uploads")).ForEach(func(k, v []byte) error {
+			uploadSession := UploadSession{}
+			err := json.Unmarshal(v, &uploadSession)
+			if err != nil {
+				return err
+			}
+
+			if uploadSessionExpired(&uploadSession, now) {
+				staleUploads = append(staleUploads, uploadSession)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, uploadSession := range staleUploads {
+			err = tx.Bucket([]byte("uploads")).Delete([]byte(uploadSession.ID))
+			if err != nil {
+				return err
+			}
+			result.Uploads++
+
+			object, err := getObject(tx, uploadSession.Object.ID)
+			if err != nil {
+				return err
+			}
+			if object == nil || objectUploaded(object) {
+				continue
+			}
+
+			owner, err := getOwner(tx, object.Owner)
+			if err != nil {
+				return err
+			}
+			ownerExists := owner != nil
+			if !ownerExists {
+				owner = &User{Username: object.Owner}
+			}
+			err = removeObject(tx, owner, object)
+			if err != nil {
+				return err
+			}
+			if ownerExists {
+				err = putOwner(tx, owner)
+				if err != nil {
+					return err
+				}
+			}
+			abandonedObjects = append(abandonedObjects, *object)
+		}
+		result.Objects = len(abandonedObjects)
+		return nil
+	})
+	if err != nil {
+		return SweepResult{}, err
+	}
+
+	// Remove any parts that were uploaded before the client gave up
+	for _, object := range abandonedObjects {
+		removeObjectData(&object)
+	}
+
+	result.Blobs, err = collectBlobs()
+	if err != nil {
+		return SweepResult{}, err
+	}
+
+	// Replace the signing key once it is old enough. This also reloads the
+	// revocation list, now that expired tokens have been swept from it.
+	rotated, err := rotateSigningKeys(false)
+	if err != nil {
+		return SweepResult{}, err
+	}
+	if rotated {
+		log.Printf("Janitor rotated the key tokens are signed with")
+	}
+	return result, nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestSweep(t *testing.T) {
+	token := createAndAuthUser(t, "slob", "foobar")
+	uploadTestObject(t, token, "kept.txt", []byte("keep me"))
+	createTestObject(t, token, "abandoned.txt")
+	createTestObject(t, token, "fresh.txt")
+
+	// Age the first pending upload and the token beyond their lifetimes
+	longAgo := time.Now().UTC().Add(-48 * time.Hour).Format("20060102150405")
+	err := MainDB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("uploads"))
+		var oldest *UploadSession
+		err := b.ForEach(func(k, v []byte) error {
+			uploadSession := UploadSession{}
+			json.Unmarshal(v, &uploadSession)
+			if uploadSession.Object.Name == "abandoned.txt" && uploadSession.Object.Owner == "slob" {
+				oldest = &uploadSession
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		oldest.Object.CreationDate = longAgo
+		err = putUploadSession(tx, oldest)
+		if err != nil {
+			return err
+		}
+
+		tokenObject, _ := checkToken(token)
+		tokenObject.ExpirationDate = longAgo
+		return putToken(tx, tokenObject)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := sweep()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Tokens < 1 || result.Uploads < 1 || result.Objects < 1 {
+		t.Errorf("Unexpected sweep result: %+v", result)
+	}
+
+	if tokenObject, _ := checkToken(token); tokenObject != nil {
+		t.Errorf("Expected expired token to be swept")
+	}
+
+	MainDB.View(func(tx *bolt.Tx) error {
+		owner, _ := getUser(tx, "slob")
+		names := []string{}
+		for _, id := range owner.ObjectIDs {
+			object, _ := getObject(tx, id)
+			names = append(names, object.Name)
+		}
+		if len(names) != 2 || names[0] != "kept.txt" || names[1] != "fresh.txt" {
+			t.Errorf("Unexpected objects left after sweep: %v", names)
+		}
+		return nil
+	})
+}
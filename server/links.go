@@ -0,0 +1,449 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Public links
+//
+// An object's owner can mint a link to one version of it, which anyone can
+// download from /s/<link ID> without an account. Link IDs are random and can't
+// be guessed. A link may stop working at a given date or after a number of
+// downloads, and may require a password, which is hashed like user passwords
+// and counts towards the per-address authentication limit when guessed. Every
+// response serving any of the object's data counts as a download, ranged ones
+// included, so a limit can't be dodged by fetching an object piece by piece.
+//
+// Links are stored in the links bucket, keyed by their ID. Links to objects
+// that have since been deleted stop working, and are swept by the janitor along
+// with links that have expired or been used up.
+
+var ErrLinkUnusable = errors.New("Link can no longer be used")
+
+type Link struct {
+	ID       string `json:"id"`
+	Owner    string `json:"owner"`
+	ObjectID int    `json:"objectid"`
+	Created  string `json:"created"`
+	// Optional limits on when and how often the link may be used
+	Expires      string `json:"expires,omitempty"`
+	MaxDownloads int    `json:"maxdownloads,omitempty"`
+	Downloads    int    `json:"downloads"`
+	// Argon2id hash of the link's password, if it has one
+	PasswordHash []byte `json:"passwordhash,omitempty"`
+}
+
+type CreateLinkRequestJSON struct {
+	Token    string `json:"token"`
+	FileName string `json:"filename"`
+	// Version to link to, or 0 for the latest
+	Version      int    `json:"version,omitempty"`
+	Expires      string `json:"expires,omitempty"`
+	MaxDownloads int    `json:"maxdownloads,omitempty"`
+	Password     string `json:"password,omitempty"`
+}
+
+type LinkResponseJSON struct {
+	ID           string `json:"id"`
+	Path         string `json:"path"`
+	Version      int    `json:"version"`
+	Expires      string `json:"expires,omitempty"`
+	MaxDownloads int    `json:"maxdownloads,omitempty"`
+}
+
+func getLink(tx *bolt.Tx, id string) (*Link, error) {
+	data := tx.Bucket([]byte("links")).Get([]byte(id))
+	if data == nil {
+		return nil, nil
+	}
+	link := Link{}
+	err := json.Unmarshal(data, &link)
+	if err != nil {
+		return nil, err
+	}
+	return &link, nil
+}
+
+func putLink(tx *bolt.Tx, link *Link) error {
+	buf, err := json.Marshal(link)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket([]byte("links")).Put([]byte(link.ID), buf)
+}
+
+// linkUsable reports whether a link has neither expired nor been used up.
+func linkUsable(link *Link, now time.Time) bool {
+	if link.Expires != "" {
+		expires, err := time.Parse("20060102150405", link.Expires)
+		if err != nil || !now.Before(expires) {
+			return false
+		}
+	}
+	return link.MaxDownloads == 0 || link.Downloads < link.MaxDownloads
+}
+
+// deleteLinks deletes the links for which match returns true, returning how
+// many were deleted.
+func deleteLinks(tx *bolt.Tx, match func(*Link) (bool, error)) (int, error) {
+	b := tx.Bucket([]byte("links"))
+	var matched [][]byte
+	err := b.ForEach(func(k, v []byte) error {
+		link := Link{}
+		err := json.Unmarshal(v, &link)
+		if err != nil {
+			return err
+		}
+		ok, err := match(&link)
+		if ok {
+			matched = append(matched, k)
+		}
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, k := range matched {
+		err = b.Delete(k)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(matched), nil
+}
+
+// sweepLinks deletes links that can no longer be used, returning how many were
+// deleted.
+func sweepLinks(tx *bolt.Tx, now time.Time) (int, error) {
+	return deleteLinks(tx, func(link *Link) (bool, error) {
+		if !linkUsable(link, now) {
+			return true, nil
+		}
+		object, err := getObject(tx, link.ObjectID)
+		return object == nil, err
+	})
+}
+
+func createLinkHandler(res http.ResponseWriter, req *http.Request) {
+	requestJSON := CreateLinkRequestJSON{}
+	err := json.NewDecoder(req.Body).Decode(&requestJSON)
+	if err != nil || requestJSON.FileName == "" || requestJSON.Version < 0 {
+		res.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(res, "Error in decoding message")
+		return
+	}
+	if requestJSON.MaxDownloads < 0 {
+		res.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(res, "Parameter 'maxdownloads' must be a non-negative integer")
+		return
+	}
+	if requestJSON.Expires != "" {
+		expires, err := time.Parse("20060102150405", requestJSON.Expires)
+		if err != nil || !expires.After(time.Now().UTC()) {
+			res.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(res, "Parameter 'expires' must be a future date formatted as YYYYMMDDHHmmss")
+			return
+		}
+	}
+
+	// Check and validate token
+	token := validateToken(res, requestJSON.Token, ScopeWrite)
+	if token == nil {
+		return
+	}
+
+	id, err := randomID()
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error generating link ID: %v", err)
+		return
+	}
+	link := Link{
+		ID:           id,
+		Owner:        token.User.Username,
+		Created:      time.Now().UTC().Format("20060102150405"),
+		Expires:      requestJSON.Expires,
+		MaxDownloads: requestJSON.MaxDownloads,
+	}
+	if requestJSON.Password != "" {
+		link.PasswordHash, err = hashPassword(requestJSON.Password)
+		if err != nil {
+			res.WriteHeader(http.StatusInternalServerError)
+			log.Printf("Error hashing link password: %v", err)
+			return
+		}
+	}
+
+	// Only the owner can make an object public
+	var linkedObject *Object
+	err = MainDB.Update(func(tx *bolt.Tx) error {
+		_, versions, err := findAccessibleVersions(tx, token.User.Username, token.User.Username, requestJSON.FileName, PermissionWrite)
+		if err != nil {
+			return err
+		}
+
+		if requestJSON.Version == 0 {
+			linkedObject = latestVersion(versions)
+		}
+		for _, object := range versions {
+			if objectVersion(object) == requestJSON.Version {
+				linkedObject = object
+			}
+		}
+		if linkedObject == nil || !objectUploaded(linkedObject) {
+			return nil
+		}
+
+		link.ObjectID = linkedObject.ID
+		return putLink(tx, &link)
+	})
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error creating link to object %v of user %v: %v", requestJSON.FileName, token.User.Username, err)
+		return
+	}
+	if linkedObject == nil {
+		res.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(res, "Failed to find object with filename %v belonging to user %v", requestJSON.FileName, token.User.Username)
+		return
+	}
+	if link.ObjectID == 0 {
+		res.WriteHeader(http.StatusPreconditionFailed)
+		fmt.Fprintf(res, "Object was never uploaded, only created")
+		return
+	}
+
+	responseData, err := json.Marshal(LinkResponseJSON{
+		ID:           link.ID,
+		Path:         "/s/" + link.ID,
+		Version:      objectVersion(linkedObject),
+		Expires:      link.Expires,
+		MaxDownloads: link.MaxDownloads,
+	})
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error marshalling response for client: %v", err)
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.Write(responseData)
+	log.Printf("Link %v to object %v has been created by user %v", link.ID, link.ObjectID, token.User.Username)
+}
+
+func deleteLinkHandler(res http.ResponseWriter, req *http.Request) {
+	requestToken, ok := requiredQueryParam(res, req, "token")
+	if !ok {
+		return
+	}
+	linkID, ok := requiredQueryParam(res, req, "id")
+	if !ok {
+		return
+	}
+
+	// Check and validate token
+	token := validateToken(res, requestToken, ScopeWrite)
+	if token == nil {
+		return
+	}
+
+	found := false
+	err := MainDB.Update(func(tx *bolt.Tx) error {
+		link, err := getLink(tx, linkID)
+		if err != nil || link == nil || link.Owner != token.User.Username {
+			return err
+		}
+		found = true
+		return tx.Bucket([]byte("links")).Delete([]byte(linkID))
+	})
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error deleting link %v of user %v: %v", linkID, token.User.Username, err)
+		return
+	}
+	if !found {
+		res.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(res, "Failed to find link %v belonging to user %v", linkID, token.User.Username)
+		return
+	}
+	log.Printf("Link %v has been deleted by user %v", linkID, token.User.Username)
+}
+
+func getLinkHandler(res http.ResponseWriter, req *http.Request) {
+	linkID := strings.TrimPrefix(req.URL.Path, "/s/")
+	if len(linkID) != 32 {
+		res.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(res, "Link is not valid")
+		return
+	}
+
+	var link *Link
+	err := MainDB.View(func(tx *bolt.Tx) error {
+		var err error
+		link, err = getLink(tx, linkID)
+		return err
+	})
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error retrieving link %v from database: %v", linkID, err)
+		return
+	}
+	if link == nil {
+		res.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(res, "Link is not valid")
+		return
+	}
+	if !linkUsable(link, time.Now().UTC()) {
+		res.WriteHeader(http.StatusGone)
+		fmt.Fprintf(res, "Link has expired")
+		return
+	}
+
+	if link.PasswordHash != nil {
+		// Guessing a link's password is limited like guessing a user's
+		if ok, retryAfter := AuthIPLimiter.Allow(clientIP(req)); !ok {
+			writeTooManyRequests(res, retryAfter)
+			fmt.Fprintf(res, "Too many authentication requests from this address")
+			log.Printf("Rate limited authentication requests from %v", clientIP(req))
+			return
+		}
+
+		// The password is sent as that of HTTP basic authentication, so it
+		// doesn't end up in logs and browser histories like the URL does
+		_, password, ok := req.BasicAuth()
+		if !ok || password == "" {
+			res.Header().Set("WWW-Authenticate", `Basic realm="piedpiper link"`)
+			res.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintf(res, "Link requires a password")
+			return
+		}
+		err = checkArgonHash(link.PasswordHash, password)
+		if err == ErrPasswordMismatch {
+			res.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(res, "Password is not correct")
+			log.Printf("Wrong password given for link %v from %v", linkID, clientIP(req))
+			return
+		}
+		if err != nil {
+			res.WriteHeader(http.StatusInternalServerError)
+			log.Printf("Error checking password of link %v: %v", linkID, err)
+			return
+		}
+	}
+
+	var object *Object
+	err = MainDB.View(func(tx *bolt.Tx) error {
+		var err error
+		object, err = getObject(tx, link.ObjectID)
+		return err
+	})
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error retrieving object %v from database: %v", link.ObjectID, err)
+		return
+	}
+	if object == nil {
+		res.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(res, "Linked object no longer exists")
+		return
+	}
+
+	blob, err := openObjectData(object)
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error opening data of object %v: %v", object.ID, err)
+		return
+	}
+	defer blob.Close()
+
+	download := &linkDownloadWriter{ResponseWriter: res, linkID: linkID}
+	serveBlob(download, req, object, blob)
+	if download.link != nil {
+		log.Printf("Object %v has been downloaded through link %v from %v (download %v)", object.ID, linkID, clientIP(req), download.link.Downloads)
+	} else if !download.refused {
+		log.Printf("Link %v to object %v has been accessed from %v with status %v", linkID, object.ID, clientIP(req), download.status)
+	}
+}
+
+// countLinkDownload counts a download through a link, checking its limits
+// again in case other downloads used it up in the meantime. It returns the
+// link, or nil if it can no longer be used.
+func countLinkDownload(linkID string) (*Link, error) {
+	var counted *Link
+	err := MainDB.Update(func(tx *bolt.Tx) error {
+		link, err := getLink(tx, linkID)
+		if err != nil || link == nil || !linkUsable(link, time.Now().UTC()) {
+			return err
+		}
+		link.Downloads++
+		counted = link
+		return putLink(tx, link)
+	})
+	return counted, err
+}
+
+// servesData reports whether a response with status holds any of the
+// object's data.
+func servesData(status int) bool {
+	return status == http.StatusOK || status == http.StatusPartialContent
+}
+
+// linkDownloadWriter counts a download through a link once its response turns
+// out to serve data, and refuses the download instead if the link was used up
+// in the meantime.
+type linkDownloadWriter struct {
+	http.ResponseWriter
+	linkID string
+	// Set once the download has been counted
+	link    *Link
+	status  int
+	started bool
+	refused bool
+}
+
+func (w *linkDownloadWriter) WriteHeader(status int) {
+	if w.started {
+		return
+	}
+	w.started = true
+	w.status = status
+
+	if servesData(status) {
+		link, err := countLinkDownload(w.linkID)
+		if err != nil || link == nil {
+			w.refused = true
+			for _, name := range []string{"Accept-Ranges", "Content-Length", "Content-Range", "Content-Type", "Last-Modified"} {
+				w.Header().Del(name)
+			}
+			if err != nil {
+				w.ResponseWriter.WriteHeader(http.StatusInternalServerError)
+				log.Printf("Error counting download of link %v: %v", w.linkID, err)
+				return
+			}
+			w.ResponseWriter.WriteHeader(http.StatusGone)
+			fmt.Fprintf(w.ResponseWriter, "Link has expired")
+			return
+		}
+		w.link = link
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *linkDownloadWriter) Write(data []byte) (int, error) {
+	if !w.started {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.refused {
+		return 0, ErrLinkUnusable
+	}
+	return w.ResponseWriter.Write(data)
+}
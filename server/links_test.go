@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+func createTestLinkRequest(t *testing.T, linkJSON CreateLinkRequestJSON) *httptest.ResponseRecorder {
+	buffer, _ := json.Marshal(linkJSON)
+	req, err := http.NewRequest("POST", "/object/link", bytes.NewBuffer(buffer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(createLinkHandler).ServeHTTP(rr, req)
+	return rr
+}
+
+func createTestLink(t *testing.T, linkJSON CreateLinkRequestJSON) LinkResponseJSON {
+	rr := createTestLinkRequest(t, linkJSON)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("link handler returned wrong status code: got %v want %v: %v", rr.Code, http.StatusOK, rr.Body.String())
+	}
+	response := LinkResponseJSON{}
+	err := json.Unmarshal(rr.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+func getTestLink(t *testing.T, path string) (int, string) {
+	req, err := http.NewRequest("GET", path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return getTestLinkRequest(t, req)
+}
+
+func getTestLinkRequest(t *testing.T, req *http.Request) (int, string) {
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(getLinkHandler).ServeHTTP(rr, req)
+	return rr.Code, rr.Body.String()
+}
+
+func TestLinks(t *testing.T) {
+	token := createAndAuthUser(t, "publisher", "foobar")
+	uploadTestObject(t, token, "flyer.txt", []byte("first edition"))
+	uploadTestObject(t, token, "flyer.txt", []byte("second edition"))
+	createTestObject(t, token, "unfinished.txt")
+
+	longAgo := time.Now().UTC().Add(-time.Hour).Format("20060102150405")
+	for _, invalid := range []struct {
+		request CreateLinkRequestJSON
+		status  int
+	}{
+		{CreateLinkRequestJSON{Token: token, FileName: "flyer.txt", Expires: longAgo}, http.StatusBadRequest},
+		{CreateLinkRequestJSON{Token: token, FileName: "flyer.txt", MaxDownloads: -1}, http.StatusBadRequest},
+		{CreateLinkRequestJSON{Token: token, FileName: "flyer.txt", Version: 3}, http.StatusNotFound},
+		{CreateLinkRequestJSON{Token: token, FileName: "missing.txt"}, http.StatusNotFound},
+		{CreateLinkRequestJSON{Token: token, FileName: "unfinished.txt"}, http.StatusPreconditionFailed},
+	} {
+		if rr := createTestLinkRequest(t, invalid.request); rr.Code != invalid.status {
+			t.Errorf("Expected link %+v to fail with %v. Got %v", invalid.request, invalid.status, rr.Code)
+		}
+	}
+
+	// Links need no token, and keep serving the version they were made for
+	latest := createTestLink(t, CreateLinkRequestJSON{Token: token, FileName: "flyer.txt"})
+	first := createTestLink(t, CreateLinkRequestJSON{Token: token, FileName: "flyer.txt", Version: 1})
+	if latest.Version != 2 || first.Version != 1 || len(latest.ID) != 32 || latest.Path != "/s/"+latest.ID {
+		t.Errorf("Unexpected links %+v and %+v", latest, first)
+	}
+	uploadTestObject(t, token, "flyer.txt", []byte("third edition"))
+	if status, body := getTestLink(t, latest.Path); status != http.StatusOK || body != "second edition" {
+		t.Errorf("Expected link to serve the object. Got %v: %v", status, body)
+	}
+	if status, body := getTestLink(t, first.Path); status != http.StatusOK || body != "first edition" {
+		t.Errorf("Expected link to serve the first version. Got %v: %v", status, body)
+	}
+	if status, _ := getTestLink(t, "/s/00000000000000000000000000000000"); status != http.StatusNotFound {
+		t.Errorf("Expected unknown link to be refused. Got %v", status)
+	}
+
+	// Limited links stop working once used up
+	limited := createTestLink(t, CreateLinkRequestJSON{Token: token, FileName: "flyer.txt", MaxDownloads: 1})
+	if status, _ := getTestLink(t, limited.Path); status != http.StatusOK {
+		t.Errorf("Expected first download to work. Got %v", status)
+	}
+	if status, _ := getTestLink(t, limited.Path); status != http.StatusGone {
+		t.Errorf("Expected used up link to be refused. Got %v", status)
+	}
+
+	// Ranged downloads count too, wherever they start
+	ranged := createTestLink(t, CreateLinkRequestJSON{Token: token, FileName: "flyer.txt", MaxDownloads: 1})
+	rangeRequest := func(byteRange string) *http.Request {
+		req, err := http.NewRequest("GET", ranged.Path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Range", byteRange)
+		return req
+	}
+	if status, body := getTestLinkRequest(t, rangeRequest("bytes=1-")); status != http.StatusPartialContent || body != "hird edition" {
+		t.Errorf("Expected ranged download to work. Got %v: %v", status, body)
+	}
+	for _, byteRange := range []string{"bytes=1-", "bytes=0-0"} {
+		if status, _ := getTestLinkRequest(t, rangeRequest(byteRange)); status != http.StatusGone {
+			t.Errorf("Expected used up link to refuse %v. Got %v", byteRange, status)
+		}
+	}
+	if status, _ := getTestLink(t, ranged.Path); status != http.StatusGone {
+		t.Errorf("Expected used up link to be refused. Got %v", status)
+	}
+
+	// Passwords are given through basic authentication, never in the URL
+	protected := createTestLink(t, CreateLinkRequestJSON{Token: token, FileName: "flyer.txt", Password: "hunter2"})
+	passwordRequest := func(password string) *http.Request {
+		req, err := http.NewRequest("GET", protected.Path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth("", password)
+		return req
+	}
+	if status, _ := getTestLink(t, protected.Path); status != http.StatusUnauthorized {
+		t.Errorf("Expected link without password to be refused. Got %v", status)
+	}
+	if status, _ := getTestLink(t, protected.Path+"?password=hunter2"); status != http.StatusUnauthorized {
+		t.Errorf("Expected password in the URL to be ignored. Got %v", status)
+	}
+	if status, _ := getTestLinkRequest(t, passwordRequest("hunter3")); status != http.StatusForbidden {
+		t.Errorf("Expected link with wrong password to be refused. Got %v", status)
+	}
+	if status, body := getTestLinkRequest(t, passwordRequest("hunter2")); status != http.StatusOK || body != "third edition" {
+		t.Errorf("Expected link with password to work. Got %v: %v", status, body)
+	}
+
+	// Expired links stop working too
+	expiring := createTestLink(t, CreateLinkRequestJSON{Token: token, FileName: "flyer.txt", Expires: time.Now().UTC().Add(time.Hour).Format("20060102150405")})
+	err := MainDB.Update(func(tx *bolt.Tx) error {
+		link, err := getLink(tx, expiring.ID)
+		if err != nil {
+			return err
+		}
+		link.Expires = longAgo
+		return putLink(tx, link)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := getTestLink(t, expiring.Path); status != http.StatusGone {
+		t.Errorf("Expected expired link to be refused. Got %v", status)
+	}
+
+	// Links can be deleted by their owner, and die with their object
+	req, err := http.NewRequest("DELETE", "/object/link?token="+token+"&id="+first.ID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(deleteLinkHandler).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("link delete handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if status, _ := getTestLink(t, first.Path); status != http.StatusNotFound {
+		t.Errorf("Expected deleted link to be refused. Got %v", status)
+	}
+
+	deleteTestObject(t, token, "flyer.txt")
+	if status, _ := getTestLink(t, latest.Path); status != http.StatusNotFound {
+		t.Errorf("Expected link to deleted object to be refused. Got %v", status)
+	}
+	err = MainDB.Update(func(tx *bolt.Tx) error {
+		_, err := sweepLinks(tx, time.Now().UTC())
+		if err != nil {
+			return err
+		}
+		for _, id := range []string{latest.ID, limited.ID, protected.ID, expiring.ID} {
+			if link, _ := getLink(tx, id); link != nil {
+				t.Errorf("Expected link %v to be swept", id)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
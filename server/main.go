@@ -3,26 +3,27 @@ package main
 import (
 	"bytes"
 	"crypto/rand"
+	"crypto/sha256"
 	"crypto/sha512"
+	"encoding/base64"
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"io/ioutil"
+	"hash"
+	"io"
 	"log"
 	"math/big"
-	insecureRand "math/rand"
 	"net/http"
 	"net/url"
 	"os"
-	"path"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
-	"golang.org/x/crypto/bcrypt"
-
 	"github.com/boltdb/bolt"
 	"github.com/gorilla/mux"
 )
@@ -30,8 +31,26 @@ import (
 var MainDB *bolt.DB
 var DataPath string
 
+// Number of versions kept of each object for users who haven't chosen their own
+var DefaultVersionRetention = 10
+
+// Returned when uploaded data doesn't have the digest the client said it would
+var ErrDigestMismatch = errors.New("Uploaded data does not match its SHA-256 digest")
+
+// Returned when an upload is finished after its session was used up, such as
+// by a concurrent upload
+var ErrUploadSessionGone = errors.New("Upload session no longer exists")
+
+// Largest request body, in bytes, accepted when uploading an object
+var MaxUploadSize int64 = 1 << 30
+
 const (
 	CHARS = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ1234567890"
+
+	// Page sizes used by GET /objects when the client does not ask for one,
+	// and the most it may ask for.
+	DEFAULT_LIST_LIMIT = 100
+	MAX_LIST_LIMIT     = 1000
 )
 
 // API JSON objects
@@ -49,6 +68,29 @@ type GetObjectRequestJSON struct {
 type CreateObjectRequestJSON struct {
 	Token    string `json: "token"`
 	FileName string `json: "filename"`
+
+	// Optional hex-encoded SHA-256 digest the uploaded data must match
+	SHA256 string `json:"sha256,omitempty"`
+
+	// User who shared the object, when uploading a new version of it
+	Owner string `json:"owner,omitempty"`
+}
+
+type RestoreObjectRequestJSON struct {
+	Token    string `json:"token"`
+	FileName string `json:"filename"`
+	Version  int    `json:"version"`
+	// User who shared the object, when restoring a version of it
+	Owner string `json:"owner,omitempty"`
+}
+
+type VersionRetentionRequestJSON struct {
+	Token    string `json:"token"`
+	Versions int    `json:"versions"`
+}
+
+type RevokeAllTokensRequestJSON struct {
+	Token string `json:"token"`
 }
 
 type UserCreationJSON struct {
@@ -60,11 +102,51 @@ type AuthUserRequestJSON struct {
 	Username string `json: "username"`
 	Password string `json: "password"`
 	ReqDate  string `json: "reqdate"`
+	// "signed" for a signed token, limited to scopes if any are given
+	Format string   `json:"format,omitempty"`
+	Scopes []string `json:"scopes,omitempty"`
+	// Also issue a refresh token, which implies a signed token
+	Refresh bool `json:"refresh,omitempty"`
+	// TOTP or recovery code, for users with two-factor authentication
+	OTP string `json:"otp,omitempty"`
+	// Registered device to tie the token to, and the device's signature
+	// proving the request came from it
+	Device          string `json:"device,omitempty"`
+	DeviceSignature string `json:"devicesignature,omitempty"`
 }
 
 type AuthUserResponseJSON struct {
 	ExpirationDate string `json: "expdate"`
 	Nonce          string `json: "nonce"`
+	// Only set for signed tokens, which are sent whole
+	Token  string   `json:"token,omitempty"`
+	Scopes []string `json:"scopes,omitempty"`
+	// Only set when a refresh token was asked for
+	RefreshToken          string `json:"refreshtoken,omitempty"`
+	RefreshExpirationDate string `json:"refreshexpdate,omitempty"`
+}
+
+type ObjectInfoJSON struct {
+	ID           int    `json:"id"`
+	Name         string `json:"name"`
+	Version      int    `json:"version"`
+	Versions     int    `json:"versions,omitempty"`
+	Size         int64  `json:"size"`
+	SHA256       string `json:"sha256,omitempty"`
+	State        string `json:"state"`
+	CreationDate string `json:"created"`
+	UploadDate   string `json:"uploaded,omitempty"`
+	// Users the object is shared with
+	Grants []Grant `json:"grants,omitempty"`
+}
+
+type ListObjectsResponseJSON struct {
+	Objects    []ObjectInfoJSON `json:"objects"`
+	Total      int              `json:"total"`
+	Offset     int              `json:"offset"`
+	NextOffset int              `json:"nextoffset,omitempty"`
+	// Folders grouping objects, when listing with a delimiter
+	Prefixes []string `json:"prefixes,omitempty"`
 }
 
 // Internal use structs
@@ -72,6 +154,32 @@ type User struct {
 	Username     string `json: "username"`
 	PasswordHash []byte `json: "passhash"`
 	ObjectIDs    []int  `json: "objectids"`
+
+	// Number of versions kept of each object, or 0 for the server default
+	VersionRetention int `json:"versionretention"`
+
+	// Storage quotas, or 0 for the server default and negative for none
+	QuotaBytes   int64 `json:"quotabytes"`
+	QuotaObjects int   `json:"quotaobjects"`
+
+	// Running counts of what the user stores
+	UsedBytes   int64 `json:"usedbytes"`
+	UsedObjects int   `json:"usedobjects"`
+
+	// Signed tokens are only valid while they carry the user's current epoch
+	TokenEpoch string `json:"tokenepoch"`
+
+	// Base32 TOTP secret if two-factor authentication is enabled, the last
+	// time step a code was used for, and digests of unused recovery codes
+	TOTPSecret    string   `json:"totpsecret,omitempty"`
+	TOTPLastStep  int64    `json:"totplaststep,omitempty"`
+	RecoveryCodes []string `json:"recoverycodes,omitempty"`
+	// Secret of an enrollment waiting for its first code, which only takes
+	// the place of TOTPSecret once confirmed
+	TOTPPendingSecret string `json:"totppendingsecret,omitempty"`
+
+	// Folders created empty, which last until they are deleted
+	Folders []string `json:"folders,omitempty"`
 }
 
 type Object struct {
@@ -79,17 +187,46 @@ type Object struct {
 	Name          string `json: "name"`
 	Owner         string `json: "owner"`
 	LocalFileName string `json: "localfilename"`
+	Version       int    `json:"version"`
+	SHA256        string `json:"sha256"`
+	Size          int64  `json:"size"`
+	CreationDate  string `json:"creationdate"`
+	UploadDate    string `json:"uploaddate"`
+	// Digest of the shared blob holding the object's data. Objects uploaded
+	// before data was shared have none, and own their data outright.
+	Blob string `json:"blob,omitempty"`
+	// Key the object's data is encrypted with, if it is encrypted
+	DataKey *WrappedKey `json:"datakey,omitempty"`
+	// Users other than the owner with access to the object
+	Grants []Grant `json:"grants,omitempty"`
 }
 
 type UploadSession struct {
-	ID     int    `json: "id"`
+	ID     string `json: "id"`
 	Object Object `json: "object"`
+
+	// Token that created the session, and which must be used to upload
+	Token []byte `json:"token"`
+
+	// Progress of a resumable upload: the total size announced by the client
+	// and the byte ranges received so far
+	Size     int64       `json:"size"`
+	Received []ByteRange `json:"received"`
+
+	// Hex-encoded SHA-256 digest the client said the data will have
+	ExpectedSHA256 string `json:"expectedsha256"`
 }
 
 type Token struct {
 	Token          []byte `json: "token"`
 	User           User   `json: "user"`
 	ExpirationDate string `json: "expirationdate"`
+
+	// Device the token is tied to, if any
+	DeviceID string `json:"deviceid,omitempty"`
+
+	// Claims of a signed token, which is never stored
+	Claims *TokenClaims `json:"-"`
 }
 
 // itob returns an 8-byte big endian representation of v.
@@ -145,50 +282,73 @@ func checkTokenExpired(token Token) bool {
 	return true
 }
 
-func getObjectHandler(res http.ResponseWriter, req *http.Request) {
-	// Decode Parameters from URL
-	queryParams := req.URL.Query()
+// validateToken looks up the token presented by a client and checks that it has
+// not expired. If the token can't be used, an error is written to res and nil
+// is returned, so the caller only has to bail out.
+func validateToken(res http.ResponseWriter, requestToken string, scope string) *Token {
+	var token *Token
+	if isSignedToken(requestToken) {
+		token = validateSignedToken(res, requestToken)
+	} else {
+		token = validateLegacyToken(res, requestToken)
+	}
+	if token == nil {
+		return nil
+	}
 
-	// Check to ensure that correct parameters exist
-	if len(queryParams["token"]) == 0 || len(queryParams["filename"]) == 0 {
-		res.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(res, "Error in decoding url parameters")
-		return
+	if token.DeviceID != "" {
+		err := markDeviceSeen(token.User.Username, token.DeviceID)
+		if err != nil {
+			log.Printf("Error marking device %v of user %v as seen: %v", token.DeviceID, token.User.Username, err)
+		}
 	}
 
-	requestToken, err := url.QueryUnescape(queryParams["token"][0])
-	if err != nil {
-		res.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(res, "Parameter 'token' was not URL encoded properly")
-		return
+	// Legacy tokens may do anything
+	if scope != "" && token.Claims != nil && !hasScope(token.Claims.Scopes, scope) {
+		res.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(res, "Token does not grant the %v scope", scope)
+		return nil
 	}
+	return token
+}
 
-	requestFileName, err := url.QueryUnescape(queryParams["filename"][0])
+func validateSignedToken(res http.ResponseWriter, requestToken string) *Token {
+	claims, err := verifySignedToken(requestToken)
+	if err == ErrTokenExpired {
+		log.Printf("Expired signed token presented for user %v", claims.Username)
+		res.WriteHeader(http.StatusPreconditionFailed)
+		fmt.Fprintf(res, "Token is expired.")
+		return nil
+	}
 	if err != nil {
-		res.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(res, "Parameter 'filename' was not URL encoded properly")
-		return
+		log.Printf("Tried to use invalid signed token: %v", err)
+		res.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(res, "Token '%v' is not a valid token", requestToken)
+		return nil
 	}
 
-	if requestToken == "" || requestFileName == "" {
-		res.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(res, "Error in decoding url parameters")
-		return
+	return &Token{
+		Token:          []byte(requestToken),
+		User:           User{Username: claims.Username},
+		ExpirationDate: time.Unix(claims.Expires, 0).UTC().Format("20060102150405"),
+		DeviceID:       claims.Device,
+		Claims:         claims,
 	}
+}
 
-	// Check and validate token
+func validateLegacyToken(res http.ResponseWriter, requestToken string) *Token {
 	token, err := checkToken(requestToken)
 	if err != nil {
 		res.WriteHeader(http.StatusInternalServerError)
 		log.Printf("Error retrieving token from datastore: %v", err)
-		return
+		return nil
 	}
 
 	if token == nil {
-		log.Printf("Tried to use invalid token: %s", requestToken)
+		log.Printf("Tried to use an invalid token")
 		res.WriteHeader(http.StatusNotFound)
 		fmt.Fprintf(res, "Token '%v' is not a valid token", requestToken)
-		return
+		return nil
 	}
 
 	// Check if token is expired
@@ -199,485 +359,1978 @@ func getObjectHandler(res http.ResponseWriter, req *http.Request) {
 
 		// If token is expired, remove it from database
 		err = MainDB.Update(func(tx *bolt.Tx) error {
-			b := tx.Bucket([]byte("tokens"))
-			return b.Delete(token.Token)
+			return deleteToken(tx, token)
 		})
-
-		// Sorry for putting an error handler in an error handler
 		if err != nil {
 			log.Printf("Failed to remove expired token from the datastore: %v", err)
-			res.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprintf(res, "")
-			return
 		}
-		return
-	}
-
-	// Get user from database
-	var existingUser []byte
-	requestedKey := []byte(token.User.Username)
-	MainDB.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("users"))
-		existingUser = b.Get(requestedKey)
 		return nil
-	})
-	ownerObject := User{}
-	err = json.Unmarshal(existingUser, &ownerObject)
+	}
 
-	// Get object from database (using owner's own index)
-	var finalObject *Object
-	err = MainDB.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("objects"))
-		for _, v := range ownerObject.ObjectIDs {
-			object := Object{}
-			objectData := b.Get(itob(v))
-			err := json.Unmarshal(objectData, &object)
-			if err != nil {
-				return err
-			}
+	return token
+}
 
-			if object.Name == requestFileName {
-				finalObject = &object
-			}
-		}
-		return nil
-	})
+// getUser reads a user record out of the users bucket. It returns nil if no
+// such user exists.
+func getUser(tx *bolt.Tx, username string) (*User, error) {
+	userData := tx.Bucket([]byte("users")).Get([]byte(username))
+	if userData == nil {
+		return nil, nil
+	}
 
+	user := User{}
+	err := json.Unmarshal(userData, &user)
 	if err != nil {
-		res.WriteHeader(http.StatusInternalServerError)
-		log.Printf("Error retrieving object from database where owner is known. %v", err)
-		return
+		return nil, err
 	}
+	return &user, nil
+}
 
-	if finalObject == nil {
-		res.WriteHeader(http.StatusNotFound)
-		fmt.Fprintf(res, "Failed to find object with filename %v belonging to user %v", requestFileName, ownerObject.Username)
-		return
+// putUser persists a user record to the users bucket.
+func putUser(tx *bolt.Tx, user *User) error {
+	buf, err := json.Marshal(user)
+	if err != nil {
+		return err
 	}
+	return tx.Bucket([]byte("users")).Put([]byte(user.Username), buf)
+}
 
-	// Read object back to user
-	filepath := path.Join(DataPath, finalObject.LocalFileName)
-	// Check that file has been initialized
-	if _, err := os.Stat(filepath); os.IsNotExist(err) {
-		res.WriteHeader(http.StatusPreconditionFailed)
-		fmt.Fprintf(res, "Object was never uploaded, only created")
-		return
+// getObject reads an object record out of the objects bucket. It returns nil
+// if no such object exists.
+func getObject(tx *bolt.Tx, id int) (*Object, error) {
+	objectData := tx.Bucket([]byte("objects")).Get(itob(id))
+	if objectData == nil {
+		return nil, nil
 	}
 
-	http.ServeFile(res, req, filepath)
-	log.Printf("Object %v has been GOTten", finalObject.ID)
-}
-
-func createObjectHandler(res http.ResponseWriter, req *http.Request) {
-	requestJSON := CreateObjectRequestJSON{}
-	err := json.NewDecoder(req.Body).Decode(&requestJSON)
+	object := Object{}
+	err := json.Unmarshal(objectData, &object)
 	if err != nil {
-		res.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(res, "Error in decoding message")
-		return
+		return nil, err
 	}
+	return &object, nil
+}
 
-	// Check and validate token
-	token, err := checkToken(requestJSON.Token)
+// putObject persists an object record to the objects bucket.
+func putObject(tx *bolt.Tx, object *Object) error {
+	buf, err := json.Marshal(object)
 	if err != nil {
-		res.WriteHeader(http.StatusInternalServerError)
-		log.Printf("Error retrieving token from datastore: %v", err)
-		return
+		return err
 	}
+	return tx.Bucket([]byte("objects")).Put(itob(object.ID), buf)
+}
 
-	if token == nil {
-		log.Printf("Tried to use invalid token: '%v'", requestJSON.Token)
-		res.WriteHeader(http.StatusNotFound)
-		fmt.Fprintf(res, "Token '%v' is not a valid token", requestJSON.Token)
-		return
+// requiredQueryParam returns the URL-decoded value of a query parameter. If
+// the parameter is missing or malformed, an error is written to res and ok is
+// false.
+func requiredQueryParam(res http.ResponseWriter, req *http.Request, name string) (value string, ok bool) {
+	queryParams := req.URL.Query()
+	if len(queryParams[name]) == 0 {
+		res.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(res, "Error in decoding url parameters")
+		return "", false
 	}
 
-	// Check if token is expired
-	if !checkTokenExpired(*token) {
-		log.Printf("Expired token presented for user %v.\n\tToken Expired at: %s\n\tCurrent Time: %s", token.User.Username, token.ExpirationDate, time.Now().UTC())
-		res.WriteHeader(http.StatusPreconditionFailed)
-		fmt.Fprintf(res, "Token is expired.")
-
-		// If token is expired, remove it from database
-		err = MainDB.Update(func(tx *bolt.Tx) error {
-			b := tx.Bucket([]byte("tokens"))
-			return b.Delete(token.Token)
-		})
-
-		// Sorry for putting an error handler in an error handler
-		if err != nil {
-			log.Printf("Failed to remove expired token from the datastore: %v", err)
-			res.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprintf(res, "")
-			return
-		}
-		return
+	value, err := url.QueryUnescape(queryParams[name][0])
+	if err != nil || value == "" {
+		res.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(res, "Parameter '%v' was not URL encoded properly", name)
+		return "", false
 	}
+	return value, true
+}
 
-	// Create new object in database
-	// Create Random filename
-	seed := insecureRand.NewSource(time.Now().UnixNano())
-	bag := insecureRand.New(seed)
-
+// randomFileName generates the key under which an object's data is stored in
+// Blobs. Keys are drawn from crypto/rand, so they can't be predicted.
+func randomFileName() (string, error) {
 	b := make([]byte, 36)
+	lengthOfCHARS := big.NewInt(int64(len(CHARS)))
 	for i := range b {
-		b[i] = CHARS[bag.Intn(len(CHARS))]
+		n, err := rand.Int(rand.Reader, lengthOfCHARS)
+		if err != nil {
+			return "", err
+		}
+		b[i] = CHARS[int(n.Int64())]
 	}
-	randomFileName := string(b)
+	return string(b), nil
+}
 
-	newObject := Object{
-		Name:          requestJSON.FileName,
-		Owner:         token.User.Username,
-		LocalFileName: randomFileName,
+// objectVersion returns the version number of an object. Objects created
+// before versioning existed count as the first version.
+func objectVersion(object *Object) int {
+	if object.Version == 0 {
+		return 1
 	}
+	return object.Version
+}
 
-	err = MainDB.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("objects"))
-
-		// Generate ID for the object.
-		// This returns an error only if the Tx is closed or not writeable.
-		// That can't happen in an Update() call so I ignore the error check.
-		id, _ := b.NextSequence()
-		newObject.ID = int(id)
+// objectUploaded reports whether an object's data has been uploaded, as
+// opposed to the object only having been created. Objects uploaded before
+// upload dates were recorded are given one when the database is opened.
+func objectUploaded(object *Object) bool {
+	return object.UploadDate != ""
+}
 
-		// Marshal Object into bytes.
-		buf, err := json.Marshal(newObject)
+// findObjectVersions returns every version of the named object in the owner's
+// index, oldest first.
+func findObjectVersions(tx *bolt.Tx, owner *User, name string) ([]*Object, error) {
+	versions := []*Object{}
+	for _, id := range owner.ObjectIDs {
+		object, err := getObject(tx, id)
 		if err != nil {
-			return err
+			return nil, err
 		}
+		if object != nil && object.Name == name {
+			versions = append(versions, object)
+		}
+	}
 
-		// Persist bytes to users bucket.
-		return b.Put(itob(newObject.ID), buf)
+	sort.SliceStable(versions, func(i, j int) bool {
+		return objectVersion(versions[i]) < objectVersion(versions[j])
 	})
+	return versions, nil
+}
+
+// latestVersion picks the version of an object that is served by default: the
+// newest one that has been uploaded, or the newest one if none have been.
+func latestVersion(versions []*Object) *Object {
+	for i := len(versions) - 1; i >= 0; i-- {
+		if objectUploaded(versions[i]) {
+			return versions[i]
+		}
+	}
+	if len(versions) == 0 {
+		return nil
+	}
+	return versions[len(versions)-1]
+}
 
+// versionRetention returns how many versions of each object a user keeps.
+func versionRetention(user *User) int {
+	if user.VersionRetention > 0 {
+		return user.VersionRetention
+	}
+	return DefaultVersionRetention
+}
+
+// pruneVersions removes the oldest versions of the named object beyond the
+// owner's retention count. The caller is responsible for persisting owner and
+// for removing the data of the returned objects once the transaction commits.
+func pruneVersions(tx *bolt.Tx, owner *User, name string) ([]Object, error) {
+	versions, err := findObjectVersions(tx, owner, name)
 	if err != nil {
-		res.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(res, "Error adding object to database.")
-		log.Printf("Error adding object to database.\nObject: %v", newObject)
-		return
+		return nil, err
 	}
 
-	// Update owner of new object
-	err = MainDB.Update(func(tx *bolt.Tx) error {
-		// Get owner out of users bucket
-		b := tx.Bucket([]byte("users"))
-		ownerData := b.Get([]byte(newObject.Owner))
-		ownerObject := User{}
-		err := json.Unmarshal(ownerData, &ownerObject)
+	var pruned []Object
+	for len(versions) > versionRetention(owner) {
+		err = removeObject(tx, owner, versions[0])
 		if err != nil {
-			return err
+			return nil, err
 		}
+		pruned = append(pruned, *versions[0])
+		versions = versions[1:]
+	}
+	return pruned, nil
+}
 
-		// Add new objectID
-		ownerObject.ObjectIDs = append(ownerObject.ObjectIDs, newObject.ID)
+func getObjectHandler(res http.ResponseWriter, req *http.Request) {
+	// Decode Parameters from URL
+	queryParams := req.URL.Query()
 
-		// Update data in bucket
-		buf, err := json.Marshal(ownerObject)
-		if err != nil {
-			return err
-		}
+	// Check to ensure that correct parameters exist
+	if len(queryParams["token"]) == 0 || len(queryParams["filename"]) == 0 {
+		res.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(res, "Error in decoding url parameters")
+		return
+	}
 
-		// Persist bytes to users bucket.
-		return b.Put([]byte(ownerObject.Username), buf)
-	})
+	requestToken, err := url.QueryUnescape(queryParams["token"][0])
+	if err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(res, "Parameter 'token' was not URL encoded properly")
+		return
+	}
 
+	requestFileName, err := url.QueryUnescape(queryParams["filename"][0])
 	if err != nil {
-		res.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(res, "Error adding object to database.")
-		log.Printf("Error updating owner in database.\nOwner: %v\nObject: %v\nError: %v", newObject.Owner, newObject.ID, err)
+		res.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(res, "Parameter 'filename' was not URL encoded properly")
 		return
 	}
 
-	// Send back upload code to user
-	uploadSession := UploadSession{Object: newObject}
-	err = MainDB.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("uploads"))
+	if requestToken == "" || requestFileName == "" {
+		res.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(res, "Error in decoding url parameters")
+		return
+	}
 
-		// Generate ID for the object.
-		// This returns an error only if the Tx is closed or not writeable.
-		// That can't happen in an Update() call so I ignore the error check.
-		id, _ := b.NextSequence()
-		uploadSession.ID = int(id)
+	// A specific version may be requested, otherwise the latest is served
+	requestVersion := 0
+	if queryParams.Get("version") != "" {
+		requestVersion, err = strconv.Atoi(queryParams.Get("version"))
+		if err != nil || requestVersion < 1 {
+			res.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(res, "Parameter 'version' must be a positive integer")
+			return
+		}
+	}
 
-		// Marshal Object into bytes.
-		buf, err := json.Marshal(uploadSession)
+	// Check and validate token
+	token := validateToken(res, requestToken, ScopeRead)
+	if token == nil {
+		return
+	}
+	ownerName := requestedOwner(queryParams.Get("owner"), token)
+
+	// Get object from database (using owner's own index)
+	var finalObject *Object
+	err = MainDB.View(func(tx *bolt.Tx) error {
+		_, versions, err := findAccessibleVersions(tx, token.User.Username, ownerName, requestFileName, PermissionRead)
 		if err != nil {
 			return err
 		}
 
-		// Persist bytes to users bucket.
-		return b.Put(itob(uploadSession.ID), buf)
+		if requestVersion == 0 {
+			finalObject = latestVersion(versions)
+			return nil
+		}
+		for _, object := range versions {
+			if objectVersion(object) == requestVersion {
+				finalObject = object
+			}
+		}
+		return nil
 	})
 
+	if writeAccessError(res, err, ownerName, requestFileName) {
+		return
+	}
 	if err != nil {
 		res.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(res, "Error adding object to database.")
-		log.Printf("Error creating new uploadsession. Error: %v", err)
+		log.Printf("Error retrieving object from database where owner is known. %v", err)
 		return
 	}
 
-	fmt.Fprintf(res, "%v", uploadSession.ID)
-	log.Printf("Object %v has been created with UploadID %v", uploadSession.Object.ID, uploadSession.ID)
-}
-
-func uploadObjectHandler(res http.ResponseWriter, req *http.Request) {
-	// Parse data from request
+	if finalObject == nil {
+		res.WriteHeader(http.StatusNotFound)
+		if requestVersion != 0 {
+			fmt.Fprintf(res, "Failed to find version %v of object with filename %v belonging to user %v", requestVersion, requestFileName, ownerName)
+			return
+		}
+		fmt.Fprintf(res, "Failed to find object with filename %v belonging to user %v", requestFileName, ownerName)
+		return
+	}
+
+	// Read object back to user
+	blob, err := openObjectData(finalObject)
+	// Check that data has been uploaded
+	if err == ErrBlobNotFound {
+		res.WriteHeader(http.StatusPreconditionFailed)
+		fmt.Fprintf(res, "Object was never uploaded, only created")
+		return
+	}
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error opening data of object %v: %v", finalObject.ID, err)
+		return
+	}
+	defer blob.Close()
+
+	// Let clients check what they received
+	if finalObject.SHA256 != "" {
+		digest, _ := hex.DecodeString(finalObject.SHA256)
+		res.Header().Set("ETag", `"`+finalObject.SHA256+`"`)
+		res.Header().Set("Digest", "SHA-256="+base64.StdEncoding.EncodeToString(digest))
+	}
+
+	serveBlob(res, req, finalObject, blob)
+	log.Printf("Object %v has been GOTten", finalObject.ID)
+}
+
+// serveBlob writes an object's data to res. Stores whose blobs can seek get
+// range and conditional requests handled for them; others are streamed whole.
+func serveBlob(res http.ResponseWriter, req *http.Request, object *Object, blob io.Reader) {
+	modTime, _ := time.Parse("20060102150405", object.UploadDate)
+	if seeker, ok := blob.(io.ReadSeeker); ok {
+		http.ServeContent(res, req, object.Name, modTime, seeker)
+		return
+	}
+
+	if object.UploadDate != "" {
+		res.Header().Set("Content-Length", strconv.FormatInt(object.Size, 10))
+	}
+	if !modTime.IsZero() {
+		res.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
+	_, err := io.Copy(res, blob)
+	if err != nil {
+		log.Printf("Error sending data of object %v: %v", object.ID, err)
+	}
+}
+
+func deleteObjectHandler(res http.ResponseWriter, req *http.Request) {
+	requestToken, ok := requiredQueryParam(res, req, "token")
+	if !ok {
+		return
+	}
+	requestFileName, ok := requiredQueryParam(res, req, "filename")
+	if !ok {
+		return
+	}
+
+	// Check and validate token
+	token := validateToken(res, requestToken, ScopeWrite)
+	if token == nil {
+		return
+	}
+	ownerName := requestedOwner(req.URL.Query().Get("owner"), token)
+
+	// Remove all metadata in a single transaction before touching the disk. If
+	// we crash before the data files are unlinked we only leak a file nobody
+	// references, rather than leaving records that point at missing data.
+	var deletedObjects []Object
+	err := MainDB.Update(func(tx *bolt.Tx) error {
+		owner, versions, err := findAccessibleVersions(tx, token.User.Username, ownerName, requestFileName, PermissionWrite)
+		if err != nil || len(versions) == 0 {
+			return err
+		}
+
+		// Every version of the object goes, along with its grants
+		latest := versions[len(versions)-1]
+		err = forgetGrants(tx, owner.Username, latest.Name, latest.Grants)
+		if err != nil {
+			return err
+		}
+		for _, object := range versions {
+			err = removeObject(tx, owner, object)
+			if err != nil {
+				return err
+			}
+			deletedObjects = append(deletedObjects, *object)
+		}
+		return putOwner(tx, owner)
+	})
+	if writeAccessError(res, err, ownerName, requestFileName) {
+		return
+	}
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error deleting object %v of user %v from database: %v", requestFileName, ownerName, err)
+		return
+	}
+
+	if len(deletedObjects) == 0 {
+		res.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(res, "Failed to find object with filename %v belonging to user %v", requestFileName, ownerName)
+		return
+	}
+
+	for _, object := range deletedObjects {
+		removeObjectData(&object)
+		log.Printf("Object %v has been deleted", object.ID)
+	}
+}
+
+// removeObject deletes an object record, strips it from its owner's index and
+// cancels any upload sessions still pending for it. The caller is responsible
+// for persisting owner and, once the transaction has committed, for removing
+// the object's data with removeObjectData.
+func removeObject(tx *bolt.Tx, owner *User, object *Object) error {
+	err := tx.Bucket([]byte("objects")).Delete(itob(object.ID))
+	if err != nil {
+		return err
+	}
+
+	err = releaseBlob(tx, object)
+	if err != nil {
+		return err
+	}
+	refundObject(owner, object)
+
+	remainingIDs := make([]int, 0, len(owner.ObjectIDs))
+	for _, id := range owner.ObjectIDs {
+		if id != object.ID {
+			remainingIDs = append(remainingIDs, id)
+		}
+	}
+	owner.ObjectIDs = remainingIDs
+
+	// Cancel pending uploads. Keys can't be deleted while iterating a cursor,
+	// so collect them first.
+	uploads := tx.Bucket([]byte("uploads"))
+	var cancelledUploads [][]byte
+	err = uploads.ForEach(func(k, v []byte) error {
+		uploadSession := UploadSession{}
+		err := json.Unmarshal(v, &uploadSession)
+		if err != nil {
+			return err
+		}
+		if uploadSession.Object.ID == object.ID {
+			cancelledUploads = append(cancelledUploads, k)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range cancelledUploads {
+		err = uploads.Delete(k)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeObjectData deletes the data of an object whose record has already been
+// removed. Shared data is left for collectBlobs, since other objects may still
+// reference it. Failures are only logged, since the metadata is already gone.
+func removeObjectData(object *Object) {
+	if object.Blob == "" {
+		err := Blobs.Delete(object.LocalFileName)
+		if err != nil {
+			log.Printf("Failed to remove data of deleted object %v: %v", object.ID, err)
+		}
+	}
+	err := os.Remove(partFilePath(object))
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to remove part file of deleted object %v: %v", object.ID, err)
+	}
+}
+
+func listObjectsHandler(res http.ResponseWriter, req *http.Request) {
+	// Decode Parameters from URL
+	queryParams := req.URL.Query()
+
+	// Check to ensure that correct parameters exist
+	if len(queryParams["token"]) == 0 {
+		res.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(res, "Error in decoding url parameters")
+		return
+	}
+
+	requestToken, err := url.QueryUnescape(queryParams["token"][0])
+	if err != nil || requestToken == "" {
+		res.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(res, "Parameter 'token' was not URL encoded properly")
+		return
+	}
+
+	// Pagination is optional, and is expressed as an offset into the owner's
+	// object index plus a page size
+	offset := 0
+	if queryParams.Get("offset") != "" {
+		offset, err = strconv.Atoi(queryParams.Get("offset"))
+		if err != nil || offset < 0 {
+			res.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(res, "Parameter 'offset' must be a non-negative integer")
+			return
+		}
+	}
+
+	limit := DEFAULT_LIST_LIMIT
+	if queryParams.Get("limit") != "" {
+		limit, err = strconv.Atoi(queryParams.Get("limit"))
+		if err != nil || limit < 1 || limit > MAX_LIST_LIMIT {
+			res.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(res, "Parameter 'limit' must be between 1 and %v", MAX_LIST_LIMIT)
+			return
+		}
+	}
+
+	// Listing can be narrowed to names starting with a prefix, and names
+	// continuing past a delimiter rolled up into a single prefix, as in S3
+	prefix := queryParams.Get("prefix")
+	delimiter := queryParams.Get("delimiter")
+
+	// Check and validate token
+	token := validateToken(res, requestToken, ScopeRead)
+	if token == nil {
+		return
+	}
+
+	ownerName := requestedOwner(queryParams.Get("owner"), token)
+
+	// Walk the requested page of the owner's object index
+	responseJSON := ListObjectsResponseJSON{Objects: []ObjectInfoJSON{}, Offset: offset}
+	err = MainDB.View(func(tx *bolt.Tx) error {
+		owner, err := findAccessibleOwner(tx, token.User.Username, ownerName, PermissionRead)
+		if err != nil {
+			return err
+		}
+
+		// Group the index by filename, keeping the order in which each filename
+		// first appeared
+		names := []string{}
+		versions := map[string][]*Object{}
+		for _, id := range owner.ObjectIDs {
+			object, err := getObject(tx, id)
+			if err != nil {
+				return err
+			}
+			if object == nil {
+				log.Printf("User %v has a dangling object ID %v in their index", owner.Username, id)
+				continue
+			}
+			if !strings.HasPrefix(object.Name, prefix) {
+				continue
+			}
+			if _, ok := versions[object.Name]; !ok {
+				names = append(names, object.Name)
+			}
+			versions[object.Name] = append(versions[object.Name], object)
+		}
+
+		// Names and empty folders below a delimiter are replaced by their
+		// common prefix, where it first appears
+		entries := []string{}
+		prefixes := map[string]bool{}
+		addEntry := func(name string, object bool) {
+			if delimiter != "" {
+				if i := strings.Index(name[len(prefix):], delimiter); i >= 0 {
+					common := name[:len(prefix)+i+len(delimiter)]
+					if !prefixes[common] {
+						prefixes[common] = true
+						entries = append(entries, common)
+					}
+					return
+				}
+			}
+			if object {
+				entries = append(entries, name)
+			}
+		}
+		for _, name := range names {
+			addEntry(name, true)
+		}
+		for _, folder := range owner.Folders {
+			if strings.HasPrefix(folder+"/", prefix) {
+				addEntry(folder+"/", false)
+			}
+		}
+
+		responseJSON.Total = len(entries)
+		for i := offset; i < len(entries) && i < offset+limit; i++ {
+			if prefixes[entries[i]] {
+				responseJSON.Prefixes = append(responseJSON.Prefixes, entries[i])
+				continue
+			}
+			objectVersions := versions[entries[i]]
+			sort.SliceStable(objectVersions, func(i, j int) bool {
+				return objectVersion(objectVersions[i]) < objectVersion(objectVersions[j])
+			})
+
+			info := objectInfo(latestVersion(objectVersions))
+			info.Versions = len(objectVersions)
+			responseJSON.Objects = append(responseJSON.Objects, info)
+		}
+
+		if offset+limit < len(entries) {
+			responseJSON.NextOffset = offset + limit
+		}
+		return nil
+	})
+	if err == ErrObjectNotShared {
+		res.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(res, "Failed to find objects belonging to %v", ownerName)
+		return
+	}
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error listing objects of %v for user %v: %v", ownerName, token.User.Username, err)
+		return
+	}
+
+	responseData, err := json.Marshal(responseJSON)
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error marshalling response for client: %v", err)
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.Write(responseData)
+}
+
+// objectInfo summarizes an object for clients. Objects uploaded before sizes
+// and upload dates were recorded are described from their data file instead.
+func objectInfo(object *Object) ObjectInfoJSON {
+	info := ObjectInfoJSON{
+		ID:           object.ID,
+		Name:         object.Name,
+		Version:      objectVersion(object),
+		Size:         object.Size,
+		SHA256:       object.SHA256,
+		State:        "created",
+		CreationDate: object.CreationDate,
+		UploadDate:   object.UploadDate,
+		Grants:       object.Grants,
+	}
+
+	if objectUploaded(object) {
+		info.State = "uploaded"
+	}
+
+	return info
+}
+
+func listObjectVersionsHandler(res http.ResponseWriter, req *http.Request) {
+	requestToken, ok := requiredQueryParam(res, req, "token")
+	if !ok {
+		return
+	}
+	requestFileName, ok := requiredQueryParam(res, req, "filename")
+	if !ok {
+		return
+	}
+
+	// Check and validate token
+	token := validateToken(res, requestToken, ScopeRead)
+	if token == nil {
+		return
+	}
+
+	ownerName := requestedOwner(req.URL.Query().Get("owner"), token)
+
+	responseJSON := []ObjectInfoJSON{}
+	err := MainDB.View(func(tx *bolt.Tx) error {
+		_, versions, err := findAccessibleVersions(tx, token.User.Username, ownerName, requestFileName, PermissionRead)
+		if err != nil {
+			return err
+		}
+		for _, object := range versions {
+			info := objectInfo(object)
+			if ownerName != token.User.Username {
+				info.Grants = nil
+			}
+			responseJSON = append(responseJSON, info)
+		}
+		return nil
+	})
+	if writeAccessError(res, err, ownerName, requestFileName) {
+		return
+	}
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error listing versions of object %v for user %v: %v", requestFileName, token.User.Username, err)
+		return
+	}
+
+	if len(responseJSON) == 0 {
+		res.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(res, "Failed to find object with filename %v belonging to user %v", requestFileName, ownerName)
+		return
+	}
+
+	responseData, err := json.Marshal(responseJSON)
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error marshalling response for client: %v", err)
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.Write(responseData)
+}
+
+func restoreObjectHandler(res http.ResponseWriter, req *http.Request) {
+	requestJSON := RestoreObjectRequestJSON{}
+	err := json.NewDecoder(req.Body).Decode(&requestJSON)
+	if err != nil || requestJSON.Version < 1 {
+		res.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(res, "Error in decoding message")
+		return
+	}
+
+	// Check and validate token
+	token := validateToken(res, requestJSON.Token, ScopeWrite)
+	if token == nil {
+		return
+	}
+
+	ownerName := requestedOwner(requestJSON.Owner, token)
+
+	// Find the version being restored
+	var oldObject *Object
+	err = MainDB.View(func(tx *bolt.Tx) error {
+		_, versions, err := findAccessibleVersions(tx, token.User.Username, ownerName, requestJSON.FileName, PermissionWrite)
+		if err != nil {
+			return err
+		}
+		for _, object := range versions {
+			if objectVersion(object) == requestJSON.Version {
+				oldObject = object
+			}
+		}
+		return nil
+	})
+	if writeAccessError(res, err, ownerName, requestJSON.FileName) {
+		return
+	}
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error retrieving object from database where owner is known. %v", err)
+		return
+	}
+
+	if oldObject == nil {
+		res.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(res, "Failed to find version %v of object with filename %v belonging to user %v", requestJSON.Version, requestJSON.FileName, ownerName)
+		return
+	}
+
+	if !objectUploaded(oldObject) {
+		res.WriteHeader(http.StatusPreconditionFailed)
+		fmt.Fprintf(res, "Object was never uploaded, only created")
+		return
+	}
+
+	// The restored data becomes a new version, so the history is kept intact
+	newObject := Object{
+		Name:          oldObject.Name,
+		Owner:         oldObject.Owner,
+		LocalFileName: oldObject.LocalFileName,
+		SHA256:        oldObject.SHA256,
+		Size:          oldObject.Size,
+		Blob:          oldObject.Blob,
+		DataKey:       oldObject.DataKey,
+		CreationDate:  time.Now().UTC().Format("20060102150405"),
+	}
+	newObject.UploadDate = newObject.CreationDate
+
+	// Shared data is simply referenced again, while data stored before it
+	// was shared is copied into a shared blob of its own
+	copiedKey := ""
+	if oldObject.Blob == "" {
+		copiedKey, err = randomFileName()
+		if err != nil {
+			res.WriteHeader(http.StatusInternalServerError)
+			log.Printf("Error generating key to restore object %v: %v", oldObject.ID, err)
+			return
+		}
+		size, digest, dataKey, err := copyObjectData(oldObject, copiedKey)
+		if err != nil {
+			res.WriteHeader(http.StatusInternalServerError)
+			log.Printf("Error copying data of object %v to restore it: %v", oldObject.ID, err)
+			return
+		}
+		newObject.LocalFileName = copiedKey
+		newObject.Size = size
+		newObject.SHA256 = hex.EncodeToString(digest)
+		newObject.DataKey = dataKey
+	}
+
+	var prunedObjects []Object
+	duplicateKey := ""
+	err = MainDB.Update(func(tx *bolt.Tx) error {
+		if copiedKey == "" {
+			err := referenceBlob(tx, newObject.Blob)
+			if err != nil {
+				return err
+			}
+		}
+
+		owner, err := getOwner(tx, newObject.Owner)
+		if err != nil {
+			return err
+		}
+		if owner == nil {
+			return fmt.Errorf("Owner %v does not exist", newObject.Owner)
+		}
+
+		versions, err := findObjectVersions(tx, owner, newObject.Name)
+		if err != nil {
+			return err
+		}
+		newObject.Version = 1
+		if len(versions) > 0 {
+			newObject.Version = objectVersion(versions[len(versions)-1]) + 1
+			newObject.Grants = versions[len(versions)-1].Grants
+		}
+
+		id, _ := tx.Bucket([]byte("objects")).NextSequence()
+		newObject.ID = int(id)
+		err = putObject(tx, &newObject)
+		if err != nil {
+			return err
+		}
+
+		owner.ObjectIDs = append(owner.ObjectIDs, newObject.ID)
+		prunedObjects, err = pruneVersions(tx, owner, newObject.Name)
+		if err != nil {
+			return err
+		}
+
+		// Versions pruned to make room count towards it
+		err = chargeObject(owner)
+		if err == nil {
+			err = chargeBytes(owner, newObject.Size)
+		}
+		if err != nil {
+			return err
+		}
+
+		// Copied data is only moved into its blob once nothing else can fail
+		if copiedKey != "" {
+			duplicateKey, err = shareObjectData(tx, &newObject, copiedKey)
+			if err != nil {
+				return err
+			}
+			err = putObject(tx, &newObject)
+			if err != nil {
+				return err
+			}
+		}
+		return putOwner(tx, owner)
+	})
+	if err != nil {
+		if copiedKey != "" {
+			Blobs.Delete(copiedKey)
+		}
+		if err == ErrQuotaExceeded {
+			writeQuotaExceeded(res)
+			return
+		}
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error adding restored object to database.\nObject: %v\nError: %v", newObject, err)
+		return
+	}
+
+	if duplicateKey != "" {
+		removeDuplicateData(duplicateKey)
+	}
+
+	for _, object := range prunedObjects {
+		removeObjectData(&object)
+		log.Printf("Object %v has been pruned", object.ID)
+	}
+
+	fmt.Fprintf(res, "%v", newObject.Version)
+	log.Printf("Object %v has been restored as object %v", oldObject.ID, newObject.ID)
+}
+
+// storeObjectData streams data into the blob store under key, encrypting it
+// if a master key is loaded. It returns the wrapped data key, if any.
+func storeObjectData(key string, data io.Reader) (*WrappedKey, error) {
+	sealed, dataKey, err := encryptObjectData(data)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = Blobs.Put(key, sealed)
+	if err != nil {
+		return nil, err
+	}
+	return dataKey, nil
+}
+
+// copyObjectData stores a copy of an object's data under dst, returning the
+// number of bytes copied, their SHA-256 digest and the copy's wrapped data
+// key, if any.
+func copyObjectData(object *Object, dst string) (int64, []byte, *WrappedKey, error) {
+	blob, err := openObjectData(object)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	defer blob.Close()
+
+	data := newDigestReader(blob, nil)
+	dataKey, err := storeObjectData(dst, data)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	return data.Size(), data.Sum(), dataKey, nil
+}
+
+func createObjectHandler(res http.ResponseWriter, req *http.Request) {
+	requestJSON := CreateObjectRequestJSON{}
+	err := json.NewDecoder(req.Body).Decode(&requestJSON)
+	if err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(res, "Error in decoding message")
+		return
+	}
+
+	if requestJSON.SHA256 != "" && !validSHA256(requestJSON.SHA256) {
+		res.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(res, "Parameter 'sha256' must be a hex-encoded SHA-256 digest")
+		return
+	}
+
+	requestJSON.FileName, err = normalizeObjectPath(requestJSON.FileName)
+	if err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(res, "%v", err)
+		return
+	}
+
+	// Check and validate token
+	token := validateToken(res, requestJSON.Token, ScopeWrite)
+	if token == nil {
+		return
+	}
+
+	// Create new object in database. Objects shared with the user can only
+	// get new versions, which belong to the object's owner.
+	localFileName, err := randomFileName()
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error generating key for new object: %v", err)
+		return
+	}
+	newObject := Object{
+		Name:          requestJSON.FileName,
+		Owner:         requestedOwner(requestJSON.Owner, token),
+		LocalFileName: localFileName,
+		CreationDate:  time.Now().UTC().Format("20060102150405"),
+	}
+
+	// The object and the owner's index are updated together, so that concurrent
+	// creations of the same filename can't be given the same version
+	err = MainDB.Update(func(tx *bolt.Tx) error {
+		// Uploading an existing filename makes a new version of it
+		owner, versions, err := findAccessibleVersions(tx, token.User.Username, newObject.Owner, newObject.Name, PermissionWrite)
+		if err != nil {
+			return err
+		}
+		newObject.Version = 1
+		if len(versions) > 0 {
+			newObject.Version = objectVersion(versions[len(versions)-1]) + 1
+			newObject.Grants = versions[len(versions)-1].Grants
+		} else {
+			// A new object can't take the place of a folder, or go inside
+			// another object
+			tree, err := readNamespace(tx, owner)
+			if err != nil {
+				return err
+			}
+			if tree.taken(newObject.Name) {
+				return ErrPathConflict
+			}
+		}
+
+		// Generate ID for the object.
+		// This returns an error only if the Tx is closed or not writeable.
+		// That can't happen in an Update() call so I ignore the error check.
+		id, _ := tx.Bucket([]byte("objects")).NextSequence()
+		newObject.ID = int(id)
+
+		err = putObject(tx, &newObject)
+		if err != nil {
+			return err
+		}
+
+		err = chargeObject(owner)
+		if err != nil {
+			return err
+		}
+
+		// Add new objectID
+		owner.ObjectIDs = append(owner.ObjectIDs, newObject.ID)
+		return putOwner(tx, owner)
+	})
+
+	if err == ErrQuotaExceeded {
+		writeQuotaExceeded(res)
+		return
+	}
+	if err == ErrPathConflict {
+		res.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(res, "%v: %v", err, newObject.Name)
+		return
+	}
+	if writeAccessError(res, err, newObject.Owner, newObject.Name) {
+		return
+	}
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(res, "Error adding object to database.")
+		log.Printf("Error adding object to database.\nObject: %v\nError: %v", newObject, err)
+		return
+	}
+
+	// Send back upload code to user. It can't be guessed, and only the token
+	// that created the object may upload to it.
+	uploadID, err := randomID()
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(res, "Error adding object to database.")
+		log.Printf("Error generating UploadID: %v", err)
+		return
+	}
+
+	uploadSession := UploadSession{
+		ID:             uploadID,
+		Object:         newObject,
+		Token:          token.Token,
+		ExpectedSHA256: strings.ToLower(requestJSON.SHA256),
+	}
+	err = MainDB.Update(func(tx *bolt.Tx) error {
+		return putUploadSession(tx, &uploadSession)
+	})
+
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(res, "Error adding object to database.")
+		log.Printf("Error creating new uploadsession. Error: %v", err)
+		return
+	}
+
+	fmt.Fprintf(res, "%v", uploadSession.ID)
+	log.Printf("Object %v has been created with UploadID %v", uploadSession.Object.ID, uploadSession.ID)
+}
+
+func uploadObjectHandler(res http.ResponseWriter, req *http.Request) {
+	uploadSession := getUploadSession(res, req)
+	if uploadSession == nil {
+		return
+	}
+
+	// Resumable uploads send the object in parts
+	if req.Header.Get("Content-Range") != "" {
+		uploadObjectPart(res, req, uploadSession)
+		return
+	}
+
+	expectedDigest, err := expectedUploadDigest(req, uploadSession)
+	if err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(res, "%v", err)
+		return
+	}
+
+	if req.ContentLength > MaxUploadSize {
+		res.WriteHeader(http.StatusRequestEntityTooLarge)
+		fmt.Fprintf(res, "Uploads may be at most %v bytes", MaxUploadSize)
+		return
+	}
+
+	// Don't bother storing data that won't fit in the owner's quota
+	remaining, limited, err := remainingBytes(uploadSession.Object.Owner)
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error reading quota of user %v: %v", uploadSession.Object.Owner, err)
+		return
+	}
+	if limited && req.ContentLength > remaining {
+		writeQuotaExceeded(res)
+		return
+	}
+
+	// Stream data into the blob store, under a key no other upload can write
+	data := newDigestReader(http.MaxBytesReader(res, req.Body, MaxUploadSize), expectedDigest)
+	key, err := randomFileName()
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error generating key for upload %v: %v", uploadSession.ID, err)
+		return
+	}
+	dataKey, err := storeObjectData(key, data)
+	var maxBytesError *http.MaxBytesError
+	if errors.As(err, &maxBytesError) {
+		res.WriteHeader(http.StatusRequestEntityTooLarge)
+		fmt.Fprintf(res, "Uploads may be at most %v bytes", MaxUploadSize)
+		return
+	}
+	if errors.Is(err, ErrDigestMismatch) {
+		res.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(res, "%v", ErrDigestMismatch)
+		log.Printf("Upload %v for object %v did not match its digest", uploadSession.ID, uploadSession.Object.ID)
+		return
+	}
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Storing uploaded object %v. Error: %v", uploadSession.Object.ID, err)
+		return
+	}
+
+	err = finishUpload(uploadSession, key, data.Size(), data.Sum(), dataKey)
+	if err == ErrQuotaExceeded {
+		writeQuotaExceeded(res)
+		return
+	}
+	if err == ErrUploadSessionGone {
+		res.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(res, "UploadID %v is not valid", uploadSession.ID)
+		return
+	}
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error finalizing upload %v for object %v: %v", uploadSession.ID, uploadSession.Object.ID, err)
+		return
+	}
+	log.Printf("Object %v has been uploaded with UploadID %v", uploadSession.Object.ID, uploadSession.ID)
+}
+
+// validSHA256 reports whether digest is a hex-encoded SHA-256 digest.
+func validSHA256(digest string) bool {
+	decoded, err := hex.DecodeString(digest)
+	return err == nil && len(decoded) == sha256.Size
+}
+
+// expectedUploadDigest returns the SHA-256 digest the uploaded data must have,
+// or nil if the client didn't give one. It may be given when the object is
+// created, or in a "Digest: SHA-256=<base64 digest>" header on the upload.
+func expectedUploadDigest(req *http.Request, uploadSession *UploadSession) ([]byte, error) {
+	var expectedDigest []byte
+	if uploadSession.ExpectedSHA256 != "" {
+		expectedDigest, _ = hex.DecodeString(uploadSession.ExpectedSHA256)
+	}
+
+	for _, value := range strings.Split(req.Header.Get("Digest"), ",") {
+		parts := strings.SplitN(strings.TrimSpace(value), "=", 2)
+		if len(parts) != 2 || !strings.EqualFold(parts[0], "SHA-256") {
+			continue
+		}
+
+		headerDigest, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil || len(headerDigest) != sha256.Size {
+			return nil, fmt.Errorf("Digest header does not contain a base64-encoded SHA-256 digest")
+		}
+		if expectedDigest != nil && !bytes.Equal(expectedDigest, headerDigest) {
+			return nil, fmt.Errorf("Digest header does not match the digest given when the object was created")
+		}
+		expectedDigest = headerDigest
+	}
+	return expectedDigest, nil
+}
+
+// digestReader computes the SHA-256 digest of everything read through it. If
+// an expected digest is given and the data turns out not to match it, the
+// reader fails with ErrDigestMismatch instead of reaching io.EOF, so blob
+// stores never keep the data.
+type digestReader struct {
+	data     io.Reader
+	hasher   hash.Hash
+	size     int64
+	expected []byte
+}
+
+func newDigestReader(data io.Reader, expectedDigest []byte) *digestReader {
+	return &digestReader{data: data, hasher: sha256.New(), expected: expectedDigest}
+}
+
+func (r *digestReader) Read(p []byte) (int, error) {
+	n, err := r.data.Read(p)
+	r.hasher.Write(p[:n])
+	r.size += int64(n)
+	if err == io.EOF && r.expected != nil && !bytes.Equal(r.hasher.Sum(nil), r.expected) {
+		return n, ErrDigestMismatch
+	}
+	return n, err
+}
+
+// Sum returns the digest of the data read so far.
+func (r *digestReader) Sum() []byte {
+	return r.hasher.Sum(nil)
+}
+
+// Size returns the number of bytes read so far.
+func (r *digestReader) Size() int64 {
+	return r.size
+}
+
+// getUploadSession looks up the upload session named in the request path, and
+// checks that the request carries the token that created it. If the session
+// can't be used, an error is written to res and nil is returned.
+func getUploadSession(res http.ResponseWriter, req *http.Request) *UploadSession {
+	// Parse data from request
 	urlPath := req.URL.Path
 	pathParts := strings.Split(urlPath, "/")
-	uploadString := pathParts[2]
-	uploadID, err := strconv.Atoi(uploadString)
-	if err != nil || uploadID == 0 {
+	uploadID := pathParts[2]
+	if len(uploadID) != 32 {
 		res.WriteHeader(http.StatusBadRequest)
 		fmt.Fprintf(res, "Error in decoding uploadId")
-		return
+		return nil
+	}
+
+	requestToken, ok := requiredQueryParam(res, req, "token")
+	if !ok {
+		return nil
+	}
+
+	// Check and validate token
+	token := validateToken(res, requestToken, ScopeWrite)
+	if token == nil {
+		return nil
 	}
 
 	// Get upload object from store
 	uploadData := []byte{}
 	MainDB.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte("uploads"))
-		uploadData = b.Get(itob(uploadID))
+		uploadData = b.Get([]byte(uploadID))
 		return nil
 	})
 	if uploadData == nil {
 		res.WriteHeader(http.StatusNotFound)
 		fmt.Fprintf(res, "UploadID %v is not valid", uploadID)
+		return nil
+	}
+
+	uploadSession := UploadSession{}
+	err := json.Unmarshal(uploadData, &uploadSession)
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error unmarshalling UploadSession object from database. %v", err)
+		return nil
+	}
+
+	if !bytes.Equal(uploadSession.Token, token.Token) {
+		res.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(res, "UploadID %v was not created with this token", uploadID)
+		log.Printf("User %v tried to use upload %v of object %v belonging to %v", token.User.Username, uploadID, uploadSession.Object.ID, uploadSession.Object.Owner)
+		return nil
+	}
+
+	if uploadSessionExpired(&uploadSession, time.Now().UTC()) {
+		res.WriteHeader(http.StatusGone)
+		fmt.Fprintf(res, "UploadID %v has expired", uploadID)
+		return nil
+	}
+
+	// Uploading to another user's object needs write access throughout
+	if uploadSession.Object.Owner != token.User.Username {
+		err = MainDB.View(func(tx *bolt.Tx) error {
+			_, _, err := findAccessibleVersions(tx, token.User.Username, uploadSession.Object.Owner, uploadSession.Object.Name, PermissionWrite)
+			return err
+		})
+		if writeAccessError(res, err, uploadSession.Object.Owner, uploadSession.Object.Name) {
+			return nil
+		}
+		if err != nil {
+			res.WriteHeader(http.StatusInternalServerError)
+			log.Printf("Error checking access of user %v to upload %v: %v", token.User.Username, uploadID, err)
+			return nil
+		}
+	}
+	return &uploadSession
+}
+
+// uploadSessionExpired reports whether an upload session is older than
+// UploadSessionTTL. Sessions from before creation dates were recorded have no
+// way of telling their age, so they count as expired.
+func uploadSessionExpired(uploadSession *UploadSession, now time.Time) bool {
+	creationDate, err := time.Parse("20060102150405", uploadSession.Object.CreationDate)
+	return err != nil || now.Sub(creationDate) > UploadSessionTTL
+}
+
+// putUploadSession persists an upload session to the uploads bucket.
+func putUploadSession(tx *bolt.Tx, uploadSession *UploadSession) error {
+	buf, err := json.Marshal(uploadSession)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket([]byte("uploads")).Put([]byte(uploadSession.ID), buf)
+}
+
+// randomID generates an unguessable hex-encoded identifier.
+func randomID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// finishUpload is called once an object's data has been stored under key,
+// which must be fresh for this upload. It records the upload on the object,
+// moves the data into its shared blob, drops versions beyond the owner's
+// retention, charges the data to the owner's quota and removes the
+// UploadSession from store. If the session is gone, ErrUploadSessionGone is
+// returned. If the data doesn't fit in the quota, ErrQuotaExceeded is returned
+// and nothing changes, so the upload may be completed again once there is
+// room. Whenever the upload isn't finished, the data under key is deleted.
+func finishUpload(uploadSession *UploadSession, key string, size int64, digest []byte, dataKey *WrappedKey) error {
+	var prunedObjects []Object
+	duplicateKey := ""
+	err := MainDB.Update(func(tx *bolt.Tx) error {
+		// Overlapping uploads to one session each get this far, but only the
+		// first may finish
+		uploads := tx.Bucket([]byte("uploads"))
+		if uploads.Get([]byte(uploadSession.ID)) == nil {
+			return ErrUploadSessionGone
+		}
+		err := uploads.Delete([]byte(uploadSession.ID))
+		if err != nil {
+			return err
+		}
+
+		object, err := getObject(tx, uploadSession.Object.ID)
+		if err != nil {
+			return err
+		}
+		if object == nil {
+			// Deleted while its data was on the way, so nothing wants it
+			duplicateKey = key
+			return nil
+		}
+		object.Size = size
+		object.SHA256 = hex.EncodeToString(digest)
+		object.DataKey = dataKey
+		object.UploadDate = time.Now().UTC().Format("20060102150405")
+
+		owner, err := getOwner(tx, object.Owner)
+		if err != nil || owner == nil {
+			return err
+		}
+		prunedObjects, err = pruneVersions(tx, owner, object.Name)
+		if err != nil {
+			return err
+		}
+		err = chargeBytes(owner, size)
+		if err != nil {
+			return err
+		}
+
+		// Data is only moved into its blob once nothing else can fail
+		duplicateKey, err = shareObjectData(tx, object, key)
+		if err != nil {
+			return err
+		}
+		err = putObject(tx, object)
+		if err != nil {
+			return err
+		}
+		return putOwner(tx, owner)
+	})
+	if err != nil {
+		removeDuplicateData(key)
+		return err
+	}
+
+	if duplicateKey != "" {
+		removeDuplicateData(duplicateKey)
+	}
+
+	// The parts of a completed resumable upload are no longer needed, nor are
+	// those of one abandoned for a single request
+	err = os.Remove(partFilePath(&uploadSession.Object))
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to remove part file of object %v: %v", uploadSession.Object.ID, err)
+	}
+
+	for _, object := range prunedObjects {
+		removeObjectData(&object)
+		log.Printf("Object %v has been pruned", object.ID)
+	}
+	return nil
+}
+
+func createUserHandler(res http.ResponseWriter, req *http.Request) {
+	requestJSON := UserCreationJSON{}
+
+	err := json.NewDecoder(req.Body).Decode(&requestJSON)
+	if err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(res, "Error in decoding message")
+		return
+	}
+
+	var existingObject []byte
+	requestedKey := []byte(requestJSON.Username)
+	MainDB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("users"))
+		existingObject = b.Get(requestedKey)
+		return nil
+	})
+
+	if existingObject != nil {
+		res.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(res, "That username already exists")
 		return
 	}
 
-	uploadSession := UploadSession{}
-	err = json.Unmarshal(uploadData, &uploadSession)
+	// Group names are given as owners the same way usernames are
+	if isGroupOwner(requestJSON.Username) {
+		res.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(res, "Usernames may not start with '%v'", groupOwnerPrefix)
+		return
+	}
+
+	// Hash password
+	hashedData, err := hashPassword(requestJSON.Password)
 	if err != nil {
 		res.WriteHeader(http.StatusInternalServerError)
-		log.Printf("Error unmarshalling UploadSession object from database. %v", err)
+		fmt.Fprintf(res, "Server encountered an error hashing the password")
+		log.Printf("Encountered an error hashing the password of user '%s': %v", requestJSON.Username, err)
 		return
 	}
 
-	// Write data to file
-	buf := bytes.NewBuffer(make([]byte, 0, req.ContentLength))
-	_, err = buf.ReadFrom(req.Body)
+	userObject := User{
+		Username:     requestJSON.Username,
+		PasswordHash: hashedData,
+		ObjectIDs:    []int{},
+	}
+	err = newTokenEpoch(&userObject)
 	if err != nil {
 		res.WriteHeader(http.StatusInternalServerError)
-		log.Printf("Failed to read bytes from request")
+		log.Printf("Error generating token epoch for user %v: %v", requestJSON.Username, err)
 		return
 	}
 
-	body := buf.Bytes()
-	filepath := path.Join(DataPath, uploadSession.Object.LocalFileName)
+	err = MainDB.Update(func(tx *bolt.Tx) error {
+		// Retrieve the objects bucket.
+		// This should be created when the DB is first opened.
+		b := tx.Bucket([]byte("users"))
+
+		// Marshal Object into bytes.
+		buf, err := json.Marshal(userObject)
+		if err != nil {
+			return err
+		}
+
+		// Persist bytes to users bucket.
+		return b.Put([]byte(userObject.Username), buf)
+	})
 
-	err = ioutil.WriteFile(filepath, body, 0600)
 	if err != nil {
 		res.WriteHeader(http.StatusInternalServerError)
-		log.Printf("Writing uploaded object to disk. Filepath: %v. Error: %v", DataPath+"/"+uploadSession.Object.LocalFileName, err)
+		log.Printf("Database insert of user %v failed with error %v", requestJSON.Username, err)
+		return
+	}
+	setTokenEpoch(userObject.Username, userObject.TokenEpoch)
+	log.Printf("User %v has been created", requestJSON.Username)
+}
+
+func setVersionRetentionHandler(res http.ResponseWriter, req *http.Request) {
+	requestJSON := VersionRetentionRequestJSON{}
+	err := json.NewDecoder(req.Body).Decode(&requestJSON)
+	if err != nil || requestJSON.Versions < 0 {
+		res.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(res, "Error in decoding message")
+		return
+	}
+
+	// Check and validate token
+	token := validateToken(res, requestJSON.Token, ScopeAccount)
+	if token == nil {
 		return
 	}
 
-	// Remove UploadSession from store
+	// Existing surplus versions are pruned the next time each object changes
 	err = MainDB.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("uploads"))
-		return b.Delete(itob(uploadSession.ID))
+		user, err := getUser(tx, token.User.Username)
+		if err != nil {
+			return err
+		}
+		if user == nil {
+			return fmt.Errorf("Owner of token %v does not exist", token.User.Username)
+		}
+
+		user.VersionRetention = requestJSON.Versions
+		return putUser(tx, user)
 	})
-	log.Printf("Object %v has been uploaded with UploadID %v", uploadSession.Object.ID, uploadSession.ID)
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error updating version retention of user %v: %v", token.User.Username, err)
+		return
+	}
+	log.Printf("User %v now keeps %v versions of each object", token.User.Username, requestJSON.Versions)
 }
 
-func createUserHandler(res http.ResponseWriter, req *http.Request) {
-	requestJSON := UserCreationJSON{}
-
+func authUserHandler(res http.ResponseWriter, req *http.Request) {
+	requestJSON := AuthUserRequestJSON{}
 	err := json.NewDecoder(req.Body).Decode(&requestJSON)
 	if err != nil {
 		res.WriteHeader(http.StatusBadRequest)
 		fmt.Fprintf(res, "Error in decoding message")
 		return
 	}
+	// The request carries passwords, codes and signatures, so only who it is
+	// for is logged
+	log.Printf("Authentication request for user %v", requestJSON.Username)
 
-	var existingObject []byte
+	if requestJSON.Format != "" && requestJSON.Format != "legacy" && requestJSON.Format != "signed" {
+		res.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(res, "Unknown token format %v", requestJSON.Format)
+		return
+	}
+	if requestJSON.Refresh && requestJSON.Format == "legacy" {
+		res.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(res, "Refresh tokens are only issued with signed tokens")
+		return
+	}
+	if !validScopes(requestJSON.Scopes) {
+		res.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(res, "Scopes must be some of %v", AllScopes)
+		return
+	}
+
+	// Throttle clients before doing any work for them. Every attempt counts,
+	// successful or not, which also limits password guessing.
+	if ok, retryAfter := AuthIPLimiter.Allow(clientIP(req)); !ok {
+		writeTooManyRequests(res, retryAfter)
+		fmt.Fprintf(res, "Too many authentication requests from this address")
+		log.Printf("Rate limited authentication requests from %v", clientIP(req))
+		return
+	}
+	if ok, retryAfter := AuthUserLimiter.Allow(requestJSON.Username); !ok {
+		writeTooManyRequests(res, retryAfter)
+		fmt.Fprintf(res, "Too many authentication requests for user %v", requestJSON.Username)
+		log.Printf("Rate limited authentication requests for user %v", requestJSON.Username)
+		return
+	}
+
+	// Confirm that owner exists
+	var userData []byte
 	requestedKey := []byte(requestJSON.Username)
 	MainDB.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte("users"))
-		existingObject = b.Get(requestedKey)
+		userData = b.Get(requestedKey)
 		return nil
 	})
+	if userData == nil {
+		res.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(res, "User %v is not a registered user", requestJSON.Username)
+		return
+	}
+	// Unmarshal User Object
+	userObject := User{}
+	err = json.Unmarshal(userData, &userObject)
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error unmarshalling owner object from database. %v", err)
+		return
+	}
 
-	if existingObject != nil {
-		res.WriteHeader(http.StatusConflict)
-		fmt.Fprintf(res, "That username already exists")
+	// Check the password, and rehash it while we have it if it was hashed
+	// the old way
+	err = checkPassword(&userObject, requestJSON.Password)
+	if err != nil {
+		res.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(res, "Invalid password given for user %v", requestJSON.Username)
 		return
 	}
+	err = upgradePasswordHash(&userObject, requestJSON.Password)
+	if err != nil {
+		log.Printf("Error rehashing password of user %v: %v", requestJSON.Username, err)
+	}
 
-	// Hash password
-	plainData := []byte(requestJSON.Password + requestJSON.Username)
-	// Hashing the password with the default cost of 10
-	hashedData, err := bcrypt.GenerateFromPassword(plainData, bcrypt.DefaultCost)
+	// Check RequestDate (to prevent replay attack)
+	requestDate, err := time.Parse("20060102150405", requestJSON.ReqDate)
+	if err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(res, "Invalid time stamp.")
+		log.Printf("Invalid time stamp from user: '%v'. Parser gave error: %v", requestJSON.ReqDate, err)
+		return
+	}
+
+	timeSinceRequest := time.Now().UTC().Sub(requestDate)
+	if timeSinceRequest.Minutes() > 5.0 {
+		res.WriteHeader(http.StatusExpectationFailed)
+		fmt.Fprintf(res, "Request Time is greater than 5 minutes ago.")
+		log.Printf("Request time >5 minutes from current time. \n\tRequest Time: '%v' \n\tCurrent Time: '%v'", requestDate, time.Now().UTC())
+		return
+	}
+
+	// Device signatures cover the request date, so one over a date far ahead
+	// could be replayed until then
+	if timeSinceRequest.Minutes() < -5.0 {
+		res.WriteHeader(http.StatusExpectationFailed)
+		fmt.Fprintf(res, "Request Time is more than 5 minutes in the future.")
+		log.Printf("Request time >5 minutes in the future. \n\tRequest Time: '%v' \n\tCurrent Time: '%v'", requestDate, time.Now().UTC())
+		return
+	}
+
+	// The password alone isn't enough for users with two-factor
+	// authentication
+	if totpEnabled(&userObject) {
+		err = verifySecondFactor(userObject.Username, requestJSON.OTP)
+		if err == ErrSecondFactorRequired {
+			res.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintf(res, "%v", err)
+			return
+		}
+		if err == ErrSecondFactorInvalid {
+			res.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(res, "%v", err)
+			log.Printf("Invalid two-factor code given for user %v", userObject.Username)
+			return
+		}
+		if err != nil {
+			res.WriteHeader(http.StatusInternalServerError)
+			log.Printf("Error checking two-factor code of user %v: %v", userObject.Username, err)
+			return
+		}
+	}
+
+	// Tokens are only tied to a device that signed the request
+	if requestJSON.Device != "" {
+		device, err := verifyDevice(userObject.Username, requestJSON.ReqDate, requestJSON.Device, requestJSON.DeviceSignature)
+		if err == ErrDeviceSignatureInvalid {
+			res.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(res, "%v", err)
+			return
+		}
+		if err != nil {
+			res.WriteHeader(http.StatusInternalServerError)
+			log.Printf("Error checking device %v of user %v: %v", requestJSON.Device, userObject.Username, err)
+			return
+		}
+		if device == nil {
+			res.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(res, "Device %v is not registered to user %v", requestJSON.Device, userObject.Username)
+			return
+		}
+	}
+
+	// Don't let a single user hold an unbounded number of tokens. Each family
+	// of refresh tokens counts as a token, while signed tokens aren't stored,
+	// so the rate they are issued at is limited instead.
+	if requestJSON.Format == "signed" && !requestJSON.Refresh {
+		if ok, retryAfter := SignedTokenLimiter.Allow(userObject.Username); !ok {
+			writeTooManyRequests(res, retryAfter)
+			fmt.Fprintf(res, "User %v has been issued too many signed tokens", userObject.Username)
+			log.Printf("User %v has been issued too many signed tokens", userObject.Username)
+			return
+		}
+	} else {
+		var validTokens int
+		var nextExpiry time.Time
+		err = MainDB.View(func(tx *bolt.Tx) error {
+			validTokens, nextExpiry, err = countHeldTokens(tx, &userObject)
+			return err
+		})
+		if err != nil {
+			res.WriteHeader(http.StatusInternalServerError)
+			log.Printf("Error counting tokens of user %v: %v", userObject.Username, err)
+			return
+		}
+		if validTokens >= MaxTokensPerUser {
+			writeTooManyRequests(res, nextExpiry.Sub(time.Now().UTC()))
+			fmt.Fprintf(res, "User %v already holds %v valid tokens", userObject.Username, validTokens)
+			log.Printf("User %v already holds %v valid tokens", userObject.Username, validTokens)
+			return
+		}
+	}
+
+	if requestJSON.Format == "signed" || requestJSON.Refresh {
+		writeSignedToken(res, &userObject, requestJSON.Scopes, requestJSON.Refresh, requestJSON.Device)
+		return
+	}
+
+	// At this point, user has been successfully authenticated. Generate a nonce and send it back.
+	// This simply creates a random byte array
+	var nonce [24]byte
+
+	lengthOfCHARS := int64(len(CHARS))
+	for i := 0; i < 24; i++ {
+		n, err := rand.Int(rand.Reader, big.NewInt(lengthOfCHARS))
+		if err != nil {
+			res.WriteHeader(http.StatusInternalServerError)
+			log.Printf("Error turning big/Int into int64: %v", err)
+			return
+		}
+		nonce[i] = CHARS[int(n.Int64())]
+	}
+
+	// This is the life of the token
+	timeDuration, err := time.ParseDuration("144h")
+	if err != nil {
+		log.Panicf("%v", err)
+	}
+	timeOffset, err := time.ParseDuration("-1s")
+	if err != nil {
+		log.Panicf("%v", err)
+	}
+	expDateString := time.Now().UTC().Add(timeDuration).Add(timeOffset).Format("20060102150405")
+
+	responseJSON := AuthUserResponseJSON{
+		ExpirationDate: expDateString,
+		Nonce:          string(nonce[:]),
+	}
+
+	// Write token into database with user and timestamp for expiration. This
+	// happens before the client is answered, so the token works as soon as the
+	// client has what it needs to derive it.
+
+	// Create hash. Neither the nonce nor the token is logged, since either
+	// would let whoever reads the logs use the token.
+	hashInput := []byte(userObject.Username + string(nonce[:]) + expDateString)
+	tokenBytes := sha512.Sum512(hashInput)
+
+	token := Token{
+		Token:          tokenBytes[:],
+		User:           User{Username: userObject.Username},
+		ExpirationDate: expDateString,
+		DeviceID:       requestJSON.Device,
+	}
+
+	err = MainDB.Update(func(tx *bolt.Tx) error {
+		return putToken(tx, &token)
+	})
 	if err != nil {
 		res.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(res, "Server encountered an error hashing the password")
-		log.Printf("Encountered an error hashing the password '%s' with username '%s' using Bcrypt.", requestJSON.Password, requestJSON.Username)
+		log.Printf("Error storing token in database: %v", err)
 		return
 	}
 
-	userObject := User{
-		Username:     requestJSON.Username,
-		PasswordHash: hashedData,
-		ObjectIDs:    []int{},
+	// Write response back to client
+	responseData, err := json.Marshal(responseJSON)
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error marshalling response for client: %v", err)
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.Write(responseData)
+	log.Printf("A token expiring at %v has been issued to user %v", expDateString, userObject.Username)
+}
+
+// writeSignedToken issues a signed token to an authenticated user and sends it
+// back. A token requested without scopes gets all of them. If refresh is set,
+// it is a short-lived access token sent along with the first refresh token of
+// a new family. The tokens are tied to device, if one is given.
+func writeSignedToken(res http.ResponseWriter, user *User, scopes []string, refresh bool, device string) {
+	if len(scopes) == 0 {
+		scopes = AllScopes
+	}
+
+	if refresh {
+		var refreshToken string
+		var record *RefreshToken
+		err := MainDB.Update(func(tx *bolt.Tx) error {
+			var err error
+			refreshToken, record, err = newRefreshToken(tx, user, scopes, "", device)
+			return err
+		})
+		if err != nil {
+			res.WriteHeader(http.StatusInternalServerError)
+			log.Printf("Error storing refresh token of user %v: %v", user.Username, err)
+			return
+		}
+		writeTokenPair(res, user, refreshToken, record)
+		return
+	}
+
+	signedToken, claims, err := issueSignedToken(user, scopes, "", device)
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error issuing signed token to user %v: %v", user.Username, err)
+		return
+	}
+
+	responseJSON := AuthUserResponseJSON{
+		ExpirationDate: time.Unix(claims.Expires, 0).UTC().Format("20060102150405"),
+		Token:          signedToken,
+		Scopes:         claims.Scopes,
+	}
+	responseData, err := json.Marshal(responseJSON)
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error marshalling response for client: %v", err)
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.Write(responseData)
+	log.Printf("Signed token %v has been issued to user %v with scopes %v", claims.ID, user.Username, claims.Scopes)
+}
+
+// putToken persists a token to the tokens bucket, and adds it to its user's
+// index of tokens so they can all be found when revoking them.
+func putToken(tx *bolt.Tx, token *Token) error {
+	// Only the username is kept, never a copy of the user's secrets
+	stored := *token
+	stored.User = User{Username: token.User.Username}
+	buf, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Bucket([]byte("tokens")).Put(token.Token, buf)
+	if err != nil {
+		return err
+	}
+
+	userTokens, err := tx.Bucket([]byte("usertokens")).CreateBucketIfNotExists([]byte(token.User.Username))
+	if err != nil {
+		return err
 	}
+	return userTokens.Put(token.Token, []byte(token.ExpirationDate))
+}
 
-	err = MainDB.Update(func(tx *bolt.Tx) error {
-		// Retrieve the objects bucket.
-		// This should be created when the DB is first opened.
-		b := tx.Bucket([]byte("users"))
+// countValidTokens counts the unexpired tokens in a user's index of tokens,
+// and returns when the first of them expires.
+func countValidTokens(tx *bolt.Tx, username string) (int, time.Time, error) {
+	userTokens := tx.Bucket([]byte("usertokens")).Bucket([]byte(username))
+	if userTokens == nil {
+		return 0, time.Time{}, nil
+	}
 
-		// Marshal Object into bytes.
-		buf, err := json.Marshal(userObject)
+	count := 0
+	var nextExpiry time.Time
+	now := time.Now().UTC()
+	err := userTokens.ForEach(func(k, v []byte) error {
+		expirationDate, err := time.Parse("20060102150405", string(v))
 		if err != nil {
 			return err
 		}
+		if expirationDate.Before(now) {
+			return nil
+		}
 
-		// Persist bytes to users bucket.
-		return b.Put([]byte(userObject.Username), buf)
+		count++
+		if nextExpiry.IsZero() || expirationDate.Before(nextExpiry) {
+			nextExpiry = expirationDate
+		}
+		return nil
 	})
+	return count, nextExpiry, err
+}
 
+// countHeldTokens counts a user's unexpired legacy tokens and families of
+// refresh tokens, and returns when the first of them expires.
+func countHeldTokens(tx *bolt.Tx, user *User) (int, time.Time, error) {
+	tokens, nextExpiry, err := countValidTokens(tx, user.Username)
 	if err != nil {
-		res.WriteHeader(http.StatusInternalServerError)
-		log.Printf("Database insert of user %v failed with error %v", requestJSON.Username, err)
-		return
+		return 0, time.Time{}, err
 	}
-	log.Printf("User %v has been created", requestJSON.Username)
+	families, nextFamilyExpiry, err := countRefreshFamilies(tx, user)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	if nextExpiry.IsZero() || (!nextFamilyExpiry.IsZero() && nextFamilyExpiry.Before(nextExpiry)) {
+		nextExpiry = nextFamilyExpiry
+	}
+	return tokens + families, nextExpiry, nil
 }
 
-func authUserHandler(res http.ResponseWriter, req *http.Request) {
-	requestJSON := AuthUserRequestJSON{}
-	err := json.NewDecoder(req.Body).Decode(&requestJSON)
+// deleteToken removes a token and its entry in its user's index of tokens.
+func deleteToken(tx *bolt.Tx, token *Token) error {
+	err := tx.Bucket([]byte("tokens")).Delete(token.Token)
 	if err != nil {
-		res.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(res, "Error in decoding message")
-		return
+		return err
 	}
-	log.Printf("Request: %v", requestJSON)
 
-	// Confirm that owner exists
-	var userData []byte
-	requestedKey := []byte(requestJSON.Username)
-	MainDB.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("users"))
-		userData = b.Get(requestedKey)
+	userTokens := tx.Bucket([]byte("usertokens")).Bucket([]byte(token.User.Username))
+	if userTokens == nil {
 		return nil
-	})
-	if userData == nil {
-		res.WriteHeader(http.StatusNotFound)
-		fmt.Fprintf(res, "User %v is not a registered user", requestJSON.Username)
-		return
 	}
-	// Unmarshal User Object
-	userObject := User{}
-	err = json.Unmarshal(userData, &userObject)
-	if err != nil {
-		res.WriteHeader(http.StatusInternalServerError)
-		log.Printf("Error unmarshalling owner object from database. %v", err)
-		return
+	return userTokens.Delete(token.Token)
+}
+
+// deleteUserTokens removes every token belonging to a user, returning how many
+// there were.
+func deleteUserTokens(tx *bolt.Tx, username string) (int, error) {
+	userTokens := tx.Bucket([]byte("usertokens")).Bucket([]byte(username))
+	if userTokens == nil {
+		return 0, nil
 	}
 
-	// Bcrypt
-	err = bcrypt.CompareHashAndPassword(userObject.PasswordHash, []byte(requestJSON.Password+requestJSON.Username))
+	tokens := tx.Bucket([]byte("tokens"))
+	count := 0
+	err := userTokens.ForEach(func(k, v []byte) error {
+		count++
+		return tokens.Delete(k)
+	})
 	if err != nil {
-		res.WriteHeader(http.StatusForbidden)
-		fmt.Fprintf(res, "Invalid password given for user %v", requestJSON.Username)
-		return
+		return 0, err
 	}
+	return count, tx.Bucket([]byte("usertokens")).DeleteBucket([]byte(username))
+}
 
-	// Check RequestDate (to prevent replay attack)
-	requestDate, err := time.Parse("20060102150405", requestJSON.ReqDate)
+// revokeUserTokens revokes every token issued to a user: legacy tokens and
+// refresh tokens are deleted, and signed tokens are revoked by moving the user
+// to a new epoch. It returns how many legacy tokens there were. The caller
+// must put user and, once the transaction commits, call setTokenEpoch.
+func revokeUserTokens(tx *bolt.Tx, user *User) (int, error) {
+	count, err := deleteUserTokens(tx, user.Username)
 	if err != nil {
-		res.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(res, "Invalid time stamp.")
-		log.Printf("Invalid time stamp from user: '%v'. Parser gave error: %v", requestJSON.ReqDate, err)
-		return
+		return 0, err
+	}
+	_, err = deleteRefreshTokens(tx, func(record *RefreshToken) bool {
+		return record.Username == user.Username
+	})
+	if err != nil {
+		return 0, err
 	}
+	return count, newTokenEpoch(user)
+}
 
-	timeSinceRequest := time.Now().UTC().Sub(requestDate)
-	if timeSinceRequest.Minutes() > 5.0 {
-		res.WriteHeader(http.StatusExpectationFailed)
-		fmt.Fprintf(res, "Request Time is greater than 5 minutes ago.")
-		log.Printf("Request time >5 minutes from current time. \n\tRequest Time: '%v' \n\tCurrent Time: '%v'", requestDate, time.Now().UTC())
+func revokeTokenHandler(res http.ResponseWriter, req *http.Request) {
+	requestToken, ok := requiredQueryParam(res, req, "token")
+	if !ok {
 		return
 	}
 
-	// At this point, user has been successfully authenticated. Generate a nonce and send it back.
-	// This simply creates a random byte array
-	var nonce [24]byte
-
-	lengthOfCHARS := int64(len(CHARS))
-	for i := 0; i < 24; i++ {
-		n, err := rand.Int(rand.Reader, big.NewInt(lengthOfCHARS))
-		if err != nil {
-			res.WriteHeader(http.StatusInternalServerError)
-			log.Printf("Error turning big/Int into int64: ", err)
-			return
-		}
-		nonce[i] = CHARS[int(n.Int64())]
+	// Check and validate token
+	token := validateToken(res, requestToken, "")
+	if token == nil {
+		return
 	}
-	log.Printf("Generated nonce: %v", string(nonce[:]))
 
-	// This is the life of the token
-	timeDuration, err := time.ParseDuration("144h")
-	if err != nil {
-		log.Panicf("%v", err)
+	// Revoking an access token that came with a refresh token logs the
+	// device out, so the refresh token goes too
+	var err error
+	if token.Claims != nil && token.Claims.Family != "" {
+		var revokedUntil int64
+		err = MainDB.Update(func(tx *bolt.Tx) error {
+			revokedUntil, err = revokeTokenFamily(tx, token.Claims.Family)
+			return err
+		})
+		if err == nil {
+			setRevokedToken(token.Claims.Family, revokedUntil)
+		}
+	} else if token.Claims != nil {
+		err = revokeSignedToken(token.Claims)
+	} else {
+		err = MainDB.Update(func(tx *bolt.Tx) error {
+			return deleteToken(tx, token)
+		})
 	}
-	timeOffset, err := time.ParseDuration("-1s")
 	if err != nil {
-		log.Panicf("%v", err)
-	}
-	expDateString := time.Now().UTC().Add(timeDuration).Add(timeOffset).Format("20060102150405")
-
-	responseJSON := AuthUserResponseJSON{
-		ExpirationDate: expDateString,
-		Nonce:          string(nonce[:]),
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error revoking token of user %v: %v", token.User.Username, err)
+		return
 	}
+	log.Printf("A token of user %v has been revoked", token.User.Username)
+}
 
-	// Write response back to client
-	responseData, err := json.Marshal(responseJSON)
+func revokeAllTokensHandler(res http.ResponseWriter, req *http.Request) {
+	requestJSON := RevokeAllTokensRequestJSON{}
+	err := json.NewDecoder(req.Body).Decode(&requestJSON)
 	if err != nil {
-		res.WriteHeader(http.StatusInternalServerError)
-		log.Printf("Error marshalling response for client", err)
+		res.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(res, "Error in decoding message")
 		return
 	}
 
-	res.Header().Set("Content-Type", "application/json")
-	res.Write(responseData)
-
-	// Write token into database with user and timestamp for expiration
-
-	// Create hash
-	log.Printf("hashInput: '%v'", userObject.Username+string(nonce[:])+expDateString)
-	hashInput := []byte(userObject.Username + string(nonce[:]) + expDateString)
-	tokenBytes := sha512.Sum512(hashInput)
-	log.Printf("hashInput(text): '%v'", hex.EncodeToString(hashInput))
-
-	log.Printf("Token for user %v is: '%v'", userObject.Username, hex.EncodeToString(tokenBytes[:]))
-
-	token := Token{
-		Token:          tokenBytes[:],
-		User:           userObject,
-		ExpirationDate: expDateString,
+	// Check and validate token
+	token := validateToken(res, requestJSON.Token, ScopeAccount)
+	if token == nil {
+		return
 	}
 
+	var count int
+	var user *User
 	err = MainDB.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("tokens"))
-
-		// Marshal Object into bytes.
-		buf, err := json.Marshal(token)
+		user, err = getUser(tx, token.User.Username)
 		if err != nil {
 			return err
 		}
-
-		// Persist bytes to users bucket.
-		return b.Put(token.Token, buf)
+		if user == nil {
+			return fmt.Errorf("Owner of token %v does not exist", token.User.Username)
+		}
+		count, err = revokeUserTokens(tx, user)
+		if err != nil {
+			return err
+		}
+		return putUser(tx, user)
 	})
 	if err != nil {
 		res.WriteHeader(http.StatusInternalServerError)
-		log.Printf("Error storing token in database", err)
+		log.Printf("Error revoking tokens of user %v: %v", token.User.Username, err)
 		return
 	}
+	setTokenEpoch(user.Username, user.TokenEpoch)
 
+	fmt.Fprintf(res, "%v", count)
+	log.Printf("All %v tokens of user %v have been revoked", count, token.User.Username)
 }
 
 func initDB(dbfile string) error {
@@ -735,6 +2388,166 @@ func initDB(dbfile string) error {
 		return err
 	}
 
+	// Holds a record of each shared blob, keyed by the digest of its data
+	err = MainDB.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte("blobs"))
+		if err != nil {
+			return fmt.Errorf("Error creating bucket: %s", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Hold the keys signed tokens are signed with, the IDs of signed tokens,
+	// token families and devices that have been revoked, refresh tokens, a
+	// bucket of registered devices per user, a bucket per user of the objects
+	// shared with them, public links, and groups
+	for _, bucket := range []string{"signingkeys", "revokedtokens", "refreshtokens", "devices", "shares", "links", "groups"} {
+		err = MainDB.Update(func(tx *bolt.Tx) error {
+			_, err := tx.CreateBucketIfNotExists([]byte(bucket))
+			if err != nil {
+				return fmt.Errorf("Error creating bucket: %s", err)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// Holds a bucket per user, indexing the tokens issued to them
+	err = MainDB.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte("usertokens"))
+		if err != nil {
+			return fmt.Errorf("Error creating bucket: %s", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Tokens issued before the index existed are added to it
+	err = MainDB.Update(func(tx *bolt.Tx) error {
+		userTokens := tx.Bucket([]byte("usertokens"))
+		return tx.Bucket([]byte("tokens")).ForEach(func(k, v []byte) error {
+			token := Token{}
+			err := json.Unmarshal(v, &token)
+			if err != nil {
+				return err
+			}
+
+			if b := userTokens.Bucket([]byte(token.User.Username)); b != nil && b.Get(k) != nil {
+				return nil
+			}
+			b, err := userTokens.CreateBucketIfNotExists([]byte(token.User.Username))
+			if err != nil {
+				return err
+			}
+			return b.Put(k, []byte(token.ExpirationDate))
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("Error indexing tokens: %s", err)
+	}
+
+	// Tokens used to carry a copy of their user's record, password hash and
+	// two-factor secrets included, so they are stored again without it
+	err = MainDB.Update(func(tx *bolt.Tx) error {
+		var tokens []*Token
+		err := tx.Bucket([]byte("tokens")).ForEach(func(k, v []byte) error {
+			token := Token{}
+			err := json.Unmarshal(v, &token)
+			if err != nil {
+				return err
+			}
+			if token.User.PasswordHash != nil || token.User.TOTPSecret != "" || token.User.RecoveryCodes != nil {
+				tokens = append(tokens, &token)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, token := range tokens {
+			err = putToken(tx, token)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Error scrubbing tokens: %s", err)
+	}
+
+	// Upload sessions used to be numbered, and weren't bound to a token. They
+	// are given random IDs with no token, so they can no longer be uploaded to
+	// and are swept up along with their objects once they expire.
+	err = MainDB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("uploads"))
+		legacySessions := map[string][]byte{}
+		err := b.ForEach(func(k, v []byte) error {
+			if len(k) == 8 {
+				legacySessions[string(k)] = v
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for k, v := range legacySessions {
+			legacySession := struct{ Object Object }{}
+			err = json.Unmarshal(v, &legacySession)
+			if err != nil {
+				return err
+			}
+
+			uploadID, err := randomID()
+			if err != nil {
+				return err
+			}
+			err = putUploadSession(tx, &UploadSession{ID: uploadID, Object: legacySession.Object})
+			if err != nil {
+				return err
+			}
+			err = b.Delete([]byte(k))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Error migrating upload sessions: %s", err)
+	}
+
+	// Usage is counted afresh, so objects stored before it was tracked count.
+	// It is counted from object records, so those uploaded before sizes were
+	// kept on them get theirs first.
+	err = recordLegacyUploads()
+	if err != nil {
+		return fmt.Errorf("Error recording sizes of legacy objects: %s", err)
+	}
+	err = MainDB.Update(recountUsage)
+	if err != nil {
+		return fmt.Errorf("Error counting usage: %s", err)
+	}
+
+	// Make sure there is a key to sign tokens with, and load what's needed
+	// to verify them
+	_, err = rotateSigningKeys(false)
+	if err != nil {
+		return fmt.Errorf("Error loading signing keys: %s", err)
+	}
+	err = MainDB.View(loadSignedTokenState)
+	if err != nil {
+		return fmt.Errorf("Error loading token revocations: %s", err)
+	}
+
 	return nil
 }
 
@@ -749,22 +2562,109 @@ func main() {
 	tlsPtr := flag.Bool("ssl", false, "Whether SSL will be used when serving data")
 	fullChainPtr := flag.String("fullchain", "./fullchain.pem", "Full chain file (only used in SSL mode)")
 	privKeyPtr := flag.String("privatekey", "./privkey.pem", "Private key file (only used in SSL mode)")
+	versionsPtr := flag.Int("versions", 10, "number of versions kept of each object, unless a user chooses otherwise")
+	maxUploadPtr := flag.Int64("maxupload", 1<<30, "largest request body, in bytes, accepted when uploading an object")
+	uploadTTLPtr := flag.Duration("uploadttl", 24*time.Hour, "how long an upload session may wait for its data before it is abandoned")
+	sweepIntervalPtr := flag.Duration("sweepinterval", time.Hour, "how often expired tokens and abandoned uploads are swept from the database")
+	authUserRatePtr := flag.Float64("authuserrate", 5, "authentication requests allowed per username each minute")
+	authUserBurstPtr := flag.Int("authuserburst", 5, "authentication requests allowed per username in a burst")
+	authIPRatePtr := flag.Float64("authiprate", 30, "authentication requests allowed per client address each minute")
+	authIPBurstPtr := flag.Int("authipburst", 30, "authentication requests allowed per client address in a burst")
+	maxTokensPtr := flag.Int("maxtokens", 20, "most valid tokens a single user may hold at once")
+	quotaBytesPtr := flag.Int64("quotabytes", 0, "bytes each user may store unless given their own quota, or 0 for no limit")
+	quotaObjectsPtr := flag.Int("quotaobjects", 0, "objects each user may own unless given their own quota, or 0 for no limit")
+	storagePtr := flag.String("storage", "fs", "where object data is stored: \"fs\" for the data directory, \"s3\" for an S3-compatible bucket")
+	s3EndpointPtr := flag.String("s3endpoint", "https://s3.amazonaws.com", "URL of the S3-compatible service (only used with -storage s3)")
+	s3BucketPtr := flag.String("s3bucket", "", "bucket object data is stored in (only used with -storage s3)")
+	s3RegionPtr := flag.String("s3region", "us-east-1", "region of the bucket (only used with -storage s3)")
+	s3AccessKeyPtr := flag.String("s3accesskey", os.Getenv("AWS_ACCESS_KEY_ID"), "access key for the bucket, defaults to $AWS_ACCESS_KEY_ID (only used with -storage s3)")
+	s3SecretKeyPtr := flag.String("s3secretkey", os.Getenv("AWS_SECRET_ACCESS_KEY"), "secret key for the bucket, defaults to $AWS_SECRET_ACCESS_KEY (only used with -storage s3)")
+	masterKeyPtr := flag.String("masterkeyfile", "", "file holding the hex-encoded 256-bit master key that object data is encrypted under, defaults to $"+MasterKeyEnv+"; data is stored unencrypted without one")
+	tokenAlgPtr := flag.String("tokenalg", AlgorithmHMAC, "algorithm of new keys for signing tokens: \""+AlgorithmHMAC+"\" or \""+AlgorithmEd25519+"\"")
+	tokenKeyRotationPtr := flag.Duration("tokenkeyrotation", 30*24*time.Hour, "how long a key signs tokens before it is replaced")
+	argonTimePtr := flag.Uint("argontime", uint(ArgonTime), "iterations of argon2id when hashing passwords")
+	argonMemoryPtr := flag.Uint("argonmemory", uint(ArgonMemory), "memory, in KiB, argon2id uses when hashing passwords")
+	argonThreadsPtr := flag.Uint("argonthreads", uint(ArgonThreads), "threads argon2id uses when hashing passwords")
+	accessTokenLifetimePtr := flag.Duration("accesstokenlifetime", time.Hour, "how long access tokens issued along with refresh tokens are valid")
+	refreshTokenLifetimePtr := flag.Duration("refreshtokenlifetime", 60*24*time.Hour, "how long a refresh token may go unused before it expires")
+	rotateKeyPtr := flag.String("rotatemasterkey", "", "rewrap every data key under the master key in this file instead of serving, then exit")
+	setQuotaPtr := flag.String("setquota", "", "set the quota of this user, or group (\"group:<name>\"), to -setquotabytes and -setquotaobjects instead of serving, then exit")
+	setQuotaBytesPtr := flag.Int64("setquotabytes", 0, "bytes the owner given to -setquota may store: 0 for the server default, negative for no limit")
+	setQuotaObjectsPtr := flag.Int("setquotaobjects", 0, "objects the owner given to -setquota may own: 0 for the server default, negative for no limit")
 	flag.Parse()
 
 	// Set up HTTP Handling
 	mainRouter := mux.NewRouter()
 
 	// Auth Actions
+	mainRouter.HandleFunc("/auth", revokeTokenHandler).Methods("DELETE")
+	mainRouter.HandleFunc("/auth/revoke-all", revokeAllTokensHandler).Methods("POST")
+	mainRouter.HandleFunc("/auth/refresh", refreshTokenHandler).Methods("POST")
 	mainRouter.HandleFunc("/auth", authUserHandler)
 	// Object Actions
+	mainRouter.HandleFunc("/objects", listObjectsHandler).Methods("GET")
+	mainRouter.HandleFunc("/objects/shared", listSharedObjectsHandler).Methods("GET")
 	mainRouter.HandleFunc("/object", getObjectHandler).Methods("GET")
+	mainRouter.HandleFunc("/object/versions", listObjectVersionsHandler).Methods("GET")
+	mainRouter.HandleFunc("/object/restore", restoreObjectHandler).Methods("POST")
+	mainRouter.HandleFunc("/object/share", shareObjectHandler).Methods("POST")
+	mainRouter.HandleFunc("/object/share", unshareObjectHandler).Methods("DELETE")
+	mainRouter.HandleFunc("/object/link", createLinkHandler).Methods("POST")
+	mainRouter.HandleFunc("/object/link", deleteLinkHandler).Methods("DELETE")
+	mainRouter.HandleFunc("/s/{linkid}", getLinkHandler).Methods("GET")
 	mainRouter.HandleFunc("/object", createObjectHandler).Methods("POST")
 	mainRouter.HandleFunc("/object", createObjectHandler).Methods("PUT")
+	mainRouter.HandleFunc("/object", deleteObjectHandler).Methods("DELETE")
+	mainRouter.HandleFunc("/object", moveObjectHandler).Methods("PATCH")
 	mainRouter.HandleFunc("/object/{uploadid}", uploadObjectHandler).Methods("POST")
 	mainRouter.HandleFunc("/object/{uploadid}", uploadObjectHandler).Methods("PUT")
+	mainRouter.HandleFunc("/object/{uploadid}", uploadStatusHandler).Methods("GET")
+	mainRouter.HandleFunc("/object/{uploadid}/complete", completeUploadHandler).Methods("POST")
+	mainRouter.HandleFunc("/folder", createFolderHandler).Methods("POST")
+	mainRouter.HandleFunc("/folder", renameFolderHandler).Methods("PATCH")
+	mainRouter.HandleFunc("/folder", deleteFolderHandler).Methods("DELETE")
 
 	// User Actions
 	mainRouter.HandleFunc("/user", createUserHandler).Methods("POST")
+	mainRouter.HandleFunc("/user", deleteUserHandler).Methods("DELETE")
+	mainRouter.HandleFunc("/user/password", changePasswordHandler).Methods("PUT")
+	mainRouter.HandleFunc("/user/2fa", enrollTwoFactorHandler).Methods("POST")
+	mainRouter.HandleFunc("/user/2fa/confirm", confirmTwoFactorHandler).Methods("POST")
+	mainRouter.HandleFunc("/user/2fa", disableTwoFactorHandler).Methods("DELETE")
+	mainRouter.HandleFunc("/user/devices", registerDeviceHandler).Methods("POST")
+	mainRouter.HandleFunc("/user/devices", listDevicesHandler).Methods("GET")
+	mainRouter.HandleFunc("/user/devices", revokeDeviceHandler).Methods("DELETE")
+	mainRouter.HandleFunc("/user/retention", setVersionRetentionHandler).Methods("PUT")
+	mainRouter.HandleFunc("/user/usage", usageHandler).Methods("GET")
+
+	// Group Actions
+	mainRouter.HandleFunc("/groups", listGroupsHandler).Methods("GET")
+	mainRouter.HandleFunc("/group", createGroupHandler).Methods("POST")
+	mainRouter.HandleFunc("/group/members", setGroupMemberHandler).Methods("PUT")
+	mainRouter.HandleFunc("/group/members", removeGroupMemberHandler).Methods("DELETE")
+
+	// Set Data Directory, which also holds partial uploads whatever the storage
+	DataPath = *datapathPtr
+	switch *storagePtr {
+	case "fs":
+		Blobs = NewFileBlobStore(DataPath)
+	case "s3":
+		if *s3BucketPtr == "" {
+			log.Fatalf("-s3bucket is required when storing data in S3")
+		}
+		Blobs = NewS3BlobStore(*s3EndpointPtr, *s3BucketPtr, *s3RegionPtr, *s3AccessKeyPtr, *s3SecretKeyPtr, DataPath)
+	default:
+		log.Fatalf("Unknown storage backend %q", *storagePtr)
+	}
+
+	// Tokens are signed with keys generated while initializing the database
+	if *tokenAlgPtr != AlgorithmHMAC && *tokenAlgPtr != AlgorithmEd25519 {
+		log.Fatalf("Unknown token signing algorithm %q", *tokenAlgPtr)
+	}
+	SigningAlgorithm = *tokenAlgPtr
+	SigningKeyRotation = *tokenKeyRotationPtr
+	AccessTokenLifetime = *accessTokenLifetimePtr
+	RefreshTokenLifetime = *refreshTokenLifetimePtr
 
 	// Initialize database
 	err := initDB(*dbfilePtr)
@@ -773,8 +2673,58 @@ func main() {
 		log.Printf("Database initialization failed with error %v", err)
 	}
 
-	// Set Data Directory
-	DataPath = *datapathPtr
+	// Encrypt data at rest if there is a master key
+	MasterKey, err = loadMasterKey(*masterKeyPtr)
+	if err != nil {
+		log.Fatalf("Loading master key failed: %v", err)
+	}
+	if MasterKey != nil {
+		log.Printf("Encrypting object data under master key %v", masterKeyID(MasterKey))
+	}
+
+	if *rotateKeyPtr != "" {
+		newKey, err := loadMasterKey(*rotateKeyPtr)
+		if err != nil || newKey == nil {
+			log.Fatalf("Loading new master key from %v failed: %v", *rotateKeyPtr, err)
+		}
+		if MasterKey == nil {
+			log.Fatalf("The current master key is needed to rotate it")
+		}
+		count, err := rotateMasterKey(MasterKey, newKey)
+		if err != nil {
+			log.Fatalf("Rotating master key failed, nothing was changed: %v", err)
+		}
+		log.Printf("Rewrapped %v data keys under master key %v. Restart the server with the new key.", count, masterKeyID(newKey))
+		return
+	}
+
+	if *setQuotaPtr != "" {
+		err = setOwnerQuota(*setQuotaPtr, *setQuotaBytesPtr, *setQuotaObjectsPtr)
+		if err != nil {
+			log.Fatalf("Setting quota of %v failed: %v", *setQuotaPtr, err)
+		}
+		log.Printf("Quota of %v has been set to %v bytes and %v objects", *setQuotaPtr, *setQuotaBytesPtr, *setQuotaObjectsPtr)
+		return
+	}
+
+	DefaultVersionRetention = *versionsPtr
+	if *argonTimePtr < 1 || *argonThreadsPtr < 1 || *argonThreadsPtr > 255 || *argonMemoryPtr < 8*(*argonThreadsPtr) {
+		log.Fatalf("Invalid argon2id parameters")
+	}
+	ArgonTime = uint32(*argonTimePtr)
+	ArgonMemory = uint32(*argonMemoryPtr)
+	ArgonThreads = uint8(*argonThreadsPtr)
+	MaxUploadSize = *maxUploadPtr
+	UploadSessionTTL = *uploadTTLPtr
+	AuthUserLimiter = NewRateLimiter(*authUserRatePtr, *authUserBurstPtr)
+	AuthIPLimiter = NewRateLimiter(*authIPRatePtr, *authIPBurstPtr)
+	MaxTokensPerUser = *maxTokensPtr
+	SignedTokenLimiter = newSignedTokenLimiter()
+	DefaultQuotaBytes = *quotaBytesPtr
+	DefaultQuotaObjects = *quotaObjectsPtr
+
+	// Clean up after clients in the background
+	startJanitor(*sweepIntervalPtr)
 
 	// Kick off Server
 	serveString := fmt.Sprintf(":%v", *portPtr)
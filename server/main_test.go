@@ -2,7 +2,9 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"crypto/sha512"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
@@ -12,7 +14,7 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"os"
-	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -20,12 +22,18 @@ import (
 )
 
 func setup() {
+	DataPath = "test_data/"
+	os.Mkdir(DataPath, 0777)
+	Blobs = NewFileBlobStore(DataPath)
+
 	err := initDB("test.db")
 	if err != nil {
 		log.Panicf("Database initialization failed with error %v", err)
 	}
-	DataPath = "test_data/"
-	os.Mkdir(DataPath, 0777)
+
+	// Every test request comes from the same address, so only the tests of
+	// rate limiting itself should run into the limits
+	AuthIPLimiter = NewRateLimiter(6000, 1000)
 }
 
 func shutdown() {
@@ -208,14 +216,14 @@ func TestPutGetObjectValid(t *testing.T) {
 			status, http.StatusOK)
 	}
 
-	uploadID, err := strconv.Atoi(rr.Body.String())
-	if err != nil {
-		t.Errorf("Failed to convert UploadID '%v' to integer", uploadID)
+	uploadID := rr.Body.String()
+	if len(uploadID) != 32 {
+		t.Errorf("UploadID '%v' is not 32 characters long", uploadID)
 	}
 
 	// Upload file to database
 	data := []byte("I am a test file! (not really, but don't tell anyone)!")
-	req, err = http.NewRequest("POST", "/object/"+strconv.Itoa(uploadID)+"/", bytes.NewBuffer(data))
+	req, err = http.NewRequest("POST", "/object/"+uploadID+"/?token="+sha, bytes.NewBuffer(data))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -691,9 +699,615 @@ func TestAuthUserReplayAttack(t *testing.T) {
 	}
 }
 
+// createAndAuthUser registers a user, authenticates them and returns the
+// hex-encoded token derived from the server's response.
+func createAndAuthUser(t *testing.T, username string, password string) string {
+	createUserJSON := UserCreationJSON{Username: username, Password: password}
+	buffer, err := json.Marshal(createUserJSON)
+	req, err := http.NewRequest("POST", "/user", bytes.NewBuffer(buffer))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(createUserHandler).ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("user creator handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+
+	return authTestUser(t, username, password)
+}
+
+// authTestUser authenticates an existing user and returns the hex-encoded
+// token derived from the server's response.
+func authTestUser(t *testing.T, username string, password string) string {
+	authUserJSON := AuthUserRequestJSON{
+		Username: username,
+		Password: password,
+		ReqDate:  time.Now().UTC().Format("20060102150405"),
+	}
+	buffer, err := json.Marshal(authUserJSON)
+	req, err := http.NewRequest("GET", "/auth", bytes.NewBuffer(buffer))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(authUserHandler).ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("auth handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+
+	response := AuthUserResponseJSON{}
+	err = json.NewDecoder(rr.Body).Decode(&response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hasher := sha512.New()
+	hasher.Write([]byte(username + response.Nonce + response.ExpirationDate))
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+// createTestObject creates an object and returns its UploadID.
+func createTestObject(t *testing.T, token string, filename string) string {
+	createObjectJSON := CreateObjectRequestJSON{Token: token, FileName: filename}
+	buffer, err := json.Marshal(createObjectJSON)
+	req, err := http.NewRequest("POST", "/object", bytes.NewBuffer(buffer))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(createObjectHandler).ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("object creator handler returned wrong status code: got %v want %v.\n\tBody was: %v",
+			status, http.StatusOK, rr.Body.String())
+	}
+	return rr.Body.String()
+}
+
+// uploadTestObject creates an object and uploads data into it.
+func uploadTestObject(t *testing.T, token string, filename string, data []byte) {
+	uploadID := createTestObject(t, token, filename)
+
+	req, err := http.NewRequest("POST", "/object/"+uploadID+"?token="+token, bytes.NewBuffer(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(uploadObjectHandler).ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("object upload handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+}
+
+func TestListObjects(t *testing.T) {
+	token := createAndAuthUser(t, "lister", "foobar")
+
+	uploadTestObject(t, token, "a.txt", []byte("first file"))
+	uploadTestObject(t, token, "b.txt", []byte("second"))
+	createTestObject(t, token, "c.txt")
+
+	// First page
+	req, err := http.NewRequest("GET", "/objects?token="+token+"&limit=2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(listObjectsHandler).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("list handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+
+	response := ListObjectsResponseJSON{}
+	err = json.NewDecoder(rr.Body).Decode(&response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if response.Total != 3 || len(response.Objects) != 2 || response.NextOffset != 2 {
+		t.Fatalf("Unexpected first page: %+v", response)
+	}
+	if response.Objects[0].Name != "a.txt" || response.Objects[0].Size != 10 || response.Objects[0].State != "uploaded" {
+		t.Errorf("Unexpected listing for a.txt: %+v", response.Objects[0])
+	}
+	if response.Objects[0].CreationDate == "" || response.Objects[0].UploadDate == "" {
+		t.Errorf("Expected timestamps for a.txt: %+v", response.Objects[0])
+	}
+
+	// Second page
+	req, err = http.NewRequest("GET", "/objects?token="+token+"&limit=2&offset=2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(listObjectsHandler).ServeHTTP(rr, req)
+
+	response = ListObjectsResponseJSON{}
+	err = json.NewDecoder(rr.Body).Decode(&response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(response.Objects) != 1 || response.NextOffset != 0 {
+		t.Fatalf("Unexpected second page: %+v", response)
+	}
+	if response.Objects[0].Name != "c.txt" || response.Objects[0].State != "created" {
+		t.Errorf("Unexpected listing for c.txt: %+v", response.Objects[0])
+	}
+}
+
+func TestListObjectsBadLimit(t *testing.T) {
+	token := createAndAuthUser(t, "badlister", "foobar")
+
+	req, err := http.NewRequest("GET", "/objects?token="+token+"&limit=0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(listObjectsHandler).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("list handler returned wrong status code: got %v want %v",
+			status, http.StatusBadRequest)
+	}
+}
+
+func TestDeleteObject(t *testing.T) {
+	token := createAndAuthUser(t, "deleter", "foobar")
+
+	uploadTestObject(t, token, "doomed.txt", []byte("goodbye"))
+	pendingUploadID := createTestObject(t, token, "pending.txt")
+
+	var doomed Object
+	MainDB.View(func(tx *bolt.Tx) error {
+		owner, _ := getUser(tx, "deleter")
+		object, _ := getObject(tx, owner.ObjectIDs[0])
+		doomed = *object
+		return nil
+	})
+
+	// Delete the uploaded object
+	req, err := http.NewRequest("DELETE", "/object?token="+token+"&filename=doomed.txt", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(deleteObjectHandler).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("delete handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+
+	// Its data goes once unreferenced blobs are collected
+	if _, err := collectBlobs(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(DataPath + doomed.LocalFileName); !os.IsNotExist(err) {
+		t.Errorf("Data file of deleted object still exists")
+	}
+
+	// Delete the object that was only created
+	req, err = http.NewRequest("DELETE", "/object?token="+token+"&filename=pending.txt", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(deleteObjectHandler).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("delete handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+
+	MainDB.View(func(tx *bolt.Tx) error {
+		owner, _ := getUser(tx, "deleter")
+		if len(owner.ObjectIDs) != 0 {
+			t.Errorf("Owner index still contains objects: %v", owner.ObjectIDs)
+		}
+		if object, _ := getObject(tx, doomed.ID); object != nil {
+			t.Errorf("Object record still exists: %v", object)
+		}
+		return nil
+	})
+
+	// The pending upload must have been cancelled
+	req, err = http.NewRequest("POST", "/object/"+pendingUploadID+"?token="+token, bytes.NewBufferString("too late"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(uploadObjectHandler).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Errorf("upload handler returned wrong status code: got %v want %v",
+			status, http.StatusNotFound)
+	}
+
+	// Deleting again finds nothing
+	req, err = http.NewRequest("DELETE", "/object?token="+token+"&filename=doomed.txt", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(deleteObjectHandler).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Errorf("delete handler returned wrong status code: got %v want %v",
+			status, http.StatusNotFound)
+	}
+}
+
+// getTestObject fetches an object, returning the status code and body.
+func getTestObject(t *testing.T, token string, query string) (int, string) {
+	req, err := http.NewRequest("GET", "/object?token="+token+"&"+query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(getObjectHandler).ServeHTTP(rr, req)
+	return rr.Code, rr.Body.String()
+}
+
+func TestObjectVersions(t *testing.T) {
+	token := createAndAuthUser(t, "versioner", "foobar")
+
+	uploadTestObject(t, token, "notes.txt", []byte("one"))
+	uploadTestObject(t, token, "notes.txt", []byte("two"))
+
+	// Latest version is served by default
+	if status, body := getTestObject(t, token, "filename=notes.txt"); status != http.StatusOK || body != "two" {
+		t.Errorf("Expected latest version. Got %v: %v", status, body)
+	}
+	if status, body := getTestObject(t, token, "filename=notes.txt&version=1"); status != http.StatusOK || body != "one" {
+		t.Errorf("Expected first version. Got %v: %v", status, body)
+	}
+	if status, _ := getTestObject(t, token, "filename=notes.txt&version=7"); status != http.StatusNotFound {
+		t.Errorf("Expected missing version to be not found. Got %v", status)
+	}
+
+	// A new version that is still pending doesn't hide the latest upload
+	createTestObject(t, token, "notes.txt")
+	if status, body := getTestObject(t, token, "filename=notes.txt"); status != http.StatusOK || body != "two" {
+		t.Errorf("Expected latest uploaded version. Got %v: %v", status, body)
+	}
+
+	// List versions
+	req, err := http.NewRequest("GET", "/object/versions?token="+token+"&filename=notes.txt", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(listObjectVersionsHandler).ServeHTTP(rr, req)
+
+	versions := []ObjectInfoJSON{}
+	err = json.NewDecoder(rr.Body).Decode(&versions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 3 || versions[0].Version != 1 || versions[2].Version != 3 || versions[2].State != "created" {
+		t.Fatalf("Unexpected version listing: %+v", versions)
+	}
+
+	// Restore the first version
+	restoreJSON := RestoreObjectRequestJSON{Token: token, FileName: "notes.txt", Version: 1}
+	buffer, err := json.Marshal(restoreJSON)
+	req, err = http.NewRequest("POST", "/object/restore", bytes.NewBuffer(buffer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(restoreObjectHandler).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK || rr.Body.String() != "4" {
+		t.Fatalf("restore handler returned %v: %v", status, rr.Body.String())
+	}
+	if status, body := getTestObject(t, token, "filename=notes.txt"); status != http.StatusOK || body != "one" {
+		t.Errorf("Expected restored version. Got %v: %v", status, body)
+	}
+
+	// The listing shows the object once
+	req, err = http.NewRequest("GET", "/objects?token="+token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(listObjectsHandler).ServeHTTP(rr, req)
+
+	listing := ListObjectsResponseJSON{}
+	err = json.NewDecoder(rr.Body).Decode(&listing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if listing.Total != 1 || listing.Objects[0].Version != 4 || listing.Objects[0].Versions != 4 {
+		t.Errorf("Unexpected listing: %+v", listing)
+	}
+}
+
+func TestObjectVersionRetention(t *testing.T) {
+	token := createAndAuthUser(t, "forgetful", "foobar")
+
+	retentionJSON := VersionRetentionRequestJSON{Token: token, Versions: 2}
+	buffer, err := json.Marshal(retentionJSON)
+	req, err := http.NewRequest("PUT", "/user/retention", bytes.NewBuffer(buffer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(setVersionRetentionHandler).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("retention handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+
+	uploadTestObject(t, token, "diary.txt", []byte("monday"))
+	uploadTestObject(t, token, "diary.txt", []byte("tuesday"))
+	uploadTestObject(t, token, "diary.txt", []byte("wednesday"))
+
+	if status, _ := getTestObject(t, token, "filename=diary.txt&version=1"); status != http.StatusNotFound {
+		t.Errorf("Expected oldest version to be pruned. Got %v", status)
+	}
+	if status, body := getTestObject(t, token, "filename=diary.txt&version=2"); status != http.StatusOK || body != "tuesday" {
+		t.Errorf("Expected second version to be kept. Got %v: %v", status, body)
+	}
+	if status, body := getTestObject(t, token, "filename=diary.txt"); status != http.StatusOK || body != "wednesday" {
+		t.Errorf("Expected latest version. Got %v: %v", status, body)
+	}
+}
+
+func TestUploadObjectTooLarge(t *testing.T) {
+	token := createAndAuthUser(t, "bigspender", "foobar")
+	uploadID := createTestObject(t, token, "huge.bin")
+
+	oldMaxUploadSize := MaxUploadSize
+	MaxUploadSize = 16
+	defer func() { MaxUploadSize = oldMaxUploadSize }()
+
+	// Hide the length, so that the limit is only noticed while streaming
+	req, err := http.NewRequest("POST", "/object/"+uploadID+"?token="+token, ioutil.NopCloser(bytes.NewBufferString("this is more than sixteen bytes")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(uploadObjectHandler).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusRequestEntityTooLarge {
+		t.Fatalf("upload handler returned wrong status code: got %v want %v",
+			status, http.StatusRequestEntityTooLarge)
+	}
+
+	// Nothing was left behind, and the upload can still be made
+	if status, _ := getTestObject(t, token, "filename=huge.bin"); status != http.StatusPreconditionFailed {
+		t.Errorf("Expected object to still be waiting for its upload. Got %v", status)
+	}
+
+	req, err = http.NewRequest("POST", "/object/"+uploadID+"?token="+token, bytes.NewBufferString("small enough"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(uploadObjectHandler).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("upload handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+
+	files, err := ioutil.ReadDir(DataPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		if strings.Contains(file.Name(), ".tmp-") {
+			t.Errorf("Temporary upload file %v was left behind", file.Name())
+		}
+	}
+}
+
+func TestUploadObjectDigest(t *testing.T) {
+	token := createAndAuthUser(t, "checksummer", "foobar")
+	data := []byte("integrity matters")
+	digest := sha256.Sum256(data)
+
+	// Digest given when creating the object
+	createObjectJSON := CreateObjectRequestJSON{Token: token, FileName: "checked.txt", SHA256: hex.EncodeToString(digest[:])}
+	buffer, err := json.Marshal(createObjectJSON)
+	req, err := http.NewRequest("POST", "/object", bytes.NewBuffer(buffer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(createObjectHandler).ServeHTTP(rr, req)
+	uploadID := rr.Body.String()
+
+	req, err = http.NewRequest("POST", "/object/"+uploadID+"?token="+token, bytes.NewBufferString("integrity does not matter"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(uploadObjectHandler).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Fatalf("upload handler returned wrong status code: got %v want %v",
+			status, http.StatusBadRequest)
+	}
+
+	req, err = http.NewRequest("POST", "/object/"+uploadID+"?token="+token, bytes.NewBuffer(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(uploadObjectHandler).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("upload handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+
+	// Digest given in a header
+	uploadID = createTestObject(t, token, "headered.txt")
+	req, err = http.NewRequest("POST", "/object/"+uploadID+"?token="+token, bytes.NewBufferString("something else"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Digest", "SHA-256="+base64.StdEncoding.EncodeToString(digest[:]))
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(uploadObjectHandler).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Fatalf("upload handler returned wrong status code: got %v want %v",
+			status, http.StatusBadRequest)
+	}
+
+	// The digest is returned with the object
+	req, err = http.NewRequest("GET", "/object?token="+token+"&filename=checked.txt", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(getObjectHandler).ServeHTTP(rr, req)
+
+	if etag := rr.Header().Get("ETag"); etag != `"`+hex.EncodeToString(digest[:])+`"` {
+		t.Errorf("Unexpected ETag: %v", etag)
+	}
+	if header := rr.Header().Get("Digest"); header != "SHA-256="+base64.StdEncoding.EncodeToString(digest[:]) {
+		t.Errorf("Unexpected Digest: %v", header)
+	}
+}
+
+func TestRevokeToken(t *testing.T) {
+	token := createAndAuthUser(t, "loser", "foobar")
+	otherToken := authTestUser(t, "loser", "foobar")
+
+	req, err := http.NewRequest("DELETE", "/auth?token="+token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(revokeTokenHandler).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("revoke handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+
+	// Only the presented token stops working
+	if status, _ := getTestObject(t, token, "filename=anything"); status != http.StatusNotFound {
+		t.Errorf("Expected revoked token to be rejected. Got %v", status)
+	}
+	if status, body := getTestObject(t, otherToken, "filename=anything"); status != http.StatusNotFound || !strings.HasPrefix(body, "Failed to find object") {
+		t.Errorf("Expected other token to keep working. Got %v: %v", status, body)
+	}
+}
+
+func TestRevokeAllTokens(t *testing.T) {
+	token := createAndAuthUser(t, "phoneless", "foobar")
+	otherToken := authTestUser(t, "phoneless", "foobar")
+	bystanderToken := createAndAuthUser(t, "bystander", "foobar")
+
+	revokeJSON := RevokeAllTokensRequestJSON{Token: token}
+	buffer, err := json.Marshal(revokeJSON)
+	req, err := http.NewRequest("POST", "/auth/revoke-all", bytes.NewBuffer(buffer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(revokeAllTokensHandler).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK || rr.Body.String() != "2" {
+		t.Fatalf("revoke-all handler returned %v: %v", status, rr.Body.String())
+	}
+
+	for _, revoked := range []string{token, otherToken} {
+		if status, _ := getTestObject(t, revoked, "filename=anything"); status != http.StatusNotFound {
+			t.Errorf("Expected revoked token to be rejected. Got %v", status)
+		}
+	}
+	if status, body := getTestObject(t, bystanderToken, "filename=anything"); !strings.HasPrefix(body, "Failed to find object") {
+		t.Errorf("Expected other user's token to keep working. Got %v: %v", status, body)
+	}
+}
+
+func TestUploadObjectRequiresCreatingToken(t *testing.T) {
+	token := createAndAuthUser(t, "rightful", "foobar")
+	thiefToken := createAndAuthUser(t, "thief", "foobar")
+	uploadID := createTestObject(t, token, "mine.txt")
+
+	for _, query := range []string{"", "?token=" + thiefToken} {
+		req, err := http.NewRequest("POST", "/object/"+uploadID+query, bytes.NewBufferString("overwritten"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(uploadObjectHandler).ServeHTTP(rr, req)
+
+		if status := rr.Code; status != http.StatusBadRequest && status != http.StatusForbidden {
+			t.Errorf("upload handler accepted upload with query '%v': got %v", query, status)
+		}
+	}
+
+	// Sessions expire
+	oldUploadSessionTTL := UploadSessionTTL
+	UploadSessionTTL = -time.Second
+	defer func() { UploadSessionTTL = oldUploadSessionTTL }()
+
+	req, err := http.NewRequest("POST", "/object/"+uploadID+"?token="+token, bytes.NewBufferString("too late"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(uploadObjectHandler).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusGone {
+		t.Errorf("upload handler returned wrong status code: got %v want %v",
+			status, http.StatusGone)
+	}
+}
+
 func TestMain(m *testing.M) {
 	setup()
 	code := m.Run()
 	shutdown()
 	os.Exit(code)
 }
+
+func TestAuthLogsNoSecrets(t *testing.T) {
+	createAndAuthUser(t, "discreet", "hunter2hunter2")
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	rr := authTestRequest(t, "discreet", "hunter2hunter2")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("auth handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	response := AuthUserResponseJSON{}
+	err := json.NewDecoder(rr.Body).Decode(&response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hasher := sha512.New()
+	hasher.Write([]byte("discreet" + response.Nonce + response.ExpirationDate))
+	token := hex.EncodeToString(hasher.Sum(nil))
+	signedToken := signedTestToken(t, "discreet", "hunter2hunter2")
+
+	for _, secret := range []string{"hunter2hunter2", response.Nonce, token, signedToken} {
+		if strings.Contains(logged.String(), secret) {
+			t.Errorf("Expected %q to be kept out of the log. Got:\n%v", secret, logged.String())
+		}
+	}
+	if !strings.Contains(logged.String(), "discreet") {
+		t.Errorf("Expected authentication to be logged. Got:\n%v", logged.String())
+	}
+}
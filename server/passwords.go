@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/boltdb/bolt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Password hashes
+//
+// Passwords are hashed with argon2id under a random salt of each user's own,
+// and stored in the PHC string format, which names the algorithm and its
+// parameters along with the salt and hash:
+//
+//	$argon2id$v=19$m=<memory KiB>,t=<iterations>,p=<threads>$<salt>$<hash>
+//
+// Users registered before argon2id was used still have bcrypt hashes
+// ("$2a$..."), over their password followed by their username. Those are
+// still verified, and like argon2id hashes with parameters other than the
+// current ones, they are replaced the next time the user logs in.
+
+// Parameters of newly computed argon2id hashes
+var (
+	ArgonTime    uint32 = 2
+	ArgonMemory  uint32 = 19 * 1024
+	ArgonThreads uint8  = 1
+)
+
+const (
+	argonSaltLength = 16
+	argonKeyLength  = 32
+	argonPrefix     = "$argon2id$"
+)
+
+var ErrPasswordMismatch = errors.New("Password does not match")
+
+type argonParams struct {
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+	Salt    []byte
+	Key     []byte
+}
+
+// hashPassword hashes a password with argon2id under a new random salt.
+func hashPassword(password string) ([]byte, error) {
+	salt := make([]byte, argonSaltLength)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, ArgonTime, ArgonMemory, ArgonThreads, argonKeyLength)
+	encoded := fmt.Sprintf("%vv=%d$m=%d,t=%d,p=%d$%v$%v", argonPrefix, argon2.Version, ArgonMemory, ArgonTime, ArgonThreads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+	return []byte(encoded), nil
+}
+
+func parseArgonHash(hash []byte) (*argonParams, error) {
+	fields := strings.Split(string(hash), "$")
+	if len(fields) != 6 || fields[1] != "argon2id" {
+		return nil, fmt.Errorf("Malformed argon2id hash")
+	}
+
+	var version int
+	_, err := fmt.Sscanf(fields[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return nil, fmt.Errorf("Unsupported argon2id version %v", fields[2])
+	}
+
+	params := argonParams{}
+	_, err = fmt.Sscanf(fields[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads)
+	if err != nil {
+		return nil, fmt.Errorf("Malformed argon2id parameters %v", fields[3])
+	}
+	params.Salt, err = base64.RawStdEncoding.DecodeString(fields[4])
+	if err != nil {
+		return nil, err
+	}
+	params.Key, err = base64.RawStdEncoding.DecodeString(fields[5])
+	if err != nil {
+		return nil, err
+	}
+	return &params, nil
+}
+
+// checkPassword returns an error unless password is the user's password,
+// whichever way it was hashed.
+func checkPassword(user *User, password string) error {
+	if !bytes.HasPrefix(user.PasswordHash, []byte(argonPrefix)) {
+		err := bcrypt.CompareHashAndPassword(user.PasswordHash, []byte(password+user.Username))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return ErrPasswordMismatch
+		}
+		return err
+	}
+
+	return checkArgonHash(user.PasswordHash, password)
+}
+
+// checkArgonHash returns an error unless hash is an argon2id hash of password.
+func checkArgonHash(hash []byte, password string) error {
+	params, err := parseArgonHash(hash)
+	if err != nil {
+		return err
+	}
+	key := argon2.IDKey([]byte(password), params.Salt, params.Time, params.Memory, params.Threads, uint32(len(params.Key)))
+	if subtle.ConstantTimeCompare(key, params.Key) != 1 {
+		return ErrPasswordMismatch
+	}
+	return nil
+}
+
+// passwordHashOutdated reports whether a hash wasn't computed the way new
+// ones are.
+func passwordHashOutdated(hash []byte) bool {
+	params, err := parseArgonHash(hash)
+	if err != nil {
+		return true
+	}
+	return params.Time != ArgonTime || params.Memory != ArgonMemory || params.Threads != ArgonThreads ||
+		len(params.Salt) != argonSaltLength || len(params.Key) != argonKeyLength
+}
+
+// upgradePasswordHash rehashes the password of a user who has just logged in
+// with it, if their stored hash is outdated. The user record is only replaced
+// if its hash hasn't changed in the meantime.
+func upgradePasswordHash(user *User, password string) error {
+	if !passwordHashOutdated(user.PasswordHash) {
+		return nil
+	}
+
+	hashedData, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	return MainDB.Update(func(tx *bolt.Tx) error {
+		current, err := getUser(tx, user.Username)
+		if err != nil || current == nil || !bytes.Equal(current.PasswordHash, user.PasswordHash) {
+			return err
+		}
+		current.PasswordHash = hashedData
+		return putUser(tx, current)
+	})
+}
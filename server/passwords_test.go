@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func getTestPasswordHash(t *testing.T, username string) []byte {
+	var hash []byte
+	err := MainDB.View(func(tx *bolt.Tx) error {
+		user, err := getUser(tx, username)
+		if err != nil {
+			return err
+		}
+		hash = user.PasswordHash
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+func TestPasswordHash(t *testing.T) {
+	long := strings.Repeat("x", 80)
+	hash, err := hashPassword(long + "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(hash, []byte("$argon2id$v=19$")) || passwordHashOutdated(hash) {
+		t.Errorf("Unexpected hash %s", hash)
+	}
+
+	user := &User{Username: "hashed", PasswordHash: hash}
+	if err := checkPassword(user, long+"1"); err != nil {
+		t.Errorf("Expected password to match: %v", err)
+	}
+	// Unlike bcrypt, the whole password counts
+	for _, wrong := range []string{long + "2", long, ""} {
+		if err := checkPassword(user, wrong); err != ErrPasswordMismatch {
+			t.Errorf("Expected %q not to match. Got %v", wrong, err)
+		}
+	}
+
+	// Every hash has its own salt
+	again, err := hashPassword(long + "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(hash, again) {
+		t.Errorf("Expected hashes of the same password to differ")
+	}
+
+	user.PasswordHash = []byte("$argon2id$v=19$garbage")
+	if err := checkPassword(user, long+"1"); err == nil {
+		t.Errorf("Expected malformed hash to fail")
+	}
+}
+
+func TestBcryptPasswordUpgraded(t *testing.T) {
+	createAndAuthUser(t, "oldtimer", "foobar")
+
+	// Users registered before argon2id have bcrypt hashes
+	legacyHash, err := bcrypt.GenerateFromPassword([]byte("foobar"+"oldtimer"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = MainDB.Update(func(tx *bolt.Tx) error {
+		user, err := getUser(tx, "oldtimer")
+		if err != nil {
+			return err
+		}
+		user.PasswordHash = legacyHash
+		return putUser(tx, user)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rr := authTestRequest(t, "oldtimer", "wrong"); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected wrong password to be refused. Got %v", rr.Code)
+	}
+	if hash := getTestPasswordHash(t, "oldtimer"); !bytes.Equal(hash, legacyHash) {
+		t.Errorf("Expected hash to be kept after a failed login")
+	}
+
+	authTestUser(t, "oldtimer", "foobar")
+	hash := getTestPasswordHash(t, "oldtimer")
+	if !bytes.HasPrefix(hash, []byte(argonPrefix)) {
+		t.Errorf("Expected bcrypt hash to be replaced on login. Got %s", hash)
+	}
+	authTestUser(t, "oldtimer", "foobar")
+}
+
+func TestArgonParametersUpgraded(t *testing.T) {
+	createAndAuthUser(t, "tuned", "foobar")
+	oldHash := getTestPasswordHash(t, "tuned")
+
+	oldTime := ArgonTime
+	ArgonTime = oldTime + 1
+	defer func() { ArgonTime = oldTime }()
+
+	if !passwordHashOutdated(oldHash) {
+		t.Errorf("Expected hash with old parameters to be outdated")
+	}
+	authTestUser(t, "tuned", "foobar")
+	hash := getTestPasswordHash(t, "tuned")
+	if bytes.Equal(hash, oldHash) || passwordHashOutdated(hash) {
+		t.Errorf("Expected hash to be recomputed with new parameters. Got %s", hash)
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/boltdb/bolt"
+)
+
+// Storage quotas
+//
+// Each user record keeps running counts of the objects the user owns and the
+// bytes uploaded into them, which are updated in the same transaction that
+// creates, uploads or removes an object. Every version counts, and data shared
+// with other objects counts in full for each of them. Sizes are read off object
+// records, never from the blob store, so transactions don't wait on it.
+
+// Limits for users who don't have their own. Zero means unlimited.
+var DefaultQuotaBytes int64 = 0
+var DefaultQuotaObjects = 0
+
+var ErrQuotaExceeded = errors.New("Storage quota exceeded")
+
+type UsageJSON struct {
+	Bytes   int64 `json:"bytes"`
+	Objects int   `json:"objects"`
+	// Limits are omitted when they are unlimited
+	QuotaBytes   int64 `json:"quotabytes,omitempty"`
+	QuotaObjects int   `json:"quotaobjects,omitempty"`
+}
+
+// quotaBytes returns how many bytes a user may store, or 0 if there is no
+// limit. A user's own quota overrides the server default, and a negative one
+// lifts the limit.
+func quotaBytes(user *User) int64 {
+	if user.QuotaBytes < 0 {
+		return 0
+	}
+	if user.QuotaBytes > 0 {
+		return user.QuotaBytes
+	}
+	return DefaultQuotaBytes
+}
+
+// quotaObjects returns how many objects a user may own, or 0 if there is no
+// limit, in the same way as quotaBytes.
+func quotaObjects(user *User) int {
+	if user.QuotaObjects < 0 {
+		return 0
+	}
+	if user.QuotaObjects > 0 {
+		return user.QuotaObjects
+	}
+	return DefaultQuotaObjects
+}
+
+// setOwnerQuota gives a user or group a quota of its own, overriding the
+// server defaults. Zero limits fall back to the defaults, and negative ones
+// lift the limit.
+func setOwnerQuota(ownerName string, quotaBytes int64, quotaObjects int) error {
+	return MainDB.Update(func(tx *bolt.Tx) error {
+		owner, err := getOwner(tx, ownerName)
+		if err != nil {
+			return err
+		}
+		if owner == nil {
+			return fmt.Errorf("%v does not exist", ownerName)
+		}
+		owner.QuotaBytes = quotaBytes
+		owner.QuotaObjects = quotaObjects
+		return putOwner(tx, owner)
+	})
+}
+
+// chargeObject counts a new object against its owner's quota, returning
+// ErrQuotaExceeded if the owner already has as many as they may. The caller
+// must put owner.
+func chargeObject(owner *User) error {
+	if limit := quotaObjects(owner); limit > 0 && owner.UsedObjects+1 > limit {
+		return ErrQuotaExceeded
+	}
+	owner.UsedObjects++
+	return nil
+}
+
+// chargeBytes counts uploaded data against its owner's quota, returning
+// ErrQuotaExceeded if it doesn't fit. The caller must put owner.
+func chargeBytes(owner *User, size int64) error {
+	if limit := quotaBytes(owner); limit > 0 && owner.UsedBytes+size > limit {
+		return ErrQuotaExceeded
+	}
+	owner.UsedBytes += size
+	return nil
+}
+
+// refundObject takes an object that is being removed off its owner's usage.
+// The caller must put owner.
+func refundObject(owner *User, object *Object) {
+	owner.UsedObjects--
+	owner.UsedBytes -= object.Size
+	if owner.UsedObjects < 0 {
+		owner.UsedObjects = 0
+	}
+	if owner.UsedBytes < 0 {
+		owner.UsedBytes = 0
+	}
+}
+
+// remainingBytes returns how many more bytes an owner may upload, and false if
+// there is no limit.
+func remainingBytes(ownerName string) (int64, bool, error) {
+	var remaining int64
+	limited := false
+	err := MainDB.View(func(tx *bolt.Tx) error {
+		user, err := getOwner(tx, ownerName)
+		if err != nil || user == nil {
+			return err
+		}
+		if limit := quotaBytes(user); limit > 0 {
+			remaining = limit - user.UsedBytes
+			limited = true
+		}
+		return nil
+	})
+	return remaining, limited, err
+}
+
+// writeQuotaExceeded tells a client its upload doesn't fit in its quota.
+func writeQuotaExceeded(res http.ResponseWriter) {
+	res.WriteHeader(http.StatusInsufficientStorage)
+	fmt.Fprintf(res, "%v", ErrQuotaExceeded)
+}
+
+// recordLegacyUploads records the size and upload date of objects uploaded
+// before they were kept on object records, reading them from the blob store
+// outside of any transaction.
+func recordLegacyUploads() error {
+	var legacy []Object
+	err := MainDB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("objects")).ForEach(func(k, v []byte) error {
+			object := Object{}
+			err := json.Unmarshal(v, &object)
+			if err != nil {
+				return err
+			}
+			if object.UploadDate == "" {
+				legacy = append(legacy, object)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	stats := map[int]BlobInfo{}
+	for _, object := range legacy {
+		stat, err := Blobs.Stat(object.LocalFileName)
+		if err == ErrBlobNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		stats[object.ID] = stat
+	}
+	if len(stats) == 0 {
+		return nil
+	}
+
+	return MainDB.Update(func(tx *bolt.Tx) error {
+		for id, stat := range stats {
+			object, err := getObject(tx, id)
+			if err != nil {
+				return err
+			}
+			if object == nil || object.UploadDate != "" {
+				continue
+			}
+			object.Size = stat.Size
+			object.UploadDate = stat.ModTime.UTC().Format("20060102150405")
+			err = putObject(tx, object)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// recountUsage recomputes the usage of every user and group from the objects
+// they own, counting objects stored before usage was tracked and correcting
+// any drift.
+func recountUsage(tx *bolt.Tx) error {
+	var recountedUsers []*User
+	err := tx.Bucket([]byte("users")).ForEach(func(k, v []byte) error {
+		user := User{}
+		err := json.Unmarshal(v, &user)
+		if err != nil {
+			return err
+		}
+		err = recountOwnerUsage(tx, &user)
+		if err != nil {
+			return err
+		}
+		recountedUsers = append(recountedUsers, &user)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var recountedGroups []*Group
+	err = tx.Bucket([]byte("groups")).ForEach(func(k, v []byte) error {
+		group := Group{}
+		err := json.Unmarshal(v, &group)
+		if err != nil {
+			return err
+		}
+		err = recountOwnerUsage(tx, &group.Namespace)
+		if err != nil {
+			return err
+		}
+		recountedGroups = append(recountedGroups, &group)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, user := range recountedUsers {
+		err = putUser(tx, user)
+		if err != nil {
+			return err
+		}
+	}
+	for _, group := range recountedGroups {
+		err = putGroup(tx, group)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recountOwnerUsage recomputes the usage of an owner's record from the objects
+// it indexes.
+func recountOwnerUsage(tx *bolt.Tx, owner *User) error {
+	owner.UsedObjects = 0
+	owner.UsedBytes = 0
+	for _, id := range owner.ObjectIDs {
+		object, err := getObject(tx, id)
+		if err != nil {
+			return err
+		}
+		if object == nil {
+			continue
+		}
+		owner.UsedObjects++
+		owner.UsedBytes += object.Size
+	}
+	return nil
+}
+
+func usageHandler(res http.ResponseWriter, req *http.Request) {
+	requestToken, ok := requiredQueryParam(res, req, "token")
+	if !ok {
+		return
+	}
+
+	// Check and validate token
+	token := validateToken(res, requestToken, ScopeRead)
+	if token == nil {
+		return
+	}
+
+	responseJSON := UsageJSON{}
+	err := MainDB.View(func(tx *bolt.Tx) error {
+		user, err := getUser(tx, token.User.Username)
+		if err != nil {
+			return err
+		}
+		if user == nil {
+			return fmt.Errorf("Owner of token %v does not exist", token.User.Username)
+		}
+
+		responseJSON = UsageJSON{
+			Bytes:        user.UsedBytes,
+			Objects:      user.UsedObjects,
+			QuotaBytes:   quotaBytes(user),
+			QuotaObjects: quotaObjects(user),
+		}
+		return nil
+	})
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error reading usage of user %v: %v", token.User.Username, err)
+		return
+	}
+
+	responseData, err := json.Marshal(responseJSON)
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error marshalling response for client: %v", err)
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.Write(responseData)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func setTestQuota(t *testing.T, username string, quotaBytes int64, quotaObjects int) {
+	err := setOwnerQuota(username, quotaBytes, quotaObjects)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func getTestUsage(t *testing.T, token string) UsageJSON {
+	req, err := http.NewRequest("GET", "/user/usage?token="+token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(usageHandler).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("usage handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	usage := UsageJSON{}
+	err = json.Unmarshal(rr.Body.Bytes(), &usage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return usage
+}
+
+func TestQuota(t *testing.T) {
+	token := createAndAuthUser(t, "quotauser", "foobar")
+	setTestQuota(t, "quotauser", 10, 3)
+
+	uploadTestObject(t, token, "a.txt", []byte("123456"))
+	usage := getTestUsage(t, token)
+	if usage != (UsageJSON{Bytes: 6, Objects: 1, QuotaBytes: 10, QuotaObjects: 3}) {
+		t.Errorf("Wrong usage after upload: %+v", usage)
+	}
+
+	// An upload that doesn't fit is refused, and nothing is charged for it
+	uploadID := createTestObject(t, token, "b.txt")
+	req, err := http.NewRequest("POST", "/object/"+uploadID+"?token="+token, bytes.NewBufferString("too much"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(uploadObjectHandler).ServeHTTP(rr, req)
+	if rr.Code != http.StatusInsufficientStorage {
+		t.Errorf("upload handler returned wrong status code: got %v want %v", rr.Code, http.StatusInsufficientStorage)
+	}
+	if usage := getTestUsage(t, token); usage.Bytes != 6 || usage.Objects != 2 {
+		t.Errorf("Wrong usage after refused upload: %+v", usage)
+	}
+
+	// Resumable uploads are refused too
+	uploadID = createTestObject(t, token, "c.txt")
+	if rr := uploadTestPart(t, token, uploadID, "bytes 0-4/100", []byte("12345")); rr.Code != http.StatusInsufficientStorage {
+		t.Errorf("Expected part of oversized upload to be refused. Got %v", rr.Code)
+	}
+
+	// So is a fourth object
+	createJSON := CreateObjectRequestJSON{Token: token, FileName: "d.txt"}
+	buffer, _ := json.Marshal(createJSON)
+	req, err = http.NewRequest("POST", "/object", bytes.NewBuffer(buffer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(createObjectHandler).ServeHTTP(rr, req)
+	if rr.Code != http.StatusInsufficientStorage {
+		t.Errorf("create handler returned wrong status code: got %v want %v", rr.Code, http.StatusInsufficientStorage)
+	}
+
+	// Deleting frees up room
+	deleteTestObject(t, token, "a.txt")
+	if usage := getTestUsage(t, token); usage.Bytes != 0 || usage.Objects != 2 {
+		t.Errorf("Wrong usage after delete: %+v", usage)
+	}
+	uploadTestObject(t, token, "e.txt", []byte("1234567890"))
+
+	// Counts survive being recomputed
+	err = MainDB.Update(recountUsage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage := getTestUsage(t, token); usage.Bytes != 10 || usage.Objects != 3 {
+		t.Errorf("Wrong usage after recount: %+v", usage)
+	}
+}
+
+func TestUnlimitedQuota(t *testing.T) {
+	token := createAndAuthUser(t, "unlimited", "foobar")
+
+	DefaultQuotaBytes = 1
+	defer func() { DefaultQuotaBytes = 0 }()
+	setTestQuota(t, "unlimited", -1, 0)
+
+	uploadTestObject(t, token, "big.txt", []byte("bigger than the default"))
+	if usage := getTestUsage(t, token); usage.QuotaBytes != 0 || usage.Bytes != 23 {
+		t.Errorf("Wrong usage for unlimited user: %+v", usage)
+	}
+}
+
+func TestSetQuotaOfMissingOwner(t *testing.T) {
+	if err := setOwnerQuota("nobodyatall", 10, 10); err == nil {
+		t.Errorf("Expected setting the quota of a missing user to fail")
+	}
+	if err := setOwnerQuota("group:nosuchgroup", 10, 10); err == nil {
+		t.Errorf("Expected setting the quota of a missing group to fail")
+	}
+}
+
+func TestLegacyUploadsRecorded(t *testing.T) {
+	token := createAndAuthUser(t, "fossil", "foobar")
+	createTestObject(t, token, "ancient.txt")
+
+	// Objects uploaded long ago only have their data, with no size or upload
+	// date on their record
+	var object *Object
+	err := MainDB.View(func(tx *bolt.Tx) error {
+		owner, err := getUser(tx, "fossil")
+		if err != nil {
+			return err
+		}
+		versions, err := findObjectVersions(tx, owner, "ancient.txt")
+		object = versions[0]
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Blobs.Put(object.LocalFileName, bytes.NewReader([]byte("dusty")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = recordLegacyUploads()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = MainDB.Update(recountUsage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage := getTestUsage(t, token); usage.Bytes != 5 || usage.Objects != 1 {
+		t.Errorf("Wrong usage of legacy upload: %+v", usage)
+	}
+	if status, body := getTestObject(t, token, "filename=ancient.txt"); status != http.StatusOK || body != "dusty" {
+		t.Errorf("Expected legacy upload to be served. Got %v: %v", status, body)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimiter hands out a token bucket to each key (a username or an IP
+// address). Each request takes a token from its key's bucket, and buckets
+// refill at a steady rate up to their burst size.
+type RateLimiter struct {
+	mu      sync.Mutex
+	rate    float64 // tokens added per second
+	burst   float64
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Past this many buckets, full ones are forgotten so that a flood of distinct
+// keys can't grow the limiter without bound
+const maxIdleBuckets = 10000
+
+// NewRateLimiter returns a limiter allowing perMinute requests per key each
+// minute, with bursts of up to burst requests.
+func NewRateLimiter(perMinute float64, burst int) *RateLimiter {
+	return &RateLimiter{
+		rate:    perMinute / 60,
+		burst:   float64(burst),
+		buckets: map[string]*tokenBucket{},
+	}
+}
+
+// Allow takes a token from the bucket for key. If the bucket is empty, it
+// returns false and how long until a token will be available.
+func (l *RateLimiter) Allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if len(l.buckets) > maxIdleBuckets {
+		l.forgetFullBuckets(now)
+	}
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = bucket
+	}
+
+	bucket.tokens = math.Min(l.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate)
+	bucket.last = now
+
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+	if l.rate <= 0 {
+		return false, time.Duration(math.MaxInt64)
+	}
+	return false, time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+}
+
+func (l *RateLimiter) forgetFullBuckets(now time.Time) {
+	for key, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Limits on requests to /auth, per username and per client IP address
+var AuthUserLimiter = NewRateLimiter(5, 5)
+var AuthIPLimiter = NewRateLimiter(30, 30)
+
+// Most tokens a user may hold at once before /auth refuses to issue more
+var MaxTokensPerUser = 20
+
+// Signed tokens aren't stored, so they can't be counted like other tokens.
+// Instead, each user is issued at most MaxTokensPerUser of them per
+// SignedTokenLifetime, so they never hold more than twice that many.
+var SignedTokenLimiter = newSignedTokenLimiter()
+
+func newSignedTokenLimiter() *RateLimiter {
+	return NewRateLimiter(float64(MaxTokensPerUser)/SignedTokenLifetime.Minutes(), MaxTokensPerUser)
+}
+
+// clientIP returns the IP address a request came from.
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// writeTooManyRequests tells a client to back off for retryAfter.
+func writeTooManyRequests(res http.ResponseWriter, retryAfter time.Duration) {
+	seconds := int64(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	res.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+	res.WriteHeader(http.StatusTooManyRequests)
+}
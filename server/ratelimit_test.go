@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	limiter := NewRateLimiter(60, 2)
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := limiter.Allow("someone"); !ok {
+			t.Fatalf("Request %v should have been allowed", i)
+		}
+	}
+
+	ok, retryAfter := limiter.Allow("someone")
+	if ok {
+		t.Fatalf("Request beyond the burst should have been refused")
+	}
+	if retryAfter <= 0 || retryAfter > time.Second {
+		t.Errorf("Unexpected retry delay: %v", retryAfter)
+	}
+
+	// Other keys have their own buckets
+	if ok, _ := limiter.Allow("someone else"); !ok {
+		t.Errorf("A different key should have been allowed")
+	}
+}
+
+func authTestRequest(t *testing.T, username string, password string) *httptest.ResponseRecorder {
+	authUserJSON := AuthUserRequestJSON{
+		Username: username,
+		Password: password,
+		ReqDate:  time.Now().UTC().Format("20060102150405"),
+	}
+	buffer, err := json.Marshal(authUserJSON)
+	req, err := http.NewRequest("GET", "/auth", bytes.NewBuffer(buffer))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(authUserHandler).ServeHTTP(rr, req)
+	return rr
+}
+
+func TestAuthUserRateLimited(t *testing.T) {
+	createAndAuthUser(t, "guesser", "foobar")
+
+	oldLimiter := AuthUserLimiter
+	AuthUserLimiter = NewRateLimiter(1, 3)
+	defer func() { AuthUserLimiter = oldLimiter }()
+
+	// Wrong passwords use up the allowance too
+	for i := 0; i < 3; i++ {
+		if rr := authTestRequest(t, "guesser", "wrong"+strconv.Itoa(i)); rr.Code != http.StatusForbidden {
+			t.Fatalf("auth handler returned wrong status code: got %v want %v",
+				rr.Code, http.StatusForbidden)
+		}
+	}
+
+	rr := authTestRequest(t, "guesser", "foobar")
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("auth handler returned wrong status code: got %v want %v",
+			rr.Code, http.StatusTooManyRequests)
+	}
+	if retryAfter, err := strconv.Atoi(rr.Header().Get("Retry-After")); err != nil || retryAfter < 1 {
+		t.Errorf("Unexpected Retry-After: '%v'", rr.Header().Get("Retry-After"))
+	}
+}
+
+func TestAuthUserTokenCap(t *testing.T) {
+	createAndAuthUser(t, "hoarder", "foobar")
+
+	oldMaxTokens := MaxTokensPerUser
+	MaxTokensPerUser = 2
+	defer func() { MaxTokensPerUser = oldMaxTokens }()
+
+	authTestUser(t, "hoarder", "foobar")
+
+	rr := authTestRequest(t, "hoarder", "foobar")
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("auth handler returned wrong status code: got %v want %v",
+			rr.Code, http.StatusTooManyRequests)
+	}
+	if rr.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected a Retry-After header")
+	}
+}
+
+func TestSignedTokenIssuanceLimited(t *testing.T) {
+	createAndAuthUser(t, "stamper", "foobar")
+
+	oldLimiter := SignedTokenLimiter
+	SignedTokenLimiter = NewRateLimiter(0, 2)
+	defer func() { SignedTokenLimiter = oldLimiter }()
+
+	signedTestToken(t, "stamper", "foobar")
+	signedTestToken(t, "stamper", "foobar")
+
+	rr := signedTestRequest(t, "stamper", "foobar", "signed", nil)
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("auth handler returned wrong status code: got %v want %v",
+			rr.Code, http.StatusTooManyRequests)
+	}
+	if rr.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected a Retry-After header")
+	}
+
+	// Legacy tokens are counted instead
+	if rr := authTestRequest(t, "stamper", "foobar"); rr.Code != http.StatusOK {
+		t.Errorf("Expected a legacy token to be issued. Got %v", rr.Code)
+	}
+}
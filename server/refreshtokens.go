@@ -0,0 +1,329 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Refresh tokens
+//
+// Clients that shouldn't keep the user's password around, like mobile apps,
+// can ask /auth for a refresh token along with a short-lived signed access
+// token, and trade the refresh token at /auth/refresh for a new pair whenever
+// the access token runs out. Every refresh token can only be traded once, and
+// the tokens handed out for it belong to the same family as the one it
+// replaces.
+//
+// A refresh token presented after it has been traded must have been copied,
+// and it can't be told whether the client or the copier traded it first, so
+// the whole family is revoked: its refresh tokens are deleted, and the family
+// is put on the revocation list, which rejects every access token issued to it.
+//
+// Refresh tokens are stored in the refreshtokens bucket, keyed by their
+// SHA-256 digest so the database doesn't hold usable tokens.
+
+// How long access tokens issued along with refresh tokens are valid
+var AccessTokenLifetime = time.Hour
+
+// How long a refresh token may go unused before it expires
+var RefreshTokenLifetime = 60 * 24 * time.Hour
+
+const refreshTokenPrefix = "ppr1."
+
+var ErrRefreshTokenReused = errors.New("Refresh token has already been used")
+
+type RefreshTokenRequestJSON struct {
+	RefreshToken string `json:"refreshtoken"`
+}
+
+type RefreshToken struct {
+	Family   string   `json:"family"`
+	Username string   `json:"username"`
+	Epoch    string   `json:"epoch"`
+	Scopes   []string `json:"scopes"`
+	Expires  int64    `json:"exp"`
+	// Device the family's tokens are tied to, if any
+	Device string `json:"device,omitempty"`
+	// Traded tokens are kept until they expire, so reuse can be noticed
+	Used bool `json:"used,omitempty"`
+}
+
+func refreshTokenKey(token string) []byte {
+	digest := sha256.Sum256([]byte(token))
+	return []byte(hex.EncodeToString(digest[:]))
+}
+
+func getRefreshToken(tx *bolt.Tx, token string) (*RefreshToken, error) {
+	data := tx.Bucket([]byte("refreshtokens")).Get(refreshTokenKey(token))
+	if data == nil {
+		return nil, nil
+	}
+	record := RefreshToken{}
+	err := json.Unmarshal(data, &record)
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+func putRefreshToken(tx *bolt.Tx, token string, record *RefreshToken) error {
+	buf, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket([]byte("refreshtokens")).Put(refreshTokenKey(token), buf)
+}
+
+// newRefreshToken stores a new refresh token for user in family, which is
+// started if it is empty, tied to device if one is given.
+func newRefreshToken(tx *bolt.Tx, user *User, scopes []string, family string, device string) (string, *RefreshToken, error) {
+	var err error
+	if family == "" {
+		family, err = randomID()
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	secret := make([]byte, 32)
+	_, err = rand.Read(secret)
+	if err != nil {
+		return "", nil, err
+	}
+	token := refreshTokenPrefix + base64.RawURLEncoding.EncodeToString(secret)
+
+	record := RefreshToken{
+		Family:   family,
+		Username: user.Username,
+		Epoch:    user.TokenEpoch,
+		Scopes:   scopes,
+		Expires:  time.Now().UTC().Add(RefreshTokenLifetime).Unix(),
+		Device:   device,
+	}
+	err = putRefreshToken(tx, token, &record)
+	if err != nil {
+		return "", nil, err
+	}
+	return token, &record, nil
+}
+
+// countRefreshFamilies counts the families of refresh tokens a user holds,
+// and returns when the first of them expires. A family is held as long as its
+// latest refresh token is unused, unexpired and from the user's current epoch.
+func countRefreshFamilies(tx *bolt.Tx, user *User) (int, time.Time, error) {
+	count := 0
+	var nextExpiry time.Time
+	now := time.Now().UTC()
+	err := tx.Bucket([]byte("refreshtokens")).ForEach(func(k, v []byte) error {
+		record := RefreshToken{}
+		err := json.Unmarshal(v, &record)
+		if err != nil {
+			return err
+		}
+		if record.Username != user.Username || record.Epoch != user.TokenEpoch || record.Used {
+			return nil
+		}
+		expires := time.Unix(record.Expires, 0).UTC()
+		if !expires.After(now) {
+			return nil
+		}
+
+		count++
+		if nextExpiry.IsZero() || expires.Before(nextExpiry) {
+			nextExpiry = expires
+		}
+		return nil
+	})
+	return count, nextExpiry, err
+}
+
+// deleteRefreshTokens deletes the refresh tokens for which match returns
+// true, returning how many were deleted.
+func deleteRefreshTokens(tx *bolt.Tx, match func(*RefreshToken) bool) (int, error) {
+	b := tx.Bucket([]byte("refreshtokens"))
+	var matched [][]byte
+	err := b.ForEach(func(k, v []byte) error {
+		record := RefreshToken{}
+		err := json.Unmarshal(v, &record)
+		if err != nil {
+			return err
+		}
+		if match(&record) {
+			matched = append(matched, k)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, k := range matched {
+		err = b.Delete(k)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(matched), nil
+}
+
+// revokeTokenFamily deletes the refresh tokens of a family and puts the family
+// on the revocation list for as long as any access token issued to it can
+// last. It returns when the entry expires; once the transaction commits, the
+// caller must call setRevokedToken.
+func revokeTokenFamily(tx *bolt.Tx, family string) (int64, error) {
+	_, err := deleteRefreshTokens(tx, func(record *RefreshToken) bool {
+		return record.Family == family
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	expires := time.Now().UTC().Add(AccessTokenLifetime).Unix()
+	return expires, putRevokedToken(tx, family, expires)
+}
+
+// tradeRefreshToken exchanges a refresh token for a new one in the same
+// family, returning the new token along with the user it was issued to. If
+// the token was already traded, the family is revoked and
+// ErrRefreshTokenReused is returned.
+func tradeRefreshToken(token string) (string, *RefreshToken, *User, error) {
+	var newToken string
+	var newRecord *RefreshToken
+	var user *User
+	var reused *RefreshToken
+	var revokedUntil int64
+	err := MainDB.Update(func(tx *bolt.Tx) error {
+		record, err := getRefreshToken(tx, token)
+		if err != nil {
+			return err
+		}
+		if record == nil {
+			return ErrTokenInvalid
+		}
+
+		if record.Used {
+			reused = record
+			revokedUntil, err = revokeTokenFamily(tx, record.Family)
+			return err
+		}
+		if time.Now().UTC().Unix() >= record.Expires {
+			return ErrTokenExpired
+		}
+
+		// Revoking all of a user's tokens revokes their refresh tokens too
+		user, err = getUser(tx, record.Username)
+		if err != nil {
+			return err
+		}
+		if user == nil || user.TokenEpoch != record.Epoch {
+			return ErrTokenRevoked
+		}
+
+		record.Used = true
+		err = putRefreshToken(tx, token, record)
+		if err != nil {
+			return err
+		}
+		newToken, newRecord, err = newRefreshToken(tx, user, record.Scopes, record.Family, record.Device)
+		return err
+	})
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	if reused != nil {
+		setRevokedToken(reused.Family, revokedUntil)
+		log.Printf("Refresh token of user %v was reused, revoked token family %v", reused.Username, reused.Family)
+		return "", nil, nil, ErrRefreshTokenReused
+	}
+	return newToken, newRecord, user, nil
+}
+
+// sweepRefreshTokens deletes expired refresh tokens, returning how many were
+// deleted.
+func sweepRefreshTokens(tx *bolt.Tx, now time.Time) (int, error) {
+	return deleteRefreshTokens(tx, func(record *RefreshToken) bool {
+		return record.Expires <= now.Unix()
+	})
+}
+
+// writeTokenPair sends a signed access token issued to a refresh token family
+// back to the client, along with the family's latest refresh token.
+func writeTokenPair(res http.ResponseWriter, user *User, refreshToken string, record *RefreshToken) {
+	accessToken, claims, err := issueSignedToken(user, record.Scopes, record.Family, record.Device)
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error issuing signed token to user %v: %v", user.Username, err)
+		return
+	}
+
+	responseJSON := AuthUserResponseJSON{
+		ExpirationDate:        time.Unix(claims.Expires, 0).UTC().Format("20060102150405"),
+		Token:                 accessToken,
+		Scopes:                claims.Scopes,
+		RefreshToken:          refreshToken,
+		RefreshExpirationDate: time.Unix(record.Expires, 0).UTC().Format("20060102150405"),
+	}
+	responseData, err := json.Marshal(responseJSON)
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error marshalling response for client: %v", err)
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.Write(responseData)
+	log.Printf("Signed token %v has been issued to user %v in token family %v", claims.ID, user.Username, record.Family)
+}
+
+func refreshTokenHandler(res http.ResponseWriter, req *http.Request) {
+	requestJSON := RefreshTokenRequestJSON{}
+	err := json.NewDecoder(req.Body).Decode(&requestJSON)
+	if err != nil || requestJSON.RefreshToken == "" {
+		res.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(res, "Error in decoding message")
+		return
+	}
+
+	// Refreshing is cheap for clients, so it counts towards the same limit
+	// as authenticating
+	if ok, retryAfter := AuthIPLimiter.Allow(clientIP(req)); !ok {
+		writeTooManyRequests(res, retryAfter)
+		fmt.Fprintf(res, "Too many authentication requests from this address")
+		log.Printf("Rate limited authentication requests from %v", clientIP(req))
+		return
+	}
+
+	refreshToken, record, user, err := tradeRefreshToken(requestJSON.RefreshToken)
+	switch err {
+	case nil:
+	case ErrTokenExpired:
+		res.WriteHeader(http.StatusPreconditionFailed)
+		fmt.Fprintf(res, "Refresh token is expired.")
+		return
+	case ErrRefreshTokenReused:
+		res.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(res, "Refresh token has already been used. Every token issued along with it has been revoked.")
+		return
+	case ErrTokenInvalid, ErrTokenRevoked:
+		res.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(res, "Refresh token is not a valid token")
+		return
+	default:
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error refreshing token: %v", err)
+		return
+	}
+
+	writeTokenPair(res, user, refreshToken, record)
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// refreshTestTokens authenticates an existing user, asking for a refresh
+// token, and returns the response.
+func refreshTestTokens(t *testing.T, username string, password string, scopes ...string) AuthUserResponseJSON {
+	authUserJSON := AuthUserRequestJSON{
+		Username: username,
+		Password: password,
+		ReqDate:  time.Now().UTC().Format("20060102150405"),
+		Scopes:   scopes,
+		Refresh:  true,
+	}
+	buffer, err := json.Marshal(authUserJSON)
+	req, err := http.NewRequest("GET", "/auth", bytes.NewBuffer(buffer))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(authUserHandler).ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("auth handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+
+	response := AuthUserResponseJSON{}
+	err = json.NewDecoder(rr.Body).Decode(&response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isSignedToken(response.Token) || !strings.HasPrefix(response.RefreshToken, refreshTokenPrefix) {
+		t.Fatalf("Expected an access token and a refresh token. Got %+v", response)
+	}
+	return response
+}
+
+func refreshTestRequest(t *testing.T, refreshToken string) (*httptest.ResponseRecorder, AuthUserResponseJSON) {
+	refreshJSON := RefreshTokenRequestJSON{RefreshToken: refreshToken}
+	buffer, _ := json.Marshal(refreshJSON)
+	req, err := http.NewRequest("POST", "/auth/refresh", bytes.NewBuffer(buffer))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(refreshTokenHandler).ServeHTTP(rr, req)
+
+	response := AuthUserResponseJSON{}
+	if rr.Code == http.StatusOK {
+		err = json.Unmarshal(rr.Body.Bytes(), &response)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rr, response
+}
+
+func TestRefreshTokens(t *testing.T) {
+	createAndAuthUser(t, "mobile", "foobar")
+	first := refreshTestTokens(t, "mobile", "foobar", ScopeRead)
+
+	// Access tokens are short-lived and keep the scopes they were asked for
+	expires, err := time.Parse("20060102150405", first.ExpirationDate)
+	if err != nil || expires.After(time.Now().UTC().Add(AccessTokenLifetime)) {
+		t.Errorf("Expected a short-lived access token. Got %v", first.ExpirationDate)
+	}
+	if status, body := getTestObject(t, first.Token, "filename=anything"); !strings.HasPrefix(body, "Failed to find object") {
+		t.Errorf("Expected access token to work. Got %v: %v", status, body)
+	}
+
+	rr, second := refreshTestRequest(t, first.RefreshToken)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("refresh handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if second.RefreshToken == first.RefreshToken || len(second.Scopes) != 1 || second.Scopes[0] != ScopeRead {
+		t.Errorf("Expected a new refresh token with the same scopes. Got %+v", second)
+	}
+	for _, valid := range []string{first.Token, second.Token} {
+		if status, body := getTestObject(t, valid, "filename=anything"); !strings.HasPrefix(body, "Failed to find object") {
+			t.Errorf("Expected access token to work. Got %v: %v", status, body)
+		}
+	}
+
+	// Trading a refresh token twice revokes the whole family
+	if rr, _ := refreshTestRequest(t, first.RefreshToken); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected reused refresh token to be refused. Got %v", rr.Code)
+	}
+	if rr, _ := refreshTestRequest(t, second.RefreshToken); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected family's refresh token to be revoked. Got %v", rr.Code)
+	}
+	for _, revoked := range []string{first.Token, second.Token} {
+		if status, _ := getTestObject(t, revoked, "filename=anything"); status != http.StatusNotFound {
+			t.Errorf("Expected family's access token to be revoked. Got %v", status)
+		}
+	}
+
+	// Other families are unaffected
+	other := refreshTestTokens(t, "mobile", "foobar")
+	if rr, _ := refreshTestRequest(t, other.RefreshToken); rr.Code != http.StatusOK {
+		t.Errorf("Expected other family to keep working. Got %v", rr.Code)
+	}
+
+	if rr, _ := refreshTestRequest(t, "ppr1.bogus"); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected unknown refresh token to be refused. Got %v", rr.Code)
+	}
+}
+
+func TestRefreshTokenLogout(t *testing.T) {
+	createAndAuthUser(t, "loggingout", "foobar")
+	tokens := refreshTestTokens(t, "loggingout", "foobar")
+
+	req, err := http.NewRequest("DELETE", "/auth?token="+tokens.Token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(revokeTokenHandler).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("revoke handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	if rr, _ := refreshTestRequest(t, tokens.RefreshToken); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected refresh token to be revoked along with its access token. Got %v", rr.Code)
+	}
+}
+
+func TestRefreshTokenRevokeAll(t *testing.T) {
+	legacyToken := createAndAuthUser(t, "lostphone", "foobar")
+	tokens := refreshTestTokens(t, "lostphone", "foobar")
+
+	revokeJSON := RevokeAllTokensRequestJSON{Token: legacyToken}
+	buffer, _ := json.Marshal(revokeJSON)
+	req, err := http.NewRequest("POST", "/auth/revoke-all", bytes.NewBuffer(buffer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(revokeAllTokensHandler).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("revoke-all handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	if rr, _ := refreshTestRequest(t, tokens.RefreshToken); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected refresh token to be revoked. Got %v", rr.Code)
+	}
+}
+
+func TestRefreshTokenExpired(t *testing.T) {
+	createAndAuthUser(t, "dormant", "foobar")
+
+	oldLifetime := RefreshTokenLifetime
+	RefreshTokenLifetime = -time.Minute
+	defer func() { RefreshTokenLifetime = oldLifetime }()
+
+	tokens := refreshTestTokens(t, "dormant", "foobar")
+	if rr, _ := refreshTestRequest(t, tokens.RefreshToken); rr.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected expired refresh token to be refused. Got %v", rr.Code)
+	}
+
+	// The janitor cleans it up
+	result, err := sweep()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Tokens < 1 {
+		t.Errorf("Expected expired refresh token to be swept. Got %+v", result)
+	}
+	if rr, _ := refreshTestRequest(t, tokens.RefreshToken); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected swept refresh token to be unknown. Got %v", rr.Code)
+	}
+}
+
+func TestRefreshTokenFamilyCap(t *testing.T) {
+	createAndAuthUser(t, "collector", "foobar")
+
+	oldMaxTokens := MaxTokensPerUser
+	MaxTokensPerUser = 3
+	defer func() { MaxTokensPerUser = oldMaxTokens }()
+
+	// The legacy token and two families add up to the limit
+	first := refreshTestTokens(t, "collector", "foobar")
+	refreshTestTokens(t, "collector", "foobar")
+
+	authUserJSON := AuthUserRequestJSON{
+		Username: "collector",
+		Password: "foobar",
+		ReqDate:  time.Now().UTC().Format("20060102150405"),
+		Refresh:  true,
+	}
+	buffer, _ := json.Marshal(authUserJSON)
+	req, err := http.NewRequest("GET", "/auth", bytes.NewBuffer(buffer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(authUserHandler).ServeHTTP(rr, req)
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected another refresh token to be refused. Got %v", rr.Code)
+	}
+	if rr.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected a Retry-After header")
+	}
+	if rr := authTestRequest(t, "collector", "foobar"); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected another legacy token to be refused. Got %v", rr.Code)
+	}
+
+	// Trading a refresh token keeps its family, so it isn't refused
+	if rr, _ := refreshTestRequest(t, first.RefreshToken); rr.Code != http.StatusOK {
+		t.Errorf("Expected refresh token to be traded. Got %v", rr.Code)
+	}
+}
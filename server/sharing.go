@@ -0,0 +1,435 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/boltdb/bolt"
+)
+
+// Sharing objects
+//
+// An object's owner may grant other users read or write access to it. Grants
+// are kept on every version of the object, and new versions inherit them, so
+// access is always decided by the latest version. Users with read access can
+// download the object and list its versions; users with write access can also
+// upload new versions, restore old ones and delete it. New versions uploaded by
+// other users belong to the owner and count towards the owner's quota. Only the
+// owner may change who the object is shared with.
+//
+// Requests for an object shared by another user name its owner along with its
+// filename. Users without access are told the object doesn't exist, so they
+// can't find out which filenames others use.
+//
+// The shares bucket indexes grants by the user they were granted to, holding a
+// bucket per user that maps each object shared with them to a SharedObject.
+
+const (
+	PermissionRead  = "read"
+	PermissionWrite = "write"
+)
+
+var (
+	ErrObjectNotShared = errors.New("Object is not shared with this user")
+	ErrWriteNotGranted = errors.New("Object is shared read-only")
+)
+
+type Grant struct {
+	Username   string `json:"username"`
+	Permission string `json:"permission"`
+}
+
+type ShareObjectRequestJSON struct {
+	Token      string `json:"token"`
+	FileName   string `json:"filename"`
+	Username   string `json:"username"`
+	Permission string `json:"permission"`
+}
+
+type SharedObject struct {
+	Owner      string `json:"owner"`
+	FileName   string `json:"filename"`
+	Permission string `json:"permission"`
+}
+
+type SharedObjectInfoJSON struct {
+	ObjectInfoJSON
+	Owner      string `json:"owner"`
+	Permission string `json:"permission"`
+}
+
+func sharedObjectKey(owner string, filename string) []byte {
+	return []byte(owner + "\n" + filename)
+}
+
+// grantedPermission returns the permission an object grants a user, or "" if
+// it isn't shared with them.
+func grantedPermission(object *Object, username string) string {
+	for _, grant := range object.Grants {
+		if grant.Username == username {
+			return grant.Permission
+		}
+	}
+	return ""
+}
+
+// permits reports whether a granted permission allows what is asked for.
+// Write access includes read access.
+func permits(granted string, permission string) bool {
+	return granted == PermissionWrite || (granted != "" && granted == permission)
+}
+
+// requestedOwner returns the owner of the object a request is for: the one it
+// names, or the user making it.
+func requestedOwner(owner string, token *Token) string {
+	if owner == "" {
+		return token.User.Username
+	}
+	return owner
+}
+
+// findAccessibleVersions returns the owner of an object along with every
+// version of it, oldest first, provided username may access it with
+// permission. Users always have full access to their own objects, and access
+// to a group's objects depends on their role in the group, as decided by
+// findAccessibleOwner. Otherwise ErrObjectNotShared is returned if the object
+// doesn't exist or isn't shared with username, and ErrWriteNotGranted if it is
+// only shared for reading. The name is looked up as a path, so a leading slash
+// makes no difference.
+func findAccessibleVersions(tx *bolt.Tx, username string, ownerName string, name string, permission string) (*User, []*Object, error) {
+	name = objectPath(name)
+	if ownerName == username || isGroupOwner(ownerName) {
+		owner, err := findAccessibleOwner(tx, username, ownerName, permission)
+		if err != nil {
+			return nil, nil, err
+		}
+		versions, err := findObjectVersions(tx, owner, name)
+		return owner, versions, err
+	}
+
+	owner, err := getUser(tx, ownerName)
+	if err != nil {
+		return nil, nil, err
+	}
+	if owner == nil {
+		return nil, nil, ErrObjectNotShared
+	}
+	versions, err := findObjectVersions(tx, owner, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(versions) == 0 {
+		return nil, nil, ErrObjectNotShared
+	}
+
+	granted := grantedPermission(versions[len(versions)-1], username)
+	if granted == "" {
+		return nil, nil, ErrObjectNotShared
+	}
+	if !permits(granted, permission) {
+		return nil, nil, ErrWriteNotGranted
+	}
+	return owner, versions, nil
+}
+
+// writeAccessError tells the client why it can't access an object, returning
+// false if err isn't one of the errors of findAccessibleVersions.
+func writeAccessError(res http.ResponseWriter, err error, ownerName string, filename string) bool {
+	switch err {
+	case ErrObjectNotShared:
+		res.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(res, "Failed to find object with filename %v belonging to user %v", filename, ownerName)
+		return true
+	case ErrWriteNotGranted:
+		res.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(res, "Object with filename %v belonging to user %v is shared read-only", filename, ownerName)
+		return true
+	}
+	return false
+}
+
+// setGrant grants username permission on every version of an object, or
+// revokes their access if permission is empty, and updates the shares index to
+// match.
+func setGrant(tx *bolt.Tx, owner *User, versions []*Object, username string, permission string) error {
+	for _, object := range versions {
+		grants := []Grant{}
+		for _, grant := range object.Grants {
+			if grant.Username != username {
+				grants = append(grants, grant)
+			}
+		}
+		if permission != "" {
+			grants = append(grants, Grant{Username: username, Permission: permission})
+		}
+		object.Grants = grants
+		err := putObject(tx, object)
+		if err != nil {
+			return err
+		}
+	}
+
+	filename := versions[0].Name
+	if permission == "" {
+		return forgetGrants(tx, owner.Username, filename, []Grant{{Username: username}})
+	}
+	return indexGrants(tx, owner.Username, filename, []Grant{{Username: username, Permission: permission}})
+}
+
+// indexGrants adds an object to the shares index of the users it is shared
+// with.
+func indexGrants(tx *bolt.Tx, owner string, filename string, grants []Grant) error {
+	for _, grant := range grants {
+		buf, err := json.Marshal(SharedObject{Owner: owner, FileName: filename, Permission: grant.Permission})
+		if err != nil {
+			return err
+		}
+		userShares, err := tx.Bucket([]byte("shares")).CreateBucketIfNotExists([]byte(grant.Username))
+		if err != nil {
+			return err
+		}
+		err = userShares.Put(sharedObjectKey(owner, filename), buf)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// forgetGrants removes an object from the shares index of the users it was
+// shared with, once the object is gone.
+func forgetGrants(tx *bolt.Tx, owner string, filename string, grants []Grant) error {
+	for _, grant := range grants {
+		userShares := tx.Bucket([]byte("shares")).Bucket([]byte(grant.Username))
+		if userShares == nil {
+			continue
+		}
+		err := userShares.Delete(sharedObjectKey(owner, filename))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteUserShares revokes every grant made to a user, so that a user later
+// registered under the same name doesn't inherit them.
+func deleteUserShares(tx *bolt.Tx, username string) error {
+	userShares := tx.Bucket([]byte("shares")).Bucket([]byte(username))
+	if userShares == nil {
+		return nil
+	}
+
+	var shared []SharedObject
+	err := userShares.ForEach(func(k, v []byte) error {
+		sharedObject := SharedObject{}
+		err := json.Unmarshal(v, &sharedObject)
+		if err != nil {
+			return err
+		}
+		shared = append(shared, sharedObject)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, sharedObject := range shared {
+		owner, err := getUser(tx, sharedObject.Owner)
+		if err != nil {
+			return err
+		}
+		if owner == nil {
+			continue
+		}
+		versions, err := findObjectVersions(tx, owner, sharedObject.FileName)
+		if err != nil {
+			return err
+		}
+		if len(versions) > 0 {
+			err = setGrant(tx, owner, versions, username, "")
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Bucket([]byte("shares")).DeleteBucket([]byte(username))
+}
+
+func shareObjectHandler(res http.ResponseWriter, req *http.Request) {
+	requestJSON := ShareObjectRequestJSON{}
+	err := json.NewDecoder(req.Body).Decode(&requestJSON)
+	if err != nil || requestJSON.FileName == "" || requestJSON.Username == "" {
+		res.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(res, "Error in decoding message")
+		return
+	}
+	if requestJSON.Permission != PermissionRead && requestJSON.Permission != PermissionWrite {
+		res.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(res, "Parameter 'permission' must be '%v' or '%v'", PermissionRead, PermissionWrite)
+		return
+	}
+
+	// Check and validate token
+	token := validateToken(res, requestJSON.Token, ScopeWrite)
+	if token == nil {
+		return
+	}
+	if requestJSON.Username == token.User.Username {
+		res.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(res, "Objects can't be shared with their owner")
+		return
+	}
+
+	found := false
+	granteeExists := false
+	err = MainDB.Update(func(tx *bolt.Tx) error {
+		owner, versions, err := findAccessibleVersions(tx, token.User.Username, token.User.Username, requestJSON.FileName, PermissionWrite)
+		if err != nil || len(versions) == 0 {
+			return err
+		}
+		found = true
+
+		grantee, err := getUser(tx, requestJSON.Username)
+		if err != nil || grantee == nil {
+			return err
+		}
+		granteeExists = true
+		return setGrant(tx, owner, versions, grantee.Username, requestJSON.Permission)
+	})
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error sharing object %v of user %v: %v", requestJSON.FileName, token.User.Username, err)
+		return
+	}
+	if !found {
+		res.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(res, "Failed to find object with filename %v belonging to user %v", requestJSON.FileName, token.User.Username)
+		return
+	}
+	if !granteeExists {
+		res.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(res, "User %v does not exist", requestJSON.Username)
+		return
+	}
+	log.Printf("Object %v of user %v has been shared with user %v for %v", requestJSON.FileName, token.User.Username, requestJSON.Username, requestJSON.Permission)
+}
+
+func unshareObjectHandler(res http.ResponseWriter, req *http.Request) {
+	requestToken, ok := requiredQueryParam(res, req, "token")
+	if !ok {
+		return
+	}
+	requestFileName, ok := requiredQueryParam(res, req, "filename")
+	if !ok {
+		return
+	}
+	requestUsername, ok := requiredQueryParam(res, req, "username")
+	if !ok {
+		return
+	}
+
+	// Check and validate token
+	token := validateToken(res, requestToken, ScopeWrite)
+	if token == nil {
+		return
+	}
+
+	found := false
+	shared := false
+	err := MainDB.Update(func(tx *bolt.Tx) error {
+		owner, versions, err := findAccessibleVersions(tx, token.User.Username, token.User.Username, requestFileName, PermissionWrite)
+		if err != nil || len(versions) == 0 {
+			return err
+		}
+		found = true
+
+		if grantedPermission(versions[len(versions)-1], requestUsername) == "" {
+			return nil
+		}
+		shared = true
+		return setGrant(tx, owner, versions, requestUsername, "")
+	})
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error unsharing object %v of user %v: %v", requestFileName, token.User.Username, err)
+		return
+	}
+	if !found {
+		res.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(res, "Failed to find object with filename %v belonging to user %v", requestFileName, token.User.Username)
+		return
+	}
+	if !shared {
+		res.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(res, "Object with filename %v is not shared with user %v", requestFileName, requestUsername)
+		return
+	}
+	log.Printf("Object %v of user %v is no longer shared with user %v", requestFileName, token.User.Username, requestUsername)
+}
+
+func listSharedObjectsHandler(res http.ResponseWriter, req *http.Request) {
+	requestToken, ok := requiredQueryParam(res, req, "token")
+	if !ok {
+		return
+	}
+
+	// Check and validate token
+	token := validateToken(res, requestToken, ScopeRead)
+	if token == nil {
+		return
+	}
+
+	responseJSON := []SharedObjectInfoJSON{}
+	err := MainDB.View(func(tx *bolt.Tx) error {
+		userShares := tx.Bucket([]byte("shares")).Bucket([]byte(token.User.Username))
+		if userShares == nil {
+			return nil
+		}
+		return userShares.ForEach(func(k, v []byte) error {
+			sharedObject := SharedObject{}
+			err := json.Unmarshal(v, &sharedObject)
+			if err != nil {
+				return err
+			}
+
+			_, versions, err := findAccessibleVersions(tx, token.User.Username, sharedObject.Owner, sharedObject.FileName, PermissionRead)
+			if err == ErrObjectNotShared {
+				log.Printf("User %v has a dangling share of object %v of user %v", token.User.Username, sharedObject.FileName, sharedObject.Owner)
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			info := objectInfo(latestVersion(versions))
+			info.Versions = len(versions)
+			// Who else the object is shared with is only the owner's business
+			info.Grants = nil
+			responseJSON = append(responseJSON, SharedObjectInfoJSON{
+				ObjectInfoJSON: info,
+				Owner:          sharedObject.Owner,
+				Permission:     grantedPermission(versions[len(versions)-1], token.User.Username),
+			})
+			return nil
+		})
+	})
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error listing objects shared with user %v: %v", token.User.Username, err)
+		return
+	}
+
+	responseData, err := json.Marshal(responseJSON)
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error marshalling response for client: %v", err)
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.Write(responseData)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func shareTestObject(t *testing.T, token string, filename string, username string, permission string) int {
+	shareJSON := ShareObjectRequestJSON{Token: token, FileName: filename, Username: username, Permission: permission}
+	buffer, _ := json.Marshal(shareJSON)
+	req, err := http.NewRequest("POST", "/object/share", bytes.NewBuffer(buffer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(shareObjectHandler).ServeHTTP(rr, req)
+	return rr.Code
+}
+
+func unshareTestObject(t *testing.T, token string, filename string, username string) int {
+	req, err := http.NewRequest("DELETE", "/object/share?token="+token+"&filename="+filename+"&username="+username, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(unshareObjectHandler).ServeHTTP(rr, req)
+	return rr.Code
+}
+
+func listTestSharedObjects(t *testing.T, token string) []SharedObjectInfoJSON {
+	req, err := http.NewRequest("GET", "/objects/shared?token="+token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(listSharedObjectsHandler).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("shared list handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	shared := []SharedObjectInfoJSON{}
+	err = json.Unmarshal(rr.Body.Bytes(), &shared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return shared
+}
+
+// createSharedTestObject creates a new version of an object shared by owner,
+// returning the status code and the UploadID if it succeeded.
+func createSharedTestObject(t *testing.T, token string, owner string, filename string) (int, string) {
+	createObjectJSON := CreateObjectRequestJSON{Token: token, FileName: filename, Owner: owner}
+	buffer, _ := json.Marshal(createObjectJSON)
+	req, err := http.NewRequest("POST", "/object", bytes.NewBuffer(buffer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(createObjectHandler).ServeHTTP(rr, req)
+	return rr.Code, rr.Body.String()
+}
+
+func uploadTestData(t *testing.T, token string, uploadID string, data []byte) int {
+	req, err := http.NewRequest("POST", "/object/"+uploadID+"?token="+token, bytes.NewBuffer(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(uploadObjectHandler).ServeHTTP(rr, req)
+	return rr.Code
+}
+
+func deleteSharedTestObject(t *testing.T, token string, owner string, filename string) int {
+	req, err := http.NewRequest("DELETE", "/object?token="+token+"&owner="+owner+"&filename="+filename, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(deleteObjectHandler).ServeHTTP(rr, req)
+	return rr.Code
+}
+
+func TestShareObject(t *testing.T) {
+	ownerToken := createAndAuthUser(t, "sharer", "foobar")
+	teammateToken := createAndAuthUser(t, "teammate", "foobar")
+	outsiderToken := createAndAuthUser(t, "outsider", "foobar")
+	uploadTestObject(t, ownerToken, "report.txt", []byte("first draft"))
+
+	// Nobody else can see the object until it is shared
+	if status, _ := getTestObject(t, teammateToken, "owner=sharer&filename=report.txt"); status != http.StatusNotFound {
+		t.Errorf("Expected unshared object to be hidden. Got %v", status)
+	}
+
+	for _, invalid := range []struct {
+		filename, username, permission string
+		status                         int
+	}{
+		{"report.txt", "teammate", "admin", http.StatusBadRequest},
+		{"report.txt", "sharer", "read", http.StatusBadRequest},
+		{"report.txt", "nobody", "read", http.StatusNotFound},
+		{"missing.txt", "teammate", "read", http.StatusNotFound},
+	} {
+		if status := shareTestObject(t, ownerToken, invalid.filename, invalid.username, invalid.permission); status != invalid.status {
+			t.Errorf("Expected sharing %+v to fail with %v. Got %v", invalid, invalid.status, status)
+		}
+	}
+
+	// Read access allows downloading, but not changing the object
+	if status := shareTestObject(t, ownerToken, "report.txt", "teammate", "read"); status != http.StatusOK {
+		t.Fatalf("share handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	if status, body := getTestObject(t, teammateToken, "owner=sharer&filename=report.txt"); status != http.StatusOK || body != "first draft" {
+		t.Errorf("Expected shared object to be readable. Got %v: %v", status, body)
+	}
+	if status, _ := getTestObject(t, outsiderToken, "owner=sharer&filename=report.txt"); status != http.StatusNotFound {
+		t.Errorf("Expected object to stay hidden from others. Got %v", status)
+	}
+	if status, _ := createSharedTestObject(t, teammateToken, "sharer", "report.txt"); status != http.StatusForbidden {
+		t.Errorf("Expected read-only object to refuse new versions. Got %v", status)
+	}
+	if status := deleteSharedTestObject(t, teammateToken, "sharer", "report.txt"); status != http.StatusForbidden {
+		t.Errorf("Expected read-only object to refuse deletion. Got %v", status)
+	}
+	if status := shareTestObject(t, teammateToken, "report.txt", "outsider", "read"); status != http.StatusNotFound {
+		t.Errorf("Expected only the owner to be able to share. Got %v", status)
+	}
+
+	shared := listTestSharedObjects(t, teammateToken)
+	if len(shared) != 1 || shared[0].Owner != "sharer" || shared[0].Name != "report.txt" || shared[0].Permission != "read" || shared[0].Grants != nil {
+		t.Errorf("Unexpected shared objects %+v", shared)
+	}
+
+	// Write access allows new versions, which belong to the owner
+	if status := shareTestObject(t, ownerToken, "report.txt", "teammate", "write"); status != http.StatusOK {
+		t.Fatalf("share handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	status, uploadID := createSharedTestObject(t, teammateToken, "sharer", "report.txt")
+	if status != http.StatusOK {
+		t.Fatalf("object creator handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	if status := uploadTestData(t, teammateToken, uploadID, []byte("second draft")); status != http.StatusOK {
+		t.Fatalf("object upload handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	if status, body := getTestObject(t, ownerToken, "filename=report.txt"); status != http.StatusOK || body != "second draft" {
+		t.Errorf("Expected the owner to get the new version. Got %v: %v", status, body)
+	}
+	if status, _ := createSharedTestObject(t, teammateToken, "sharer", "new.txt"); status != http.StatusNotFound {
+		t.Errorf("Expected new objects not to be created for the owner. Got %v", status)
+	}
+
+	// Revoking access also stops uploads already under way
+	status, uploadID = createSharedTestObject(t, teammateToken, "sharer", "report.txt")
+	if status != http.StatusOK {
+		t.Fatalf("object creator handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	if status := unshareTestObject(t, ownerToken, "report.txt", "teammate"); status != http.StatusOK {
+		t.Fatalf("unshare handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	if status := uploadTestData(t, teammateToken, uploadID, []byte("third draft")); status != http.StatusNotFound {
+		t.Errorf("Expected upload to be refused once access was revoked. Got %v", status)
+	}
+	if status, _ := getTestObject(t, teammateToken, "owner=sharer&filename=report.txt"); status != http.StatusNotFound {
+		t.Errorf("Expected unshared object to be hidden. Got %v", status)
+	}
+	if status := unshareTestObject(t, ownerToken, "report.txt", "teammate"); status != http.StatusNotFound {
+		t.Errorf("Expected unsharing twice to fail. Got %v", status)
+	}
+	if shared := listTestSharedObjects(t, teammateToken); len(shared) != 0 {
+		t.Errorf("Expected nothing to be shared. Got %+v", shared)
+	}
+
+	// Users with write access may delete the object
+	if status := shareTestObject(t, ownerToken, "report.txt", "teammate", "write"); status != http.StatusOK {
+		t.Fatalf("share handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	if status := deleteSharedTestObject(t, teammateToken, "sharer", "report.txt"); status != http.StatusOK {
+		t.Fatalf("delete handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	if status, _ := getTestObject(t, ownerToken, "filename=report.txt"); status != http.StatusNotFound {
+		t.Errorf("Expected shared object to be deleted. Got %v", status)
+	}
+	if shared := listTestSharedObjects(t, teammateToken); len(shared) != 0 {
+		t.Errorf("Expected deleted object not to be listed. Got %+v", shared)
+	}
+}
+
+func TestShareObjectDeletedUser(t *testing.T) {
+	ownerToken := createAndAuthUser(t, "lender", "foobar")
+	borrowerToken := createAndAuthUser(t, "borrower", "foobar")
+	uploadTestObject(t, ownerToken, "book.txt", []byte("chapter one"))
+	if status := shareTestObject(t, ownerToken, "book.txt", "borrower", "read"); status != http.StatusOK {
+		t.Fatalf("share handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	// Someone registering a deleted user's name doesn't inherit their access
+	if status := deleteTestUser(t, borrowerToken, "foobar"); status != http.StatusOK {
+		t.Fatalf("delete user handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	newBorrowerToken := createAndAuthUser(t, "borrower", "foobar")
+	if status, _ := getTestObject(t, newBorrowerToken, "owner=lender&filename=book.txt"); status != http.StatusNotFound {
+		t.Errorf("Expected access to be revoked along with the user. Got %v", status)
+	}
+	if shared := listTestSharedObjects(t, newBorrowerToken); len(shared) != 0 {
+		t.Errorf("Expected nothing to be shared. Got %+v", shared)
+	}
+}
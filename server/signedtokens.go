@@ -0,0 +1,479 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Signed tokens
+//
+// Besides the legacy tokens, which are stored in the tokens bucket and looked
+// up on every request, /auth can issue signed tokens. A signed token carries
+// its claims (user, expiry, scopes and the ID of the key that signed it) and is
+// verified with the signing key alone, so it needs no database read:
+//
+//	pp1.<base64url claims JSON>.<base64url signature>
+//
+// Signing keys are generated by the server and stored in the signingkeys
+// bucket. The current key is replaced every SigningKeyRotation, and retired
+// keys are kept until every token they signed has expired. Revoked tokens are
+// kept on a revocation list until they would have expired, and revoking all of
+// a user's tokens gives the user a new token epoch, which every token they hold
+// must match. Keys, the revocation list and epochs are all held in memory.
+
+// Scopes a signed token may be limited to. Legacy tokens have all of them.
+const (
+	ScopeRead    = "objects:read"
+	ScopeWrite   = "objects:write"
+	ScopeAccount = "account"
+)
+
+var AllScopes = []string{ScopeRead, ScopeWrite, ScopeAccount}
+
+// Algorithms signing keys may use
+const (
+	AlgorithmHMAC    = "HS256"
+	AlgorithmEd25519 = "EdDSA"
+)
+
+// Algorithm of newly generated signing keys
+var SigningAlgorithm = AlgorithmHMAC
+
+// How long a signing key is used before it is replaced
+var SigningKeyRotation = 30 * 24 * time.Hour
+
+// How long a signed token is valid, the same as a legacy token
+var SignedTokenLifetime = 144 * time.Hour
+
+const signedTokenPrefix = "pp1."
+
+var (
+	ErrTokenInvalid = errors.New("Token is not a valid token")
+	ErrTokenExpired = errors.New("Token is expired")
+	ErrTokenRevoked = errors.New("Token has been revoked")
+)
+
+type TokenClaims struct {
+	Username string   `json:"sub"`
+	Epoch    string   `json:"epoch"`
+	Expires  int64    `json:"exp"`
+	IssuedAt int64    `json:"iat"`
+	Scopes   []string `json:"scp"`
+	KeyID    string   `json:"kid"`
+	ID       string   `json:"jti"`
+	// Refresh token family and device the token was issued to, if any
+	Family string `json:"fam,omitempty"`
+	Device string `json:"dev,omitempty"`
+}
+
+type SigningKey struct {
+	ID        string `json:"id"`
+	Algorithm string `json:"alg"`
+	// HMAC key, or Ed25519 seed
+	Secret  []byte `json:"secret"`
+	Created string `json:"created"`
+	Retired string `json:"retired,omitempty"`
+}
+
+func (key *SigningKey) sign(message []byte) []byte {
+	if key.Algorithm == AlgorithmEd25519 {
+		return ed25519.Sign(ed25519.NewKeyFromSeed(key.Secret), message)
+	}
+	mac := hmac.New(sha256.New, key.Secret)
+	mac.Write(message)
+	return mac.Sum(nil)
+}
+
+func (key *SigningKey) verify(message []byte, signature []byte) bool {
+	if key.Algorithm == AlgorithmEd25519 {
+		publicKey := ed25519.NewKeyFromSeed(key.Secret).Public().(ed25519.PublicKey)
+		return ed25519.Verify(publicKey, message, signature)
+	}
+	return hmac.Equal(key.sign(message), signature)
+}
+
+// signedTokenState is the in-memory copy of everything needed to verify a
+// signed token. It is loaded when the database is opened, and updated after
+// each change to the database commits.
+type signedTokenState struct {
+	mu      sync.RWMutex
+	keys    map[string]*SigningKey
+	current *SigningKey
+	// Expiry of each revoked token, by token ID, and of each revoked
+	// refresh token family or device, by its ID
+	revoked map[string]int64
+	// Token epoch of every user. Users missing from it don't exist.
+	epochs map[string]string
+}
+
+var signedTokens = &signedTokenState{}
+
+func isSignedToken(token string) bool {
+	return strings.HasPrefix(token, signedTokenPrefix)
+}
+
+// loadSignedTokenState reads signing keys, the revocation list and the token
+// epochs of users into memory. It replaces the revocation list and epochs
+// wholesale, so it is only used when the database is opened; afterwards they
+// are kept up to date as changes commit.
+func loadSignedTokenState(tx *bolt.Tx) error {
+	err := loadSigningKeys(tx)
+	if err != nil {
+		return err
+	}
+
+	revoked := map[string]int64{}
+	err = tx.Bucket([]byte("revokedtokens")).ForEach(func(k, v []byte) error {
+		revoked[string(k)] = int64(binary.BigEndian.Uint64(v))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	epochs := map[string]string{}
+	err = tx.Bucket([]byte("users")).ForEach(func(k, v []byte) error {
+		user := User{}
+		err := json.Unmarshal(v, &user)
+		if err != nil {
+			return err
+		}
+		epochs[user.Username] = user.TokenEpoch
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	signedTokens.mu.Lock()
+	defer signedTokens.mu.Unlock()
+	signedTokens.revoked = revoked
+	signedTokens.epochs = epochs
+	return nil
+}
+
+// loadSigningKeys reads the signing keys into memory, leaving the revocation
+// list and token epochs alone.
+func loadSigningKeys(tx *bolt.Tx) error {
+	keys := map[string]*SigningKey{}
+	var current *SigningKey
+	err := tx.Bucket([]byte("signingkeys")).ForEach(func(k, v []byte) error {
+		key := SigningKey{}
+		err := json.Unmarshal(v, &key)
+		if err != nil {
+			return err
+		}
+		keys[key.ID] = &key
+		if key.Retired == "" {
+			current = &key
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	signedTokens.mu.Lock()
+	defer signedTokens.mu.Unlock()
+	signedTokens.keys = keys
+	signedTokens.current = current
+	return nil
+}
+
+// setTokenEpoch records a user's token epoch in memory once it has been
+// committed to the database.
+func setTokenEpoch(username string, epoch string) {
+	signedTokens.mu.Lock()
+	defer signedTokens.mu.Unlock()
+	signedTokens.epochs[username] = epoch
+}
+
+// forgetTokenEpoch drops a deleted user's token epoch from memory, so none of
+// their signed tokens verify.
+func forgetTokenEpoch(username string) {
+	signedTokens.mu.Lock()
+	defer signedTokens.mu.Unlock()
+	delete(signedTokens.epochs, username)
+}
+
+// newTokenEpoch sets a new random token epoch on a user, invalidating every
+// signed token issued to them so far. The caller must put user and, once the
+// transaction commits, call setTokenEpoch.
+func newTokenEpoch(user *User) error {
+	epoch, err := randomID()
+	if err != nil {
+		return err
+	}
+	user.TokenEpoch = epoch
+	return nil
+}
+
+// rotateSigningKeys generates a new signing key if there is none or the
+// current one is older than SigningKeyRotation (or always, if force is set),
+// and drops retired keys that no unexpired token can have been signed with.
+// It reports whether a new key was generated.
+func rotateSigningKeys(force bool) (bool, error) {
+	now := time.Now().UTC()
+	rotated := false
+	err := MainDB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("signingkeys"))
+		var current *SigningKey
+		var expired [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			key := SigningKey{}
+			err := json.Unmarshal(v, &key)
+			if err != nil {
+				return err
+			}
+			if key.Retired == "" {
+				current = &key
+				return nil
+			}
+
+			retired, err := time.Parse("20060102150405", key.Retired)
+			if err != nil || now.Sub(retired) > SignedTokenLifetime {
+				expired = append(expired, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, k := range expired {
+			err = b.Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+
+		if current != nil && !force {
+			created, err := time.Parse("20060102150405", current.Created)
+			if err == nil && now.Sub(created) < SigningKeyRotation {
+				return nil
+			}
+		}
+
+		if current != nil {
+			current.Retired = now.Format("20060102150405")
+			err = putSigningKey(tx, current)
+			if err != nil {
+				return err
+			}
+		}
+
+		key, err := newSigningKey(SigningAlgorithm, now)
+		if err != nil {
+			return err
+		}
+		rotated = true
+		return putSigningKey(tx, key)
+	})
+	if err != nil {
+		return false, err
+	}
+
+	// Pick up the new keys. Revocations and epochs are already up to date,
+	// and reloading them could undo changes committed in the meantime.
+	return rotated, MainDB.View(loadSigningKeys)
+}
+
+func newSigningKey(algorithm string, now time.Time) (*SigningKey, error) {
+	if algorithm != AlgorithmHMAC && algorithm != AlgorithmEd25519 {
+		return nil, fmt.Errorf("Unknown signing algorithm %v", algorithm)
+	}
+
+	id, err := randomID()
+	if err != nil {
+		return nil, err
+	}
+	secret := make([]byte, 32)
+	_, err = rand.Read(secret)
+	if err != nil {
+		return nil, err
+	}
+	return &SigningKey{ID: id[:16], Algorithm: algorithm, Secret: secret, Created: now.Format("20060102150405")}, nil
+}
+
+func putSigningKey(tx *bolt.Tx, key *SigningKey) error {
+	buf, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket([]byte("signingkeys")).Put([]byte(key.ID), buf)
+}
+
+// issueSignedToken signs a new token for a user, limited to scopes. Access
+// tokens issued to a refresh token family only last AccessTokenLifetime. The
+// token is tied to device, if one is given.
+func issueSignedToken(user *User, scopes []string, family string, device string) (string, *TokenClaims, error) {
+	signedTokens.mu.RLock()
+	key := signedTokens.current
+	signedTokens.mu.RUnlock()
+	if key == nil {
+		return "", nil, fmt.Errorf("There is no signing key")
+	}
+
+	id, err := randomID()
+	if err != nil {
+		return "", nil, err
+	}
+	now := time.Now().UTC()
+	lifetime := SignedTokenLifetime
+	if family != "" {
+		lifetime = AccessTokenLifetime
+	}
+	claims := TokenClaims{
+		Username: user.Username,
+		Epoch:    user.TokenEpoch,
+		Expires:  now.Add(lifetime).Unix(),
+		IssuedAt: now.Unix(),
+		Scopes:   scopes,
+		KeyID:    key.ID,
+		ID:       id,
+		Family:   family,
+		Device:   device,
+	}
+
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		return "", nil, err
+	}
+	message := signedTokenPrefix + base64.RawURLEncoding.EncodeToString(claimsJSON)
+	signature := key.sign([]byte(message))
+	return message + "." + base64.RawURLEncoding.EncodeToString(signature), &claims, nil
+}
+
+// verifySignedToken checks a signed token's signature, expiry and revocation,
+// returning its claims.
+func verifySignedToken(token string) (*TokenClaims, error) {
+	dot := strings.LastIndex(token, ".")
+	if !isSignedToken(token) || dot < len(signedTokenPrefix) {
+		return nil, ErrTokenInvalid
+	}
+	message := token[:dot]
+
+	claimsJSON, err := base64.RawURLEncoding.DecodeString(message[len(signedTokenPrefix):])
+	if err != nil {
+		return nil, ErrTokenInvalid
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(token[dot+1:])
+	if err != nil {
+		return nil, ErrTokenInvalid
+	}
+	claims := TokenClaims{}
+	decoder := json.NewDecoder(bytes.NewReader(claimsJSON))
+	decoder.DisallowUnknownFields()
+	if decoder.Decode(&claims) != nil {
+		return nil, ErrTokenInvalid
+	}
+
+	signedTokens.mu.RLock()
+	defer signedTokens.mu.RUnlock()
+
+	key := signedTokens.keys[claims.KeyID]
+	if key == nil || !key.verify([]byte(message), signature) {
+		return nil, ErrTokenInvalid
+	}
+	if time.Now().UTC().Unix() >= claims.Expires {
+		return &claims, ErrTokenExpired
+	}
+	if _, revoked := signedTokens.revoked[claims.ID]; revoked {
+		return &claims, ErrTokenRevoked
+	}
+	if _, revoked := signedTokens.revoked[claims.Family]; revoked && claims.Family != "" {
+		return &claims, ErrTokenRevoked
+	}
+	if _, revoked := signedTokens.revoked[claims.Device]; revoked && claims.Device != "" {
+		return &claims, ErrTokenRevoked
+	}
+	if epoch, exists := signedTokens.epochs[claims.Username]; !exists || epoch != claims.Epoch {
+		return &claims, ErrTokenRevoked
+	}
+	return &claims, nil
+}
+
+// revokeSignedToken puts a signed token on the revocation list.
+func revokeSignedToken(claims *TokenClaims) error {
+	err := MainDB.Update(func(tx *bolt.Tx) error {
+		return putRevokedToken(tx, claims.ID, claims.Expires)
+	})
+	if err != nil {
+		return err
+	}
+	setRevokedToken(claims.ID, claims.Expires)
+	return nil
+}
+
+// putRevokedToken adds a token or token family ID to the revocation list
+// until expires. Once the transaction commits, the caller must call
+// setRevokedToken.
+func putRevokedToken(tx *bolt.Tx, id string, expires int64) error {
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, uint64(expires))
+	return tx.Bucket([]byte("revokedtokens")).Put([]byte(id), value)
+}
+
+// setRevokedToken records a revocation in memory once it has been committed
+// to the database.
+func setRevokedToken(id string, expires int64) {
+	signedTokens.mu.Lock()
+	defer signedTokens.mu.Unlock()
+	signedTokens.revoked[id] = expires
+}
+
+// sweepRevokedTokens drops tokens from the revocation list once they would
+// have expired anyway, returning how many were dropped.
+func sweepRevokedTokens(tx *bolt.Tx, now time.Time) (int, error) {
+	b := tx.Bucket([]byte("revokedtokens"))
+	var expired [][]byte
+	err := b.ForEach(func(k, v []byte) error {
+		if int64(binary.BigEndian.Uint64(v)) <= now.Unix() {
+			expired = append(expired, k)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, k := range expired {
+		err = b.Delete(k)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(expired), nil
+}
+
+// validScopes reports whether every requested scope exists.
+func validScopes(scopes []string) bool {
+	for _, scope := range scopes {
+		if !hasScope(AllScopes, scope) {
+			return false
+		}
+	}
+	return true
+}
+
+func hasScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
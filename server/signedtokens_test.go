@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signedTestRequest asks /auth for a signed token limited to scopes.
+func signedTestRequest(t *testing.T, username string, password string, format string, scopes []string) *httptest.ResponseRecorder {
+	authUserJSON := AuthUserRequestJSON{
+		Username: username,
+		Password: password,
+		ReqDate:  time.Now().UTC().Format("20060102150405"),
+		Format:   format,
+		Scopes:   scopes,
+	}
+	buffer, err := json.Marshal(authUserJSON)
+	req, err := http.NewRequest("GET", "/auth", bytes.NewBuffer(buffer))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(authUserHandler).ServeHTTP(rr, req)
+	return rr
+}
+
+// signedTestToken authenticates an existing user and returns a signed token
+// limited to scopes.
+func signedTestToken(t *testing.T, username string, password string, scopes ...string) string {
+	rr := signedTestRequest(t, username, password, "signed", scopes)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("auth handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+
+	response := AuthUserResponseJSON{}
+	err := json.NewDecoder(rr.Body).Decode(&response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isSignedToken(response.Token) || response.Nonce != "" {
+		t.Fatalf("Expected a signed token. Got %+v", response)
+	}
+	return response.Token
+}
+
+func TestSignedTokens(t *testing.T) {
+	createAndAuthUser(t, "signer", "foobar")
+	token := signedTestToken(t, "signer", "foobar")
+	readToken := signedTestToken(t, "signer", "foobar", ScopeRead)
+
+	uploadTestObject(t, token, "signed.txt", []byte("signed data"))
+	if status, body := getTestObject(t, readToken, "filename=signed.txt"); status != http.StatusOK || body != "signed data" {
+		t.Errorf("Expected object through read-only token. Got %v: %v", status, body)
+	}
+
+	// A token can't be used beyond its scopes
+	createJSON := CreateObjectRequestJSON{Token: readToken, FileName: "readonly.txt"}
+	buffer, _ := json.Marshal(createJSON)
+	req, err := http.NewRequest("POST", "/object", bytes.NewBuffer(buffer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(createObjectHandler).ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("create handler returned wrong status code: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+
+	// Nor can its claims be changed
+	dot := strings.LastIndex(readToken, ".")
+	claims, _ := json.Marshal(TokenClaims{Username: "signer", Scopes: AllScopes})
+	forged := signedTokenPrefix + base64.RawURLEncoding.EncodeToString(claims) + readToken[dot:]
+	tampered := readToken[:dot+1] + strings.Repeat("A", len(readToken)-dot-1)
+	for _, bad := range []string{forged, tampered, "pp1.garbage"} {
+		if status, _ := getTestObject(t, bad, "filename=signed.txt"); status != http.StatusNotFound {
+			t.Errorf("Expected forged token %v to be rejected. Got %v", bad, status)
+		}
+	}
+
+	// Tokens signed before a rotation keep working, whatever the new
+	// key's algorithm
+	SigningAlgorithm = AlgorithmEd25519
+	defer func() {
+		SigningAlgorithm = AlgorithmHMAC
+		rotateSigningKeys(true)
+	}()
+	if rotated, err := rotateSigningKeys(true); err != nil || !rotated {
+		t.Fatalf("Failed to rotate signing keys: %v", err)
+	}
+	edToken := signedTestToken(t, "signer", "foobar", ScopeRead)
+	for _, valid := range []string{token, readToken, edToken} {
+		if status, body := getTestObject(t, valid, "filename=signed.txt"); status != http.StatusOK || body != "signed data" {
+			t.Errorf("Expected object after key rotation. Got %v: %v", status, body)
+		}
+	}
+
+	// Revoking a token only revokes that one
+	req, err = http.NewRequest("DELETE", "/auth?token="+readToken, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(revokeTokenHandler).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("revoke handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if status, _ := getTestObject(t, readToken, "filename=signed.txt"); status != http.StatusNotFound {
+		t.Errorf("Expected revoked token to be rejected. Got %v", status)
+	}
+	if status, _ := getTestObject(t, edToken, "filename=signed.txt"); status != http.StatusOK {
+		t.Errorf("Expected other token to keep working. Got %v", status)
+	}
+}
+
+func TestSignedTokensRevokeAll(t *testing.T) {
+	legacyToken := createAndAuthUser(t, "epochal", "foobar")
+	token := signedTestToken(t, "epochal", "foobar")
+
+	revokeJSON := RevokeAllTokensRequestJSON{Token: token}
+	buffer, _ := json.Marshal(revokeJSON)
+	req, err := http.NewRequest("POST", "/auth/revoke-all", bytes.NewBuffer(buffer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(revokeAllTokensHandler).ServeHTTP(rr, req)
+
+	// Only stored tokens are counted
+	if status := rr.Code; status != http.StatusOK || rr.Body.String() != "1" {
+		t.Fatalf("revoke-all handler returned %v: %v", status, rr.Body.String())
+	}
+	for _, revoked := range []string{token, legacyToken} {
+		if status, _ := getTestObject(t, revoked, "filename=anything"); status != http.StatusNotFound {
+			t.Errorf("Expected revoked token to be rejected. Got %v", status)
+		}
+	}
+
+	// Tokens issued afterwards work
+	token = signedTestToken(t, "epochal", "foobar")
+	if status, body := getTestObject(t, token, "filename=anything"); !strings.HasPrefix(body, "Failed to find object") {
+		t.Errorf("Expected new token to work. Got %v: %v", status, body)
+	}
+}
+
+func TestSignedTokenExpired(t *testing.T) {
+	createAndAuthUser(t, "ephemeral", "foobar")
+
+	oldLifetime := SignedTokenLifetime
+	SignedTokenLifetime = -time.Minute
+	defer func() { SignedTokenLifetime = oldLifetime }()
+
+	token := signedTestToken(t, "ephemeral", "foobar")
+	if status, _ := getTestObject(t, token, "filename=anything"); status != http.StatusPreconditionFailed {
+		t.Errorf("Expected expired token to be rejected. Got %v", status)
+	}
+}
+
+func TestSignedTokenBadRequest(t *testing.T) {
+	createAndAuthUser(t, "indecisive", "foobar")
+
+	if rr := signedTestRequest(t, "indecisive", "foobar", "jwt", nil); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected unknown format to be refused. Got %v", rr.Code)
+	}
+	if rr := signedTestRequest(t, "indecisive", "foobar", "signed", []string{"objects:everything"}); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected unknown scope to be refused. Got %v", rr.Code)
+	}
+}
+
+func TestKeyRotationKeepsRevocations(t *testing.T) {
+	// Revocations and epochs recorded in memory while the keys are reloaded,
+	// as if they committed just after the reload started, survive it
+	setRevokedToken("revokedmidrotation", time.Now().UTC().Add(time.Hour).Unix())
+	setTokenEpoch("rotationwatcher", "bumpedmidrotation")
+	defer forgetTokenEpoch("rotationwatcher")
+
+	if rotated, err := rotateSigningKeys(true); err != nil || !rotated {
+		t.Fatalf("Failed to rotate signing keys: %v", err)
+	}
+
+	signedTokens.mu.RLock()
+	defer signedTokens.mu.RUnlock()
+	if _, ok := signedTokens.revoked["revokedmidrotation"]; !ok {
+		t.Errorf("Expected revocation to survive key rotation")
+	}
+	if epoch := signedTokens.epochs["rotationwatcher"]; epoch != "bumpedmidrotation" {
+		t.Errorf("Expected token epoch to survive key rotation. Got %q", epoch)
+	}
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Two-factor authentication
+//
+// Users may enroll a TOTP authenticator (RFC 6238: HMAC-SHA1, 6 digits, 30
+// second steps). Enrollment only takes effect once the user confirms it with a
+// code from the authenticator, so a mis-scanned secret can't lock them out.
+// From then on /auth only issues tokens to clients that also give a current
+// code. Codes from one step either side of the current one are
+// accepted to allow for clock drift, and each step's code can only be used
+// once. Enrolling also hands out recovery codes, each of which can be used once
+// instead of a TOTP code; only their SHA-256 digests are stored.
+
+const (
+	totpIssuer        = "PiedPiper"
+	totpDigits        = 6
+	totpPeriod        = 30
+	totpSkew          = 1
+	recoveryCodeCount = 10
+)
+
+var (
+	ErrSecondFactorRequired = errors.New("A two-factor code is required")
+	ErrSecondFactorInvalid  = errors.New("Two-factor code is not valid")
+)
+
+type TwoFactorRequestJSON struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+type ConfirmTwoFactorRequestJSON struct {
+	Token string `json:"token"`
+	Code  string `json:"code"`
+}
+
+type TwoFactorResponseJSON struct {
+	// otpauth:// URI to give to an authenticator app, usually as a QR code
+	URI           string   `json:"uri"`
+	Secret        string   `json:"secret"`
+	RecoveryCodes []string `json:"recoverycodes"`
+}
+
+func totpEnabled(user *User) bool {
+	return user.TOTPSecret != ""
+}
+
+// totpCode computes the code for a time step.
+func totpCode(secret []byte, step int64) string {
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+func decodeTOTPSecret(secret string) ([]byte, error) {
+	return base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+}
+
+func recoveryCodeDigest(code string) string {
+	normalized := strings.ToUpper(strings.Replace(code, "-", "", -1))
+	digest := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(digest[:])
+}
+
+// newRecoveryCodes generates a fresh set of recovery codes, returning them
+// along with the digests to store.
+func newRecoveryCodes() ([]string, []string, error) {
+	var codes, digests []string
+	for i := 0; i < recoveryCodeCount; i++ {
+		raw := make([]byte, 5)
+		_, err := rand.Read(raw)
+		if err != nil {
+			return nil, nil, err
+		}
+		code := base32.StdEncoding.EncodeToString(raw)
+		code = code[:4] + "-" + code[4:]
+		codes = append(codes, code)
+		digests = append(digests, recoveryCodeDigest(code))
+	}
+	return codes, digests, nil
+}
+
+// checkSecondFactor checks a TOTP or recovery code given by a user, using it
+// up if it is valid. The caller must put user.
+func checkSecondFactor(user *User, code string, now time.Time) error {
+	if code == "" {
+		return ErrSecondFactorRequired
+	}
+
+	if len(code) == totpDigits {
+		return checkTOTPCode(user, user.TOTPSecret, code, now)
+	}
+
+	digest := recoveryCodeDigest(code)
+	for i, stored := range user.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(stored), []byte(digest)) == 1 {
+			user.RecoveryCodes = append(user.RecoveryCodes[:i:i], user.RecoveryCodes[i+1:]...)
+			return nil
+		}
+	}
+	return ErrSecondFactorInvalid
+}
+
+// checkTOTPCode checks a TOTP code against a user's secret, recording its time
+// step so it can't be used again. The caller must put user.
+func checkTOTPCode(user *User, encodedSecret string, code string, now time.Time) error {
+	secret, err := decodeTOTPSecret(encodedSecret)
+	if err != nil {
+		return err
+	}
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= user.TOTPLastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) == 1 {
+			user.TOTPLastStep = step
+			return nil
+		}
+	}
+	return ErrSecondFactorInvalid
+}
+
+// verifySecondFactor checks the code given when a user with two-factor
+// authentication enabled logs in, and records that it has been used.
+func verifySecondFactor(username string, code string) error {
+	return MainDB.Update(func(tx *bolt.Tx) error {
+		user, err := getUser(tx, username)
+		if err != nil {
+			return err
+		}
+		if user == nil {
+			return fmt.Errorf("User %v does not exist", username)
+		}
+		if !totpEnabled(user) {
+			return nil
+		}
+
+		err = checkSecondFactor(user, code, time.Now().UTC())
+		if err != nil {
+			return err
+		}
+		return putUser(tx, user)
+	})
+}
+
+func enrollTwoFactorHandler(res http.ResponseWriter, req *http.Request) {
+	requestJSON := TwoFactorRequestJSON{}
+	err := json.NewDecoder(req.Body).Decode(&requestJSON)
+	if err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(res, "Error in decoding message")
+		return
+	}
+
+	// Check and validate token
+	token := validateToken(res, requestJSON.Token, ScopeAccount)
+	if token == nil {
+		return
+	}
+	if confirmPassword(res, token.User.Username, requestJSON.Password) == nil {
+		return
+	}
+
+	secret := make([]byte, 20)
+	_, err = rand.Read(secret)
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error generating TOTP secret: %v", err)
+		return
+	}
+	encodedSecret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret)
+	codes, digests, err := newRecoveryCodes()
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error generating recovery codes: %v", err)
+		return
+	}
+
+	alreadyEnabled := false
+	err = MainDB.Update(func(tx *bolt.Tx) error {
+		user, err := getUser(tx, token.User.Username)
+		if err != nil {
+			return err
+		}
+		if user == nil {
+			return fmt.Errorf("Owner of token %v does not exist", token.User.Username)
+		}
+		if totpEnabled(user) {
+			alreadyEnabled = true
+			return nil
+		}
+
+		// Enrolling again before confirming replaces the pending secret
+		user.TOTPPendingSecret = encodedSecret
+		user.TOTPLastStep = 0
+		user.RecoveryCodes = digests
+		return putUser(tx, user)
+	})
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error enrolling user %v in two-factor authentication: %v", token.User.Username, err)
+		return
+	}
+	if alreadyEnabled {
+		res.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(res, "Two-factor authentication is already enabled for user %v", token.User.Username)
+		return
+	}
+
+	label := url.PathEscape(totpIssuer + ":" + token.User.Username)
+	query := url.Values{}
+	query.Set("secret", encodedSecret)
+	query.Set("issuer", totpIssuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprintf("%v", totpDigits))
+	query.Set("period", fmt.Sprintf("%v", totpPeriod))
+
+	responseJSON := TwoFactorResponseJSON{
+		URI:           "otpauth://totp/" + label + "?" + query.Encode(),
+		Secret:        encodedSecret,
+		RecoveryCodes: codes,
+	}
+	responseData, err := json.Marshal(responseJSON)
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error marshalling response for client: %v", err)
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.Write(responseData)
+	log.Printf("User %v has started enrolling in two-factor authentication", token.User.Username)
+}
+
+// confirmTwoFactorHandler enables two-factor authentication once the user shows
+// their authenticator produces valid codes for the pending secret.
+func confirmTwoFactorHandler(res http.ResponseWriter, req *http.Request) {
+	requestJSON := ConfirmTwoFactorRequestJSON{}
+	err := json.NewDecoder(req.Body).Decode(&requestJSON)
+	if err != nil || len(requestJSON.Code) != totpDigits {
+		res.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(res, "Error in decoding message")
+		return
+	}
+
+	// Check and validate token
+	token := validateToken(res, requestJSON.Token, ScopeAccount)
+	if token == nil {
+		return
+	}
+
+	pending := false
+	err = MainDB.Update(func(tx *bolt.Tx) error {
+		user, err := getUser(tx, token.User.Username)
+		if err != nil {
+			return err
+		}
+		if user == nil {
+			return fmt.Errorf("Owner of token %v does not exist", token.User.Username)
+		}
+		if user.TOTPPendingSecret == "" {
+			return nil
+		}
+		pending = true
+
+		err = checkTOTPCode(user, user.TOTPPendingSecret, requestJSON.Code, time.Now().UTC())
+		if err != nil {
+			return err
+		}
+		user.TOTPSecret = user.TOTPPendingSecret
+		user.TOTPPendingSecret = ""
+		return putUser(tx, user)
+	})
+	if err == ErrSecondFactorInvalid {
+		res.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(res, "%v", err)
+		return
+	}
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error confirming two-factor authentication of user %v: %v", token.User.Username, err)
+		return
+	}
+	if !pending {
+		res.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(res, "User %v has no two-factor enrollment to confirm", token.User.Username)
+		return
+	}
+	log.Printf("User %v has enabled two-factor authentication", token.User.Username)
+}
+
+func disableTwoFactorHandler(res http.ResponseWriter, req *http.Request) {
+	requestJSON := TwoFactorRequestJSON{}
+	err := json.NewDecoder(req.Body).Decode(&requestJSON)
+	if err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(res, "Error in decoding message")
+		return
+	}
+
+	// Check and validate token
+	token := validateToken(res, requestJSON.Token, ScopeAccount)
+	if token == nil {
+		return
+	}
+	if confirmPassword(res, token.User.Username, requestJSON.Password) == nil {
+		return
+	}
+
+	err = MainDB.Update(func(tx *bolt.Tx) error {
+		user, err := getUser(tx, token.User.Username)
+		if err != nil {
+			return err
+		}
+		if user == nil {
+			return fmt.Errorf("Owner of token %v does not exist", token.User.Username)
+		}
+
+		user.TOTPSecret = ""
+		user.TOTPPendingSecret = ""
+		user.TOTPLastStep = 0
+		user.RecoveryCodes = nil
+		return putUser(tx, user)
+	})
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error disabling two-factor authentication of user %v: %v", token.User.Username, err)
+		return
+	}
+	log.Printf("User %v has disabled two-factor authentication", token.User.Username)
+}
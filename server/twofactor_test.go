@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+func twoFactorTestRequest(t *testing.T, handler http.HandlerFunc, method string, token string, password string) *httptest.ResponseRecorder {
+	requestJSON := TwoFactorRequestJSON{Token: token, Password: password}
+	buffer, _ := json.Marshal(requestJSON)
+	req, err := http.NewRequest(method, "/user/2fa", bytes.NewBuffer(buffer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func authTestRequestWithCode(t *testing.T, username string, password string, code string) *httptest.ResponseRecorder {
+	authUserJSON := AuthUserRequestJSON{
+		Username: username,
+		Password: password,
+		ReqDate:  time.Now().UTC().Format("20060102150405"),
+		OTP:      code,
+	}
+	buffer, _ := json.Marshal(authUserJSON)
+	req, err := http.NewRequest("GET", "/auth", bytes.NewBuffer(buffer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(authUserHandler).ServeHTTP(rr, req)
+	return rr
+}
+
+func confirmTwoFactorTestRequest(t *testing.T, token string, code string) *httptest.ResponseRecorder {
+	requestJSON := ConfirmTwoFactorRequestJSON{Token: token, Code: code}
+	buffer, _ := json.Marshal(requestJSON)
+	req, err := http.NewRequest("POST", "/user/2fa/confirm", bytes.NewBuffer(buffer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(confirmTwoFactorHandler).ServeHTTP(rr, req)
+	return rr
+}
+
+func TestTOTPCode(t *testing.T) {
+	// Test vectors from RFC 6238, truncated to 6 digits
+	secret := []byte("12345678901234567890")
+	vectors := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+	for seconds, expected := range vectors {
+		if code := totpCode(secret, seconds/totpPeriod); code != expected {
+			t.Errorf("Wrong code at %v: got %v want %v", seconds, code, expected)
+		}
+	}
+}
+
+func TestTwoFactorAuth(t *testing.T) {
+	// This takes more attempts than a user is usually allowed
+	oldLimiter := AuthUserLimiter
+	AuthUserLimiter = NewRateLimiter(6000, 1000)
+	defer func() { AuthUserLimiter = oldLimiter }()
+
+	token := createAndAuthUser(t, "cautious", "foobar")
+
+	if rr := twoFactorTestRequest(t, enrollTwoFactorHandler, "POST", token, "wrong"); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected enrollment with wrong password to be refused. Got %v", rr.Code)
+	}
+	rr := twoFactorTestRequest(t, enrollTwoFactorHandler, "POST", token, "foobar")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("2fa handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	enrollment := TwoFactorResponseJSON{}
+	err := json.Unmarshal(rr.Body.Bytes(), &enrollment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(enrollment.URI, "otpauth://totp/PiedPiper:cautious?") || !strings.Contains(enrollment.URI, "secret="+enrollment.Secret) {
+		t.Errorf("Unexpected otpauth URI %v", enrollment.URI)
+	}
+	if len(enrollment.RecoveryCodes) != recoveryCodeCount {
+		t.Errorf("Expected %v recovery codes. Got %v", recoveryCodeCount, enrollment.RecoveryCodes)
+	}
+	secret, err := decodeTOTPSecret(enrollment.Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing changes until the enrollment is confirmed with a valid code
+	if rr := authTestRequestWithCode(t, "cautious", "foobar", ""); rr.Code != http.StatusOK {
+		t.Errorf("Expected login without a code before confirming. Got %v", rr.Code)
+	}
+	if rr := confirmTwoFactorTestRequest(t, token, "000000"); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected confirmation with a wrong code to be refused. Got %v", rr.Code)
+	}
+	if rr := confirmTwoFactorTestRequest(t, token, totpCode(secret, time.Now().UTC().Unix()/totpPeriod)); rr.Code != http.StatusOK {
+		t.Fatalf("2fa confirm handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if rr := confirmTwoFactorTestRequest(t, token, "000000"); rr.Code != http.StatusConflict {
+		t.Errorf("Expected nothing left to confirm. Got %v", rr.Code)
+	}
+	if rr := twoFactorTestRequest(t, enrollTwoFactorHandler, "POST", token, "foobar"); rr.Code != http.StatusConflict {
+		t.Errorf("Expected second enrollment to be refused. Got %v", rr.Code)
+	}
+
+	// The password alone no longer gets a token
+	if rr := authTestRequestWithCode(t, "cautious", "foobar", ""); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected login without a code to be refused. Got %v", rr.Code)
+	}
+	if rr := authTestRequestWithCode(t, "cautious", "foobar", "000000"); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected login with a wrong code to be refused. Got %v", rr.Code)
+	}
+
+	// The confirmation used up the current code, but the next one is accepted
+	// too
+	code := totpCode(secret, time.Now().UTC().Unix()/totpPeriod+1)
+	if rr := authTestRequestWithCode(t, "cautious", "foobar", code); rr.Code != http.StatusOK {
+		t.Errorf("Expected login with a valid code. Got %v: %v", rr.Code, rr.Body.String())
+	}
+	if rr := authTestRequestWithCode(t, "cautious", "foobar", code); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected a used code to be refused. Got %v", rr.Code)
+	}
+
+	// Recovery codes work once each, whatever their case
+	recoveryCode := strings.ToLower(enrollment.RecoveryCodes[3])
+	if rr := authTestRequestWithCode(t, "cautious", "foobar", recoveryCode); rr.Code != http.StatusOK {
+		t.Errorf("Expected login with a recovery code. Got %v: %v", rr.Code, rr.Body.String())
+	}
+	if rr := authTestRequestWithCode(t, "cautious", "foobar", recoveryCode); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected a used recovery code to be refused. Got %v", rr.Code)
+	}
+
+	// Tokens don't keep a copy of the secrets they were issued against
+	err = MainDB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("tokens")).ForEach(func(k, v []byte) error {
+			stored := Token{}
+			err := json.Unmarshal(v, &stored)
+			if err != nil {
+				return err
+			}
+			if stored.User.Username == "cautious" && (stored.User.PasswordHash != nil || stored.User.TOTPSecret != "" || stored.User.RecoveryCodes != nil) {
+				t.Errorf("Token of user %v stores their secrets", stored.User.Username)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rr := twoFactorTestRequest(t, disableTwoFactorHandler, "DELETE", token, "foobar"); rr.Code != http.StatusOK {
+		t.Fatalf("2fa handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	authTestUser(t, "cautious", "foobar")
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/boltdb/bolt"
+)
+
+// Resumable uploads
+//
+// Instead of sending an object in one request, a client may send it in parts
+// to /object/<UploadID>, each with a Content-Range header saying where the
+// part belongs. Parts are written straight into a part file next to the
+// object's data file, and the ranges received so far are recorded on the
+// UploadSession so a client whose connection dropped can ask what is missing.
+// Once every byte has arrived, the client completes the upload: the part file
+// is streamed into the blob store under a fresh key, its digest checked on the
+// way, and finishUpload records the data on the object and removes the part
+// file. Part files of uploads that are never completed are removed by the
+// janitor along with their expired objects.
+
+// ByteRange is an inclusive range of byte offsets, as in a Content-Range header.
+type ByteRange struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+type UploadStatusJSON struct {
+	UploadID string      `json:"uploadid"`
+	Size     int64       `json:"size"`
+	Received []ByteRange `json:"received"`
+	Complete bool        `json:"complete"`
+}
+
+var contentRangeRegexp = regexp.MustCompile(`^bytes (\d+)-(\d+)/(\d+)$`)
+
+// parseContentRange parses a header of the form "bytes <start>-<end>/<size>".
+func parseContentRange(header string) (ByteRange, int64, error) {
+	matches := contentRangeRegexp.FindStringSubmatch(header)
+	if matches == nil {
+		return ByteRange{}, 0, fmt.Errorf("Content-Range '%v' is not of the form 'bytes <start>-<end>/<size>'", header)
+	}
+
+	// The regexp only matches digits, so these can only fail by overflowing
+	start, err1 := strconv.ParseInt(matches[1], 10, 64)
+	end, err2 := strconv.ParseInt(matches[2], 10, 64)
+	size, err3 := strconv.ParseInt(matches[3], 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return ByteRange{}, 0, fmt.Errorf("Content-Range '%v' is out of range", header)
+	}
+
+	if start > end || end >= size {
+		return ByteRange{}, 0, fmt.Errorf("Content-Range '%v' does not describe bytes within the object", header)
+	}
+	return ByteRange{Start: start, End: end}, size, nil
+}
+
+// addRange adds a range to a list of received ranges, merging it with any
+// ranges it overlaps or touches so that the list stays sorted and minimal.
+func addRange(ranges []ByteRange, newRange ByteRange) []ByteRange {
+	ranges = append(ranges, newRange)
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].Start < ranges[j].Start
+	})
+
+	merged := []ByteRange{ranges[0]}
+	for _, r := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if r.Start <= last.End+1 {
+			if r.End > last.End {
+				last.End = r.End
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// uploadComplete reports whether every byte of a resumable upload has arrived.
+func uploadComplete(uploadSession *UploadSession) bool {
+	return uploadSession.Size > 0 && len(uploadSession.Received) == 1 &&
+		uploadSession.Received[0].Start == 0 && uploadSession.Received[0].End == uploadSession.Size-1
+}
+
+// partFilePath is where the parts of a resumable upload are assembled.
+func partFilePath(object *Object) string {
+	return path.Join(DataPath, object.LocalFileName+".part")
+}
+
+func uploadStatus(uploadSession *UploadSession) UploadStatusJSON {
+	status := UploadStatusJSON{
+		UploadID: uploadSession.ID,
+		Size:     uploadSession.Size,
+		Received: uploadSession.Received,
+		Complete: uploadComplete(uploadSession),
+	}
+	if status.Received == nil {
+		status.Received = []ByteRange{}
+	}
+	return status
+}
+
+func writeUploadStatus(res http.ResponseWriter, uploadSession *UploadSession) {
+	responseData, err := json.Marshal(uploadStatus(uploadSession))
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error marshalling response for client: %v", err)
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.Write(responseData)
+}
+
+// uploadObjectPart writes one part of a resumable upload into the part file
+// and records it on the upload session.
+func uploadObjectPart(res http.ResponseWriter, req *http.Request, uploadSession *UploadSession) {
+	partRange, size, err := parseContentRange(req.Header.Get("Content-Range"))
+	if err != nil {
+		res.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		fmt.Fprintf(res, "%v", err)
+		return
+	}
+
+	if uploadSession.Size != 0 && uploadSession.Size != size {
+		res.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(res, "Upload %v was started with a size of %v bytes, not %v", uploadSession.ID, uploadSession.Size, size)
+		return
+	}
+
+	// The limit applies to the whole object, not each part, which also keeps
+	// parts from being written at arbitrary offsets
+	if size > MaxUploadSize {
+		res.WriteHeader(http.StatusRequestEntityTooLarge)
+		fmt.Fprintf(res, "Uploads may be at most %v bytes", MaxUploadSize)
+		return
+	}
+	partLength := partRange.End - partRange.Start + 1
+
+	// Don't collect parts of an object that won't fit in the owner's quota
+	remaining, limited, err := remainingBytes(uploadSession.Object.Owner)
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error reading quota of user %v: %v", uploadSession.Object.Owner, err)
+		return
+	}
+	if limited && size > remaining {
+		writeQuotaExceeded(res)
+		return
+	}
+
+	// Write the part straight to its place in the part file. Parts may arrive
+	// in any order, and concurrently, since each request has its own offset.
+	partFile, err := os.OpenFile(partFilePath(&uploadSession.Object), os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error opening part file of upload %v: %v", uploadSession.ID, err)
+		return
+	}
+	defer partFile.Close()
+
+	_, err = partFile.Seek(partRange.Start, io.SeekStart)
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error seeking in part file of upload %v: %v", uploadSession.ID, err)
+		return
+	}
+
+	written, err := io.CopyN(partFile, req.Body, partLength)
+	if err != nil {
+		// Whatever did arrive was written, but isn't recorded, so the client
+		// resends the whole part
+		res.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(res, "Expected %v bytes in part but only received %v", partLength, written)
+		return
+	}
+
+	// The part must be on disk before we tell the client we have it
+	err = partFile.Sync()
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error syncing part file of upload %v: %v", uploadSession.ID, err)
+		return
+	}
+
+	// Record the part. The session is re-read, since other parts may have been
+	// recorded while this one was being written, possibly with another size.
+	sizeChanged := false
+	err = MainDB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("uploads"))
+		uploadData := b.Get([]byte(uploadSession.ID))
+		if uploadData == nil {
+			uploadSession = nil
+			return nil
+		}
+
+		err := json.Unmarshal(uploadData, uploadSession)
+		if err != nil {
+			return err
+		}
+		if uploadSession.Size != 0 && uploadSession.Size != size {
+			sizeChanged = true
+			return nil
+		}
+		uploadSession.Size = size
+		uploadSession.Received = addRange(uploadSession.Received, partRange)
+
+		buf, err := json.Marshal(uploadSession)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(uploadSession.ID), buf)
+	})
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error recording part of upload: %v", err)
+		return
+	}
+
+	if uploadSession == nil {
+		res.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(res, "Upload is no longer in progress")
+		return
+	}
+	if sizeChanged {
+		res.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(res, "Upload %v was started with a size of %v bytes, not %v", uploadSession.ID, uploadSession.Size, size)
+		return
+	}
+
+	writeUploadStatus(res, uploadSession)
+	log.Printf("Bytes %v-%v of object %v have been uploaded with UploadID %v", partRange.Start, partRange.End, uploadSession.Object.ID, uploadSession.ID)
+}
+
+// resetUpload discards every part received for a resumable upload.
+func resetUpload(uploadSession *UploadSession) error {
+	err := MainDB.Update(func(tx *bolt.Tx) error {
+		uploadSession.Size = 0
+		uploadSession.Received = nil
+		return putUploadSession(tx, uploadSession)
+	})
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(partFilePath(&uploadSession.Object))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func uploadStatusHandler(res http.ResponseWriter, req *http.Request) {
+	uploadSession := getUploadSession(res, req)
+	if uploadSession == nil {
+		return
+	}
+
+	writeUploadStatus(res, uploadSession)
+}
+
+func completeUploadHandler(res http.ResponseWriter, req *http.Request) {
+	uploadSession := getUploadSession(res, req)
+	if uploadSession == nil {
+		return
+	}
+
+	if !uploadComplete(uploadSession) {
+		res.WriteHeader(http.StatusPreconditionFailed)
+		fmt.Fprintf(res, "Upload %v is missing parts", uploadSession.ID)
+		return
+	}
+
+	expectedDigest, err := expectedUploadDigest(req, uploadSession)
+	if err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(res, "%v", err)
+		return
+	}
+
+	// Hand the assembled parts to the blob store, checking them on the way
+	partFile, err := os.Open(partFilePath(&uploadSession.Object))
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error opening part file of upload %v: %v", uploadSession.ID, err)
+		return
+	}
+	data := newDigestReader(partFile, expectedDigest)
+	key, err := randomFileName()
+	if err != nil {
+		partFile.Close()
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error generating key for upload %v: %v", uploadSession.ID, err)
+		return
+	}
+	dataKey, err := storeObjectData(key, data)
+	partFile.Close()
+
+	// If the parts are corrupt there is no telling which, so start over
+	if errors.Is(err, ErrDigestMismatch) {
+		err = resetUpload(uploadSession)
+		if err != nil {
+			res.WriteHeader(http.StatusInternalServerError)
+			log.Printf("Error discarding parts of upload %v: %v", uploadSession.ID, err)
+			return
+		}
+		res.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(res, "%v", ErrDigestMismatch)
+		log.Printf("Upload %v for object %v did not match its digest", uploadSession.ID, uploadSession.Object.ID)
+		return
+	}
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error storing assembled upload %v: %v", uploadSession.ID, err)
+		return
+	}
+
+	err = finishUpload(uploadSession, key, uploadSession.Size, data.Sum(), dataKey)
+	if err == ErrQuotaExceeded {
+		writeQuotaExceeded(res)
+		return
+	}
+	if err == ErrUploadSessionGone {
+		res.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(res, "UploadID %v is not valid", uploadSession.ID)
+		return
+	}
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Error finalizing upload %v for object %v: %v", uploadSession.ID, uploadSession.Object.ID, err)
+		return
+	}
+	log.Printf("Object %v has been uploaded in parts with UploadID %v", uploadSession.Object.ID, uploadSession.ID)
+}
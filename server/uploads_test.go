@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func uploadTestPart(t *testing.T, token string, uploadID string, contentRange string, data []byte) *httptest.ResponseRecorder {
+	req, err := http.NewRequest("PUT", "/object/"+uploadID+"?token="+token, bytes.NewBuffer(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Range", contentRange)
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(uploadObjectHandler).ServeHTTP(rr, req)
+	return rr
+}
+
+func TestAddRange(t *testing.T) {
+	ranges := []ByteRange{}
+	ranges = addRange(ranges, ByteRange{10, 19})
+	ranges = addRange(ranges, ByteRange{30, 39})
+	ranges = addRange(ranges, ByteRange{0, 9})
+	if len(ranges) != 2 || ranges[0] != (ByteRange{0, 19}) || ranges[1] != (ByteRange{30, 39}) {
+		t.Errorf("Unexpected ranges: %v", ranges)
+	}
+
+	ranges = addRange(ranges, ByteRange{15, 35})
+	if len(ranges) != 1 || ranges[0] != (ByteRange{0, 39}) {
+		t.Errorf("Unexpected ranges: %v", ranges)
+	}
+}
+
+func TestParseContentRange(t *testing.T) {
+	partRange, size, err := parseContentRange("bytes 5-9/20")
+	if err != nil || partRange != (ByteRange{5, 9}) || size != 20 {
+		t.Errorf("Unexpected parse: %v %v %v", partRange, size, err)
+	}
+
+	for _, header := range []string{"bytes 9-5/20", "bytes 5-20/20", "bytes 0-4/*", "items 0-4/5"} {
+		if _, _, err := parseContentRange(header); err == nil {
+			t.Errorf("Expected '%v' to be rejected", header)
+		}
+	}
+}
+
+func TestResumableUpload(t *testing.T) {
+	token := createAndAuthUser(t, "resumer", "foobar")
+	uploadID := createTestObject(t, token, "big.bin")
+
+	data := []byte("0123456789abcdefghij")
+
+	// Upload the second half first
+	rr := uploadTestPart(t, token, uploadID, "bytes 10-19/20", data[10:])
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("upload handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+
+	// A part that disagrees about the size is rejected
+	rr = uploadTestPart(t, token, uploadID, "bytes 0-4/30", data[:5])
+	if status := rr.Code; status != http.StatusConflict {
+		t.Errorf("upload handler returned wrong status code: got %v want %v",
+			status, http.StatusConflict)
+	}
+
+	// Completing early fails
+	req, err := http.NewRequest("POST", "/object/"+uploadID+"/complete?token="+token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(completeUploadHandler).ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusPreconditionFailed {
+		t.Errorf("complete handler returned wrong status code: got %v want %v",
+			status, http.StatusPreconditionFailed)
+	}
+
+	// Ask which parts the server has
+	req, err = http.NewRequest("GET", "/object/"+uploadID+"?token="+token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(uploadStatusHandler).ServeHTTP(rr, req)
+
+	status := UploadStatusJSON{}
+	err = json.NewDecoder(rr.Body).Decode(&status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Size != 20 || len(status.Received) != 1 || status.Received[0] != (ByteRange{10, 19}) || status.Complete {
+		t.Fatalf("Unexpected upload status: %+v", status)
+	}
+
+	// Fill in the rest
+	rr = uploadTestPart(t, token, uploadID, "bytes 0-9/20", data[:10])
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("upload handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+
+	var partFile string
+	err = MainDB.View(func(tx *bolt.Tx) error {
+		uploadSession := UploadSession{}
+		err := json.Unmarshal(tx.Bucket([]byte("uploads")).Get([]byte(uploadID)), &uploadSession)
+		partFile = partFilePath(&uploadSession.Object)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(partFile); err != nil {
+		t.Fatalf("Expected parts to be assembled in %v: %v", partFile, err)
+	}
+
+	req, err = http.NewRequest("POST", "/object/"+uploadID+"/complete?token="+token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(completeUploadHandler).ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("complete handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+
+	if status, body := getTestObject(t, token, "filename=big.bin"); status != http.StatusOK || body != string(data) {
+		t.Errorf("Expected assembled object. Got %v: %v", status, body)
+	}
+	if _, err := os.Stat(partFile); !os.IsNotExist(err) {
+		t.Errorf("Expected part file to be removed once the upload completed. Got %v", err)
+	}
+}
+
+func TestResumableUploadDigestMismatch(t *testing.T) {
+	token := createAndAuthUser(t, "corrupter", "foobar")
+	uploadID := createTestObject(t, token, "corrupt.bin")
+
+	expected := sha256.Sum256([]byte("what the client meant to send"))
+	uploadTestPart(t, token, uploadID, "bytes 0-9/10", []byte("0123456789"))
+
+	req, err := http.NewRequest("POST", "/object/"+uploadID+"/complete?token="+token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Digest", "SHA-256="+base64.StdEncoding.EncodeToString(expected[:]))
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(completeUploadHandler).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Fatalf("complete handler returned wrong status code: got %v want %v",
+			status, http.StatusBadRequest)
+	}
+
+	// The parts were discarded
+	req, err = http.NewRequest("GET", "/object/"+uploadID+"?token="+token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(uploadStatusHandler).ServeHTTP(rr, req)
+
+	status := UploadStatusJSON{}
+	err = json.NewDecoder(rr.Body).Decode(&status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Received) != 0 {
+		t.Errorf("Expected parts to be discarded. Got %+v", status)
+	}
+}
+
+func TestResumableUploadSizeLimit(t *testing.T) {
+	oldMaxUploadSize := MaxUploadSize
+	MaxUploadSize = 10
+	defer func() { MaxUploadSize = oldMaxUploadSize }()
+
+	token := createAndAuthUser(t, "piecemeal", "foobar")
+	uploadID := createTestObject(t, token, "sliced.bin")
+
+	// Parts within the limit can't add up to an object beyond it
+	if rr := uploadTestPart(t, token, uploadID, "bytes 0-9/30", []byte("0123456789")); rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected object beyond the limit to be refused. Got %v", rr.Code)
+	}
+	if rr := uploadTestPart(t, token, uploadID, "bytes 0-0/1000000000000", []byte("0")); rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected huge declared size to be refused. Got %v", rr.Code)
+	}
+	if rr := uploadTestPart(t, token, uploadID, "bytes 0-9/10", []byte("0123456789")); rr.Code != http.StatusOK {
+		t.Errorf("Expected object within the limit to be accepted. Got %v", rr.Code)
+	}
+}